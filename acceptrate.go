@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// acceptLimiter, when non-nil, caps how many new connections per second
+// serve admits across all listeners.
+var acceptLimiter *rate.Limiter
+
+// acceptRateMaxDelay is the longest a connection is held waiting for an
+// accept-rate token; connections that would wait longer are closed.
+const acceptRateMaxDelay = 250 * time.Millisecond
+
+// newAcceptLimiter returns a limiter admitting perSecond connections a
+// second in bursts of up to perSecond, or nil when perSecond <= 0.
+func newAcceptLimiter(perSecond int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), perSecond)
+}
+
+// admitDelay takes an accept-rate token for a new connection. It returns
+// how long to hold the connection before handling it, or ok == false when
+// the wait would exceed acceptRateMaxDelay and the connection should be
+// dropped instead.
+func admitDelay(l *rate.Limiter) (delay time.Duration, ok bool) {
+	if l == nil {
+		return 0, true
+	}
+	r := l.Reserve()
+	if delay = r.Delay(); delay > acceptRateMaxDelay {
+		r.Cancel()
+		return 0, false
+	}
+	return delay, true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestAdmitDelay(t *testing.T) {
+	t.Parallel()
+
+	if d, ok := admitDelay(nil); !ok || d != 0 {
+		t.Fatalf("admitDelay(nil) = %v, %v; want 0, true", d, ok)
+	}
+
+	// 10/s with no burst beyond one: each extra connection waits another
+	// 100ms, until the wait would pass acceptRateMaxDelay.
+	l := rate.NewLimiter(10, 1)
+	if d, ok := admitDelay(l); !ok || d != 0 {
+		t.Fatalf("first admitDelay = %v, %v; want 0, true", d, ok)
+	}
+	for range 2 {
+		if d, ok := admitDelay(l); !ok || d <= 0 || d > acceptRateMaxDelay {
+			t.Fatalf("admitDelay within the max delay = %v, %v", d, ok)
+		}
+	}
+	if d, ok := admitDelay(l); ok {
+		t.Fatalf("admitDelay past the max delay = %v, true; want it dropped", d)
+	}
+}
+
+func TestServeDropsConnectionsOverAcceptRate(t *testing.T) {
+	// Not parallel: mutates the package-level acceptLimiter.
+	orig := acceptLimiter
+	defer func() { acceptLimiter = orig }()
+	acceptLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(context.Background(), ln, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+	defer func() { _ = ln.Close(); <-served }()
+
+	request := func() (string, error) {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		defer conn.Close() //nolint:errcheck // test cleanup
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		b, err := io.ReadAll(conn)
+		return string(b), err
+	}
+
+	if resp, err := request(); err != nil || !strings.HasPrefix(resp, "HTTP/1.1 400") {
+		t.Fatalf("first connection = %q, %v; want a 400 from the proxy", resp, err)
+	}
+	resp, err := request()
+	if resp != "" || (err != nil && !errors.Is(err, net.ErrClosed) && !strings.Contains(err.Error(), "reset")) {
+		t.Fatalf("connection over the accept rate = %q, %v; want it closed unanswered", resp, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// accessLogger, when set, receives the "tunnel closed" access log records
+// instead of the connection's logger. main points it at an asyncLog when
+// -access-log-buffer is set.
+var accessLogger *slog.Logger
+
+// accessLogFor returns the logger access log records go to.
+func accessLogFor(logger *slog.Logger) *slog.Logger {
+	if accessLogger != nil {
+		return accessLogger
+	}
+	return logger
+}
+
+// accessLogSample is the fraction of tunnels that closed normally whose
+// access log record is written; tunnels that ended any other way are
+// always logged.
+var accessLogSample = 1.0
+
+// logResolvedIP adds resolved_ip, the address actually dialed, to the
+// access log records of tunnels whose target is a host name, so names can
+// be matched to addresses after DNS changes.
+var logResolvedIP = true
+
+// resolvedIP returns the IP target is connected to when targetAddr names a
+// host rather than an IP literal, and "" otherwise.
+func resolvedIP(targetAddr string, target net.Conn) string {
+	host, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return ""
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return ""
+	}
+	var ap netip.AddrPort
+	switch a := target.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		return ""
+	}
+	return ap.Addr().Unmap().String()
+}
+
+// accessLogSummaryInterval is how often logSampledOut reports records the
+// sampling skipped.
+const accessLogSummaryInterval = time.Minute
+
+// sampleAccessLog reports whether to write the access log record for a
+// tunnel that closed with reason, counting it in access_log_sampled_out
+// when not.
+func sampleAccessLog(reason string) bool {
+	if accessLogSample >= 1 || reason != closeNormalEOF || rand.Float64() < accessLogSample {
+		return true
+	}
+	accessLogSampledOut.Add(1)
+	return false
+}
+
+// logSampledOut logs how many access log records sampling skipped in each
+// accessLogSummaryInterval, until ctx is done.
+func logSampledOut(ctx context.Context, logger *slog.Logger) {
+	t := time.NewTicker(accessLogSummaryInterval)
+	defer t.Stop()
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n := accessLogSampledOut.Value(); n > last {
+				accessLogFor(logger).Info("access log records sampled out", "count", n-last, "interval", accessLogSummaryInterval, "sample", accessLogSample)
+				last = n
+			}
+		}
+	}
+}
+
+// asyncLogFlushTimeout bounds how long Close waits for queued records.
+const asyncLogFlushTimeout = 2 * time.Second
+
+// asyncLog queues records for a background goroutine that writes them to
+// the wrapped handler, so a slow sink never blocks the caller. When the
+// queue is full, records are dropped and counted in access_log_dropped.
+type asyncLog struct {
+	queue chan asyncEntry
+	done  chan struct{}
+
+	mu     sync.RWMutex // held for writing only to close queue
+	closed bool
+}
+
+type asyncEntry struct {
+	h slog.Handler
+	r slog.Record
+}
+
+func newAsyncLog(size int) *asyncLog {
+	l := &asyncLog{queue: make(chan asyncEntry, size), done: make(chan struct{})}
+	go l.drain()
+	return l
+}
+
+func (l *asyncLog) drain() {
+	defer close(l.done)
+	for e := range l.queue {
+		_ = e.h.Handle(context.Background(), e.r)
+	}
+}
+
+// Close stops accepting records and waits up to asyncLogFlushTimeout for
+// the queue to drain. Records logged after Close are dropped.
+func (l *asyncLog) Close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+	select {
+	case <-l.done:
+	case <-time.After(asyncLogFlushTimeout):
+	}
+}
+
+// handler returns a slog.Handler that enqueues records for h.
+func (l *asyncLog) handler(h slog.Handler) slog.Handler {
+	return &asyncHandler{log: l, h: h}
+}
+
+type asyncHandler struct {
+	log *asyncLog
+	h   slog.Handler
+}
+
+func (a *asyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return a.h.Enabled(ctx, level)
+}
+
+func (a *asyncHandler) Handle(_ context.Context, r slog.Record) error {
+	a.log.mu.RLock()
+	defer a.log.mu.RUnlock()
+	if a.log.closed {
+		accessLogDropped.Add(1)
+		return nil
+	}
+	select {
+	case a.log.queue <- asyncEntry{h: a.h, r: r.Clone()}:
+	default:
+		accessLogDropped.Add(1)
+	}
+	return nil
+}
+
+func (a *asyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &asyncHandler{log: a.log, h: a.h.WithAttrs(attrs)}
+}
+
+func (a *asyncHandler) WithGroup(name string) slog.Handler {
+	return &asyncHandler{log: a.log, h: a.h.WithGroup(name)}
+}
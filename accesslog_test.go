@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingHandler is a slog sink that holds every Handle call until
+// release is closed, standing in for a stalled remote log sink.
+type blockingHandler struct {
+	slog.Handler
+	release chan struct{}
+}
+
+func (h blockingHandler) Handle(ctx context.Context, r slog.Record) error {
+	<-h.release
+	return h.Handler.Handle(ctx, r)
+}
+
+func TestAsyncLogWritesInBackground(t *testing.T) {
+	t.Parallel()
+
+	var out syncBuffer
+	al := newAsyncLog(8)
+	logger := slog.New(al.handler(slog.NewTextHandler(&out, nil))).With("protocol", "http")
+
+	logger.Info("tunnel closed", "reason", "normal-eof")
+	al.Close()
+
+	if got := out.String(); !strings.Contains(got, `msg="tunnel closed" protocol=http reason=normal-eof`) {
+		t.Fatalf("record not flushed with its attrs: %q", got)
+	}
+}
+
+func TestAsyncLogDropsWhenFull(t *testing.T) {
+	// Not parallel: reads the package-level access_log_dropped counter.
+	var out syncBuffer
+	sink := blockingHandler{Handler: slog.NewTextHandler(&out, nil), release: make(chan struct{})}
+	al := newAsyncLog(2)
+	logger := slog.New(al.handler(sink))
+	before := accessLogDropped.Value()
+
+	// One record is held by the stalled writer and two fill the queue; the
+	// rest must be dropped without blocking.
+	start := time.Now()
+	for range 10 {
+		logger.Info("tunnel closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("logging blocked for %v on a stalled sink", elapsed)
+	}
+	if dropped := accessLogDropped.Value() - before; dropped < 7 {
+		t.Fatalf("access_log_dropped increased by %d, want at least 7", dropped)
+	}
+
+	close(sink.release)
+	al.Close()
+	if n := strings.Count(out.String(), "tunnel closed"); n < 2 || n > 3 {
+		t.Fatalf("wrote %d records, want the 2-3 that fit", n)
+	}
+
+	// Records after Close are dropped rather than panicking.
+	logger.Info("tunnel closed")
+}
+
+func TestAccessLogFor(t *testing.T) {
+	// Not parallel: mutates the package-level accessLogger.
+	orig := accessLogger
+	defer func() { accessLogger = orig }()
+
+	conn := slog.Default()
+	accessLogger = nil
+	if accessLogFor(conn) != conn {
+		t.Fatal("accessLogFor without accessLogger should use the connection logger")
+	}
+	al := slog.New(slog.DiscardHandler)
+	accessLogger = al
+	if accessLogFor(conn) != al {
+		t.Fatal("accessLogFor should prefer accessLogger")
+	}
+}
+
+func TestSampleAccessLog(t *testing.T) {
+	// Not parallel: mutates the package-level accessLogSample.
+	orig := accessLogSample
+	defer func() { accessLogSample = orig }()
+
+	accessLogSample = 0
+	before := accessLogSampledOut.Value()
+	if sampleAccessLog(closeNormalEOF) {
+		t.Fatal("normal close logged with -log-sample 0")
+	}
+	if got := accessLogSampledOut.Value() - before; got != 1 {
+		t.Fatalf("access_log_sampled_out grew by %d, want 1", got)
+	}
+	for _, reason := range []string{closeIdleTimeout, closeClientReset, closeTargetReset, closePolicyClosed, closeShutdown, closeError} {
+		if !sampleAccessLog(reason) {
+			t.Errorf("%s close not logged; only normal closes are sampled", reason)
+		}
+	}
+
+	accessLogSample = 1
+	if !sampleAccessLog(closeNormalEOF) {
+		t.Fatal("normal close not logged with -log-sample 1")
+	}
+}
+
+func TestResolvedIP(t *testing.T) {
+	t.Parallel()
+
+	conn := func(addr net.Addr) net.Conn { return &proxiedConn{remote: addr} }
+	tcp := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:192.0.2.7]:443"))
+	udp := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::7]:53"))
+	for _, tc := range []struct {
+		target string
+		remote net.Addr
+		want   string
+	}{
+		{"example.com:443", tcp, "192.0.2.7"},
+		{"dns.example:53", udp, "2001:db8::7"},
+		{"192.0.2.7:443", tcp, ""},
+		{"[2001:db8::7]:53", udp, ""},
+		{"example.com:443", pipeAddr{}, ""},
+	} {
+		if got := resolvedIP(tc.target, conn(tc.remote)); got != tc.want {
+			t.Errorf("resolvedIP(%q, %v) = %q, want %q", tc.target, tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestHandleHTTPConnectLogsResolvedIP(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	_, port, _ := net.SplitHostPort(targetAddr)
+	target := net.JoinHostPort("localhost", port)
+
+	var logs syncBuffer
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger := slog.New(slog.NewTextHandler(&logs, nil))
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+		_ = serverConn.Close()
+	}()
+
+	_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(clientConn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %v, %v; want 200", resp, err)
+	}
+	_ = clientConn.Close()
+	<-done
+
+	if out := logs.String(); !strings.Contains(out, "target="+target) || !strings.Contains(out, "resolved_ip=127.0.0.1") {
+		t.Fatalf("access log missing the target name and resolved_ip: %s", out)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// inlineAdminPaths are the admin endpoints -local-admin serves on the proxy
+// port. Only exact paths match, so nothing else on the admin mux (or a
+// future handler registered there) becomes reachable by accident.
+var inlineAdminPaths = map[string]bool{
+	"/healthz":    true,
+	"/debug/vars": true,
+	"/recent":     true,
+}
+
+// newAdminMux returns the handler for the admin listener.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/recent", serveRecentEvents)
+	mux.HandleFunc("/events", serveEventStream)
+	mux.HandleFunc("/talkers", serveTopTalkers)
+	mux.HandleFunc("/healthz", serveHealthz)
+	return mux
+}
+
+// serveHealthz answers ok, or 503 while accepting is paused.
+func serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if acceptPaused.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "paused\n")
+		return
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// isInlineAdminRequest reports whether req, read on a proxy port, is a
+// plain GET or HEAD for one of inlineAdminPaths. CONNECT and absolute-form
+// requests never match, so a tunnel request can't be steered to the admin
+// handler.
+func isInlineAdminRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return isOriginFormRequest(req) && inlineAdminPaths[req.URL.Path]
+}
+
+// serveInlineAdmin answers a single admin request on a proxy connection and
+// closes it, as the proxy port never keeps plain HTTP connections alive.
+func serveInlineAdmin(conn net.Conn, req *http.Request, handler http.Handler) {
+	w := &bufferedResponseWriter{header: make(http.Header), code: http.StatusOK}
+	handler.ServeHTTP(w, req)
+
+	resp := &http.Response{
+		StatusCode:    w.code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        w.header,
+		ContentLength: int64(w.body.Len()),
+		Body:          io.NopCloser(&w.body),
+		Close:         true,
+	}
+	resp.Header.Set("Connection", "close")
+	_ = conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	_ = resp.Write(conn)
+}
+
+// bufferedResponseWriter collects a handler's response so it can be written
+// with http.Response.Write. Admin responses are small.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (w *bufferedResponseWriter) Header() http.Header { return w.header }
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.code = code
+		w.wrote = true
+	}
+}
+
+func (w *bufferedResponseWriter) Write(p []byte) (int, error) {
+	w.wrote = true
+	return w.body.Write(p)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminDebugVars(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(newAdminMux())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/vars")
+	if err != nil {
+		t.Fatalf("get /debug/vars: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // test cleanup
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %q", resp.Status)
+	}
+
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("decode /debug/vars: %v", err)
+	}
+	for _, name := range []string{"connections_total", "connections_active", "bytes_proxied", "errors", "tunnel_resets"} {
+		if _, ok := vars[name]; !ok {
+			t.Fatalf("expected %q in /debug/vars", name)
+		}
+	}
+}
+
+func TestIsInlineAdminRequest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		request string
+		want    bool
+	}{
+		{request: "GET /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n", want: true},
+		{request: "HEAD /debug/vars HTTP/1.1\r\nHost: proxy\r\n\r\n", want: true},
+		{request: "GET /recent HTTP/1.1\r\nHost: proxy\r\n\r\n", want: true},
+		{request: "GET /healthz/ HTTP/1.1\r\nHost: proxy\r\n\r\n", want: false},
+		{request: "GET /debug/pprof/ HTTP/1.1\r\nHost: proxy\r\n\r\n", want: false},
+		{request: "POST /healthz HTTP/1.1\r\nHost: proxy\r\nContent-Length: 0\r\n\r\n", want: false},
+		{request: "GET http://proxy/healthz HTTP/1.1\r\nHost: proxy\r\n\r\n", want: false},
+		{request: "CONNECT proxy:80 HTTP/1.1\r\nHost: proxy:80\r\n\r\n", want: false},
+	}
+	for _, tc := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tc.request)))
+		if err != nil {
+			t.Fatalf("parse %q: %v", tc.request, err)
+		}
+		if got := isInlineAdminRequest(req); got != tc.want {
+			t.Fatalf("isInlineAdminRequest(%q) = %v, want %v", tc.request, got, tc.want)
+		}
+	}
+}
+
+func TestHandleHTTPConnectInlineAdmin(t *testing.T) {
+	t.Parallel()
+
+	get := func(t *testing.T, opts listenerOptions, path string) *http.Response {
+		t.Helper()
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { _ = clientConn.Close() })
+		go func() {
+			defer serverConn.Close() //nolint:errcheck // test cleanup
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), opts, logger)
+		}()
+		go func() { _, _ = io.WriteString(clientConn, "GET "+path+" HTTP/1.1\r\nHost: proxy\r\n\r\n") }()
+
+		_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		return resp
+	}
+
+	opts := listenerOptions{admin: newAdminMux()}
+
+	resp := get(t, opts, "/healthz")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok\n" {
+		t.Fatalf("GET /healthz = %d %q, want 200 \"ok\\n\"", resp.StatusCode, body)
+	}
+	if !resp.Close {
+		t.Fatal("expected Connection: close")
+	}
+
+	resp = get(t, opts, "/debug/vars")
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("decode /debug/vars: %v", err)
+	}
+	if _, ok := vars["connections_total"]; !ok {
+		t.Fatal("expected connections_total in inline /debug/vars")
+	}
+
+	if resp := get(t, opts, "/index.html"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET /index.html with inline admin = %d, want 400", resp.StatusCode)
+	}
+	if resp := get(t, listenerOptions{}, "/healthz"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET /healthz without inline admin = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"runtime/debug"
+)
+
+// buildInfo is the build metadata printed by -version-json.
+type buildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"go_version"`
+}
+
+// newBuildInfo describes this binary. version is the ldflags-set version;
+// when it is still "dev", the module version from info is used instead, as
+// for binaries built with go install. info may be nil when the binary was
+// built without module support.
+func newBuildInfo(version string, info *debug.BuildInfo) buildInfo {
+	bi := buildInfo{Version: version}
+	if info == nil {
+		return bi
+	}
+	bi.GoVersion = info.GoVersion
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		bi.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			bi.Commit = s.Value
+		case "vcs.time":
+			bi.CommitTime = s.Value
+		case "vcs.modified":
+			bi.Modified = s.Value == "true"
+		}
+	}
+	return bi
+}
+
+// currentBuildInfo is newBuildInfo for the running binary.
+func currentBuildInfo(version string) buildInfo {
+	info, _ := debug.ReadBuildInfo()
+	return newBuildInfo(version, info)
+}
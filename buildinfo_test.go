@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"testing"
+)
+
+func TestNewBuildInfo(t *testing.T) {
+	t.Parallel()
+
+	info := &debug.BuildInfo{
+		GoVersion: "go1.25.7",
+		Main:      debug.Module{Path: "github.com/kljensen/tailgate", Version: "v1.2.3"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "eb4ca00c0ffee"},
+			{Key: "vcs.time", Value: "2026-10-01T12:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		info    *debug.BuildInfo
+		want    buildInfo
+	}{
+		{
+			name:    "ldflags_version_wins",
+			version: "v2.0.0",
+			info:    info,
+			want:    buildInfo{Version: "v2.0.0", Commit: "eb4ca00c0ffee", CommitTime: "2026-10-01T12:00:00Z", Modified: true, GoVersion: "go1.25.7"},
+		},
+		{
+			name:    "module_version_fills_dev",
+			version: "dev",
+			info:    info,
+			want:    buildInfo{Version: "v1.2.3", Commit: "eb4ca00c0ffee", CommitTime: "2026-10-01T12:00:00Z", Modified: true, GoVersion: "go1.25.7"},
+		},
+		{
+			name:    "devel_module_keeps_dev",
+			version: "dev",
+			info:    &debug.BuildInfo{GoVersion: "go1.25.7", Main: debug.Module{Version: "(devel)"}},
+			want:    buildInfo{Version: "dev", GoVersion: "go1.25.7"},
+		},
+		{
+			name:    "no_build_info",
+			version: "dev",
+			want:    buildInfo{Version: "dev"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := newBuildInfo(tt.version, tt.info); got != tt.want {
+				t.Fatalf("newBuildInfo = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildInfoJSON(t *testing.T) {
+	t.Parallel()
+
+	b, err := json.Marshal(buildInfo{Version: "dev", GoVersion: "go1.25.7"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if want := `{"version":"dev","go_version":"go1.25.7"}`; string(b) != want {
+		t.Fatalf("json = %s, want %s", b, want)
+	}
+}
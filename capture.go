@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureDir and captureFilter enable tunnel capture: the bytes of every
+// tunnel matching the filter are copied to a new file in the directory.
+// Capture is off unless both are set. They are vars so main can configure
+// them from -capture-dir and -capture-filter and tests can override them.
+var (
+	captureDir    string
+	captureFilter *tunnelFilter
+)
+
+// tunnelFilter selects tunnels by client address or by target.
+type tunnelFilter struct {
+	client netip.Prefix // valid for client= filters
+	host   string       // hostKey of the target for target= filters
+	port   string       // optional target port
+}
+
+// parseTunnelFilter parses "client=<ip or CIDR>" or "target=<host[:port]>".
+func parseTunnelFilter(s string) (*tunnelFilter, error) {
+	key, value, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("filter %q: want client=<ip or CIDR> or target=<host[:port]>", s)
+	}
+	switch key {
+	case "client":
+		prefixes, err := parsePrefixList(value)
+		if err != nil || len(prefixes) != 1 {
+			return nil, fmt.Errorf("filter %q: invalid client address", s)
+		}
+		return &tunnelFilter{client: prefixes[0]}, nil
+	case "target":
+		host, port := value, ""
+		if h, p, err := net.SplitHostPort(value); err == nil {
+			host, port = h, p
+		}
+		return &tunnelFilter{host: hostKey(host), port: port}, nil
+	default:
+		return nil, fmt.Errorf("filter %q: unknown key %q", s, key)
+	}
+}
+
+// match reports whether the tunnel from client to targetAddr is selected.
+func (f *tunnelFilter) match(client, targetAddr string) bool {
+	if f == nil {
+		return false
+	}
+	if f.client.IsValid() {
+		// client is "ip:port", or a bare IP taken from X-Forwarded-For.
+		ip, err := netip.ParseAddr(client)
+		if ap, perr := netip.ParseAddrPort(client); perr == nil {
+			ip, err = ap.Addr(), nil
+		}
+		return err == nil && f.client.Contains(ip.Unmap())
+	}
+	host, port, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return false
+	}
+	return hostKey(host) == f.host && (f.port == "" || f.port == port)
+}
+
+// tunnelCapture records both directions of one tunnel into a single file.
+// Each chunk is written as a header line
+//
+//	# <RFC 3339 time> <direction> <length>
+//
+// followed by the raw bytes and a newline. Write errors disable the capture
+// but never reach the relay.
+type tunnelCapture struct {
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	f      *os.File
+	failed bool
+}
+
+// openCapture starts a capture file for the tunnel if capture is enabled
+// and the tunnel matches captureFilter. It returns nil otherwise, and the
+// methods of a nil *tunnelCapture do nothing.
+func openCapture(client, targetAddr string, logger *slog.Logger) *tunnelCapture {
+	if captureDir == "" || !captureFilter.match(client, targetAddr) {
+		return nil
+	}
+	f, err := os.CreateTemp(captureDir, "tunnel-"+time.Now().UTC().Format("20060102T150405")+"-*.cap")
+	if err != nil {
+		logger.Warn("failed to open tunnel capture", "remote", client, "target", targetAddr, "error", err)
+		return nil
+	}
+	logger.Info("capturing tunnel", "remote", client, "target", targetAddr, "file", f.Name())
+	c := &tunnelCapture{logger: logger, f: f}
+	c.writeRecord("# tailgate capture client=%s target=%s\n", client, targetAddr)
+	return c
+}
+
+// tee returns r with everything read from it also recorded as direction.
+func (c *tunnelCapture) tee(r io.Reader, direction string) io.Reader {
+	if c == nil {
+		return r
+	}
+	return io.TeeReader(r, captureWriter{c: c, direction: direction})
+}
+
+func (c *tunnelCapture) writeRecord(format string, args ...any) {
+	if _, err := fmt.Fprintf(c.f, format, args...); err != nil {
+		c.fail(err)
+	}
+}
+
+// fail disables the capture after a write error. c.mu must be held, except
+// from openCapture before c is shared.
+func (c *tunnelCapture) fail(err error) {
+	c.failed = true
+	c.logger.Warn("tunnel capture write failed; capture stopped", "file", c.f.Name(), "error", err)
+}
+
+func (c *tunnelCapture) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.f.Close()
+}
+
+type captureWriter struct {
+	c         *tunnelCapture
+	direction string
+}
+
+// Write always reports success so capture problems can't affect the relay.
+func (w captureWriter) Write(p []byte) (int, error) {
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed {
+		return len(p), nil
+	}
+	c.writeRecord("# %s %s %d\n", time.Now().UTC().Format(time.RFC3339Nano), w.direction, len(p))
+	if !c.failed {
+		if _, err := c.f.Write(p); err != nil {
+			c.fail(err)
+		}
+	}
+	if !c.failed {
+		c.writeRecord("\n")
+	}
+	return len(p), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTunnelFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		spec   string
+		client string
+		target string
+		want   bool
+	}{
+		{spec: "client=100.64.0.5", client: "100.64.0.5:51000", target: "example.com:443", want: true},
+		{spec: "client=100.64.0.5", client: "100.64.0.6:51000", target: "example.com:443"},
+		{spec: "client=100.64.0.0/10", client: "100.100.1.1:1", target: "example.com:443", want: true},
+		{spec: "client=100.64.0.5", client: "100.64.0.5", target: "example.com:443", want: true},
+		{spec: "target=Example.com.", client: "100.64.0.5:1", target: "example.com:80", want: true},
+		{spec: "target=example.com:443", client: "100.64.0.5:1", target: "example.com:443", want: true},
+		{spec: "target=example.com:443", client: "100.64.0.5:1", target: "example.com:80"},
+		{spec: "target=example.com", client: "100.64.0.5:1", target: "other.example:443"},
+	}
+	for _, tt := range tests {
+		f, err := parseTunnelFilter(tt.spec)
+		if err != nil {
+			t.Fatalf("parseTunnelFilter(%q): %v", tt.spec, err)
+		}
+		if got := f.match(tt.client, tt.target); got != tt.want {
+			t.Errorf("%q.match(%q, %q) = %v, want %v", tt.spec, tt.client, tt.target, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "example.com", "client=", "client=not-an-ip", "client=10.0.0.1,10.0.0.2", "port=443"} {
+		if _, err := parseTunnelFilter(bad); err == nil {
+			t.Errorf("parseTunnelFilter(%q) succeeded, want error", bad)
+		}
+	}
+
+	var none *tunnelFilter
+	if none.match("100.64.0.5:1", "example.com:443") {
+		t.Error("nil filter matched")
+	}
+}
+
+func TestRelayCapturesMatchingTunnel(t *testing.T) {
+	// Not parallel: mutates the package-level captureDir and captureFilter.
+	dir := t.TempDir()
+	origDir, origFilter := captureDir, captureFilter
+	defer func() { captureDir, captureFilter = origDir, origFilter }()
+	captureDir = dir
+	var err error
+	if captureFilter, err = parseTunnelFilter("target=target"); err != nil {
+		t.Fatalf("parse filter: %v", err)
+	}
+
+	runRelay := func(targetAddr string) {
+		clientConn, serverConn := net.Pipe()
+		targetConn, targetPeer := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			relay(context.Background(), serverConn, targetConn, slog.New(slog.NewTextHandler(io.Discard, nil)), "http", "100.64.0.5:51000", targetAddr)
+		}()
+
+		_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+		_ = targetPeer.SetDeadline(time.Now().Add(3 * time.Second))
+		go func() { _, _ = io.WriteString(clientConn, "hello") }()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(targetPeer, buf); err != nil {
+			t.Fatalf("read at target: %v", err)
+		}
+		go func() { _, _ = io.WriteString(targetPeer, "world!") }()
+		buf = make([]byte, 6)
+		if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatalf("read at client: %v", err)
+		}
+		_ = clientConn.Close()
+		_ = targetPeer.Close()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("relay did not exit")
+		}
+	}
+
+	runRelay("target:443")
+	runRelay("other:443")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cap"))
+	if len(files) != 1 {
+		t.Fatalf("capture files = %v, want exactly one for the matching tunnel", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("read capture: %v", err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		"# tailgate capture client=100.64.0.5:51000 target=target:443\n",
+		" client->target 5\nhello\n",
+		" target->client 6\nworld!\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("capture missing %q:\n%s", want, got)
+		}
+	}
+	if info, err := os.Stat(files[0]); err == nil && info.Mode().Perm() != 0o600 {
+		t.Errorf("capture file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestCaptureWriteFailureDoesNotAffectRelay(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.CreateTemp(t.TempDir(), "*.cap")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_ = f.Close() // writes now fail
+
+	c := &tunnelCapture{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), f: f}
+	r := c.tee(strings.NewReader("payload"), "client->target")
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("tee read = %q, %v; want payload with no error", got, err)
+	}
+	if !c.failed {
+		t.Fatal("capture not marked failed after write error")
+	}
+}
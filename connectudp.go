@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// connectUDP enables UDP proxying per RFC 9298 (CONNECT-UDP) over an
+// HTTP/1.1 Upgrade on the proxy port.
+var connectUDP bool
+
+// connectUDPPathPrefix is the start of RFC 9298's default URI template,
+// /.well-known/masque/udp/{target_host}/{target_port}/.
+const connectUDPPathPrefix = "/.well-known/masque/udp/"
+
+// capsuleTypeDatagram is the HTTP Datagram capsule type (RFC 9297).
+const capsuleTypeDatagram = 0x00
+
+// maxCapsuleLength bounds a capsule's body: a context ID and the largest
+// UDP payload. Longer capsules end the tunnel rather than being buffered.
+const maxCapsuleLength = 8 + 65527
+
+var errCapsuleTooLarge = errors.New("capsule too large")
+
+// isConnectUDPRequest reports whether req asks to upgrade to a CONNECT-UDP
+// tunnel.
+func isConnectUDPRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		isOriginFormRequest(req) &&
+		strings.HasPrefix(req.URL.Path, connectUDPPathPrefix) &&
+		headerHasToken(req.Header, "Connection", "upgrade") &&
+		headerHasToken(req.Header, "Upgrade", "connect-udp")
+}
+
+// headerHasToken reports whether the comma-separated header name lists
+// token, compared case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connectUDPTarget returns the host:port named by a CONNECT-UDP request
+// path. IPv6 literals arrive percent-encoded, since ':' is reserved there.
+func connectUDPTarget(u *url.URL) (string, error) {
+	rest, ok := strings.CutPrefix(u.EscapedPath(), connectUDPPathPrefix)
+	if !ok {
+		return "", fmt.Errorf("path %q is not under %s", u.Path, connectUDPPathPrefix)
+	}
+	rest = strings.TrimSuffix(rest, "/")
+	rawHost, rawPort, ok := strings.Cut(rest, "/")
+	if !ok || rawHost == "" || strings.Contains(rawPort, "/") {
+		return "", fmt.Errorf("path %q: want %s{host}/{port}/", u.Path, connectUDPPathPrefix)
+	}
+	host, err := url.PathUnescape(rawHost)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid IPv6 target %q", host)
+		}
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("invalid port %q", rawPort)
+	}
+	return net.JoinHostPort(host, rawPort), nil
+}
+
+// handleConnectUDP serves a CONNECT-UDP upgrade read by handleHTTPConnect.
+// pending holds client bytes read past the request, which are already
+// capsules.
+func handleConnectUDP(ctx context.Context, hs *handshake, conn net.Conn, req *http.Request, pending []byte, client string, logger *slog.Logger) {
+	targetAddr, err := connectUDPTarget(req.URL)
+	if err != nil {
+		countError("invalid_target")
+		logger.Debug("invalid connect-udp target", "remote", client, "path", req.URL.Path, "error", err)
+		writeHTTPError(conn, http.StatusBadRequest, "invalid connect-udp target\n", nil)
+		return
+	}
+	if !targetPortAllowed(targetAddr) {
+		countError("port_denied")
+		logger.Debug("destination port not allowed", "remote", client, "target", targetAddr, "protocol", "connect-udp")
+		writeHTTPError(conn, http.StatusForbidden, "destination port not allowed\n", nil)
+		return
+	}
+	if err := checkGrant(hs.ctx, whoIsAddr(conn), targetAddr); err != nil {
+		countError("no_grant")
+		logger.Debug("peer not granted access to target", "remote", client, "target", targetAddr, "protocol", "connect-udp", "error", err)
+		writeHTTPError(conn, http.StatusForbidden, "not granted access to this destination\n", nil)
+		return
+	}
+
+	releaseUser, user, ok := acquireUserSlot(hs.ctx, conn, logger)
+	if !ok {
+		countError("user_limit")
+		logger.Debug("per-user connection limit reached", "remote", client, "user", user, "protocol", "connect-udp")
+		writeHTTPError(conn, http.StatusForbidden, "too many tunnels for this user\n", nil)
+		return
+	}
+	defer releaseUser()
+	ctx = withTunnelUser(ctx, user)
+
+	targetHost, _, _ := net.SplitHostPort(targetAddr)
+	release, ok := perHostLimiter.acquire(hostKey(targetHost))
+	if !ok {
+		countError("host_limit")
+		logger.Debug("per-host connection limit reached", "remote", client, "host", targetHost, "protocol", "connect-udp")
+		writeHTTPError(conn, http.StatusServiceUnavailable, "too many connections to target\n", retryAfterHeader(dialRetryAfterSeconds))
+		return
+	}
+	defer release()
+
+	target, err := dialNetwork(hs.ctx, "udp", targetAddr)
+	if err != nil {
+		if hs.expired() {
+			countError("handshake_timeout")
+			logger.Debug("handshake timeout", "remote", client, "target", targetAddr, "timeout", handshakeTimeout)
+			return
+		}
+		if ctx.Err() != nil {
+			countError("shutdown")
+			logger.Debug("dial canceled by shutdown", "remote", client, "target", targetAddr)
+			return
+		}
+		countError(dialErrorKind(err))
+		logger.Debug("failed to open connect-udp target", "remote", client, "target", targetAddr, "error", err)
+		if errors.Is(err, errSelfTarget) || errors.Is(err, errPrivateTarget) {
+			writeHTTPError(conn, http.StatusForbidden, "destination not allowed\n", nil)
+			return
+		}
+		writeHTTPError(conn, http.StatusBadGateway, "dial failed\n", nil)
+		return
+	}
+	defer target.Close() //nolint:errcheck // best-effort cleanup
+
+	if !hs.done() {
+		countError("handshake_timeout")
+		logger.Debug("handshake timeout", "remote", client, "target", targetAddr, "timeout", handshakeTimeout)
+		return
+	}
+
+	if err := writeBeforeRelay(conn, []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")); err != nil {
+		countError("client_write")
+		logger.Debug("failed to write connect-udp response", "remote", client, "target", targetAddr, "error", err)
+		return
+	}
+	var clientConn net.Conn = conn
+	if len(pending) > 0 {
+		clientConn = &prefixedConn{Conn: conn, prefix: pending}
+	}
+	relay(ctx, newCapsuleConn(clientConn), target, logger, "connect-udp", client, targetAddr)
+}
+
+// capsuleConn carries UDP payloads as DATAGRAM capsules on the client's
+// upgraded connection, so relay can treat a CONNECT-UDP tunnel like any
+// other: each Read returns one payload and each Write sends one.
+//
+// Empty payloads and payloads larger than the Read buffer (relayBufferSize
+// in the relay) are dropped rather than split, as are datagrams with a
+// nonzero context ID and capsule types other than DATAGRAM, which RFC 9297
+// says to ignore.
+type capsuleConn struct {
+	net.Conn
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newCapsuleConn(conn net.Conn) *capsuleConn {
+	return &capsuleConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *capsuleConn) Read(p []byte) (int, error) {
+	for {
+		typ, err := readVarint(c.r)
+		if err != nil {
+			return 0, err // io.EOF only between capsules
+		}
+		length, err := readVarint(c.r)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		if length > maxCapsuleLength {
+			return 0, errCapsuleTooLarge
+		}
+		if typ != capsuleTypeDatagram {
+			if _, err := c.r.Discard(int(length)); err != nil {
+				return 0, noEOF(err)
+			}
+			continue
+		}
+		if cap(c.buf) < int(length) {
+			c.buf = make([]byte, length)
+		}
+		body := c.buf[:length]
+		if _, err := io.ReadFull(c.r, body); err != nil {
+			return 0, noEOF(err)
+		}
+		br := bytes.NewReader(body)
+		contextID, err := readVarint(br)
+		if err != nil || contextID != 0 || br.Len() == 0 || br.Len() > len(p) {
+			continue
+		}
+		return copy(p, body[len(body)-br.Len():]), nil
+	}
+}
+
+func (c *capsuleConn) Write(p []byte) (int, error) {
+	b := make([]byte, 0, 1+8+1+len(p))
+	b = appendVarint(b, capsuleTypeDatagram)
+	b = appendVarint(b, uint64(1+len(p)))
+	b = appendVarint(b, 0) // context ID 0: a UDP payload
+	b = append(b, p...)
+	if _, err := c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendVarint appends v as a QUIC variable-length integer (RFC 9000
+// section 16), the encoding capsules use for their type and length.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x8000_0000)
+	default:
+		return binary.BigEndian.AppendUint64(b, v|0xc000_0000_0000_0000)
+	}
+}
+
+// readVarint reads a QUIC variable-length integer. It returns io.EOF only
+// when r ends before the first byte.
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(b & 0x3f)
+	for range 1<<(b>>6) - 1 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, noEOF(err)
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for a stream that ended
+// inside a capsule.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
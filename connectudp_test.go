@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVarintRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		v   uint64
+		len int
+	}{
+		{0, 1}, {63, 1}, {64, 2}, {16383, 2}, {16384, 4}, {1<<30 - 1, 4}, {1 << 30, 8}, {1<<62 - 1, 8},
+	} {
+		b := appendVarint(nil, tc.v)
+		if len(b) != tc.len {
+			t.Errorf("appendVarint(%d) = %x, want %d bytes", tc.v, b, tc.len)
+		}
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil || got != tc.v {
+			t.Errorf("readVarint(%x) = %d, %v, want %d", b, got, err, tc.v)
+		}
+		if _, err := readVarint(bytes.NewReader(b[:len(b)-1])); len(b) > 1 && err != io.ErrUnexpectedEOF {
+			t.Errorf("readVarint(truncated %x) error = %v, want io.ErrUnexpectedEOF", b, err)
+		}
+	}
+}
+
+func TestConnectUDPTarget(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/.well-known/masque/udp/example.com/53/", "example.com:53"},
+		{"/.well-known/masque/udp/192.0.2.1/443", "192.0.2.1:443"},
+		{"/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/", "[2001:db8::1]:443"},
+		{"/.well-known/masque/udp/example.com/", ""},
+		{"/.well-known/masque/udp//53/", ""},
+		{"/.well-known/masque/udp/example.com/0/", ""},
+		{"/.well-known/masque/udp/example.com/53/extra/", ""},
+		{"/.well-known/masque/udp/not%3Aan%3Aip/53/", ""},
+	} {
+		u, err := url.ParseRequestURI(tc.path)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tc.path, err)
+		}
+		got, err := connectUDPTarget(u)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("connectUDPTarget(%q) = %q, want error", tc.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("connectUDPTarget(%q) = %q, %v, want %q", tc.path, got, err, tc.want)
+		}
+	}
+}
+
+// startUDPEchoServer runs a UDP server that sends every datagram back.
+func startUDPEchoServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestHandleConnectUDP(t *testing.T) {
+	// Not parallel: mutates the package-level connectUDP.
+	orig := connectUDP
+	defer func() { connectUDP = orig }()
+
+	target := startUDPEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	request := "GET " + connectUDPPathPrefix + "127.0.0.1/" + port + "/ HTTP/1.1\r\n" +
+		"Host: proxy\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"
+
+	t.Run("disabled", func(t *testing.T) {
+		connectUDP = false
+		if status, _ := executeProxyRequest(t, request); !strings.Contains(status, "400") {
+			t.Fatalf("status = %q, want 400 with -connect-udp off", status)
+		}
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		connectUDP = true
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			logger := slog.New(slog.DiscardHandler)
+			handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+		}()
+		defer func() { _ = clientConn.Close(); <-done }()
+		_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+
+		// Send the first datagram optimistically, behind an unknown capsule
+		// type that must be skipped.
+		var b []byte
+		b = appendVarint(b, 0x2a)
+		b = appendVarint(b, 3)
+		b = append(b, "xyz"...)
+		b = appendVarint(b, capsuleTypeDatagram)
+		b = appendVarint(b, 5)
+		b = appendVarint(b, 0)
+		b = append(b, "ping"...)
+		go func() { _, _ = io.WriteString(clientConn, request+string(b)) }()
+
+		br := bufio.NewReader(clientConn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "connect-udp" {
+			t.Fatalf("response = %d %v, want 101 upgrading to connect-udp", resp.StatusCode, resp.Header)
+		}
+
+		capsules := newCapsuleConn(&prefixedConn{Conn: clientConn, prefix: drainBuffered(br)})
+		buf := make([]byte, 64)
+		n, err := capsules.Read(buf)
+		if err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("echoed datagram = %q, %v, want ping", buf[:n], err)
+		}
+		if _, err := capsules.Write([]byte("pong")); err != nil {
+			t.Fatalf("write datagram: %v", err)
+		}
+		if n, err = capsules.Read(buf); err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("echoed datagram = %q, %v, want pong", buf[:n], err)
+		}
+	})
+}
+
+// drainBuffered returns the bytes br has read ahead of its caller.
+func drainBuffered(br *bufio.Reader) []byte {
+	b, _ := br.Peek(br.Buffered())
+	return b
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// perHostLimiter caps concurrent tunnels per destination host.
+var perHostLimiter = newConnLimiter(0)
+
+// connLimiter caps the number of concurrent connections per key. A limiter
+// with max <= 0 never rejects.
+type connLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, active: make(map[string]int)}
+}
+
+// acquire reserves a slot for key. If the key is already at the limit it
+// returns ok == false. Otherwise the caller must call release exactly once
+// when the connection closes; extra calls are no-ops.
+func (l *connLimiter) acquire(key string) (release func(), ok bool) {
+	if l == nil || l.max <= 0 {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] >= l.max {
+		return nil, false
+	}
+	l.active[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.active[key] <= 1 {
+				delete(l.active, key)
+				return
+			}
+			l.active[key]--
+		})
+	}, true
+}
+
+// hostKey normalizes a destination host for use as a limiter key so that
+// "Example.com." and "example.com" share a slot count.
+func hostKey(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// targetKey normalizes a "host:port" target the same way, for tracking
+// targets rather than hosts.
+func targetKey(targetAddr string) string {
+	host, port, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return targetAddr
+	}
+	return net.JoinHostPort(hostKey(host), port)
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestConnLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newConnLimiter(2)
+	r1, ok := l.acquire("example.com")
+	if !ok {
+		t.Fatal("expected first acquire to succeed")
+	}
+	r2, ok := l.acquire("example.com")
+	if !ok {
+		t.Fatal("expected second acquire to succeed")
+	}
+	if _, ok := l.acquire("example.com"); ok {
+		t.Fatal("expected third acquire to be rejected")
+	}
+	if _, ok := l.acquire("other.example"); !ok {
+		t.Fatal("expected acquire for a different key to succeed")
+	}
+
+	r1()
+	r1() // release is idempotent
+	r3, ok := l.acquire("example.com")
+	if !ok {
+		t.Fatal("expected acquire after release to succeed")
+	}
+	if _, ok := l.acquire("example.com"); ok {
+		t.Fatal("expected double release not to free an extra slot")
+	}
+	r2()
+	r3()
+}
+
+func TestConnLimiterUnlimited(t *testing.T) {
+	t.Parallel()
+
+	l := newConnLimiter(0)
+	for range 100 {
+		if _, ok := l.acquire("example.com"); !ok {
+			t.Fatal("expected unlimited limiter never to reject")
+		}
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	t.Parallel()
+
+	if got := hostKey("Example.COM."); got != "example.com" {
+		t.Fatalf("hostKey = %q, want example.com", got)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+)
+
+// connSlots caps concurrent client connections across all listeners once
+// their protocol is known, keeping -reserve-socks and -reserve-http slots
+// for each protocol.
+var connSlots = newSlotPool(0, nil)
+
+// slotPool is a concurrency cap shared by several protocols, each of
+// which may hold back reserved slots the others can't take. A pool with
+// max <= 0 never rejects.
+type slotPool struct {
+	max     int
+	reserve map[string]int
+
+	mu    sync.Mutex
+	used  map[string]int
+	total int
+}
+
+func newSlotPool(max int, reserve map[string]int) *slotPool {
+	return &slotPool{max: max, reserve: reserve, used: make(map[string]int)}
+}
+
+// acquire takes a slot for a connection speaking protocol. It fails when
+// the pool is full, or when the free slots are all held back for other
+// protocols' unused reservations. Otherwise the caller must call release
+// exactly once when the connection closes; extra calls are no-ops.
+func (p *slotPool) acquire(protocol string) (release func(), ok bool) {
+	if p == nil || p.max <= 0 {
+		return func() {}, true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	held := 0
+	for proto, n := range p.reserve {
+		if proto != protocol {
+			held += max(n-p.used[proto], 0)
+		}
+	}
+	if p.total+held >= p.max {
+		return nil, false
+	}
+	p.used[protocol]++
+	p.total++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.used[protocol]--
+			p.total--
+		})
+	}, true
+}
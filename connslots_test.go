@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSlotPoolReservesForProtocol(t *testing.T) {
+	t.Parallel()
+
+	p := newSlotPool(4, map[string]int{"socks5": 2})
+
+	// HTTP fills everything but the SOCKS5 reservation.
+	var releases []func()
+	for i := range 2 {
+		release, ok := p.acquire("http")
+		if !ok {
+			t.Fatalf("http acquire %d rejected with free shared slots", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := p.acquire("http"); ok {
+		t.Fatal("http took a slot reserved for socks5")
+	}
+
+	// SOCKS5 still gets its reserved slots, then the pool is full.
+	for i := range 2 {
+		if _, ok := p.acquire("socks5"); !ok {
+			t.Fatalf("socks5 acquire %d rejected within its reservation", i)
+		}
+	}
+	if _, ok := p.acquire("socks5"); ok {
+		t.Fatal("socks5 acquired past max")
+	}
+
+	// A freed shared slot goes to whichever protocol asks, since socks5's
+	// reservation is already in use.
+	releases[0]()
+	releases[0]() // extra calls are no-ops
+	if _, ok := p.acquire("http"); !ok {
+		t.Fatal("http rejected from a freed shared slot")
+	}
+	if _, ok := p.acquire("http"); ok {
+		t.Fatal("double release freed two slots")
+	}
+}
+
+func TestSlotPoolSOCKSUsesSharedSlots(t *testing.T) {
+	t.Parallel()
+
+	p := newSlotPool(3, map[string]int{"socks5": 1})
+	for i := range 3 {
+		if _, ok := p.acquire("socks5"); !ok {
+			t.Fatalf("socks5 acquire %d rejected; it may use shared slots too", i)
+		}
+	}
+	if _, ok := p.acquire("http"); ok {
+		t.Fatal("http acquired from a full pool")
+	}
+}
+
+func TestSlotPoolUnlimited(t *testing.T) {
+	t.Parallel()
+
+	p := newSlotPool(0, map[string]int{"socks5": 5})
+	for range 100 {
+		if _, ok := p.acquire("http"); !ok {
+			t.Fatal("unlimited pool rejected a connection")
+		}
+	}
+	var nilPool *slotPool
+	if _, ok := nilPool.acquire("http"); !ok {
+		t.Fatal("nil pool rejected a connection")
+	}
+}
+
+func TestHandleConnRejectsHTTPOverReservation(t *testing.T) {
+	// Not parallel: mutates the package-level connSlots.
+	orig := connSlots
+	connSlots = newSlotPool(2, map[string]int{"socks5": 1})
+	defer func() { connSlots = orig }()
+	release, ok := connSlots.acquire("http")
+	if !ok {
+		t.Fatal("first http acquire rejected")
+	}
+	defer release()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+	go func() {
+		_, _ = io.WriteString(clientConn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	}()
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503 with the last slot reserved for socks5", resp.StatusCode)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not exit")
+	}
+
+	// The reserved slot is still free for SOCKS5.
+	if _, ok := connSlots.acquire("socks5"); !ok {
+		t.Fatal("socks5 rejected from its reserved slot")
+	}
+}
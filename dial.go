@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDNSBusy is returned when a lookup could not get a resolver slot within
+// the queue timeout.
+var errDNSBusy = errors.New("too many concurrent DNS lookups")
+
+// dnsLimiter bounds in-flight DNS resolutions in the dial path. Lookups
+// beyond the limit queue for a slot, then fail with errDNSBusy.
+var dnsLimiter = newResolveLimiter(0, 2*time.Second)
+
+// errResolveTimeout is returned when a target lookup takes longer than
+// resolverTimeout.
+var errResolveTimeout = errors.New("DNS lookup timed out")
+
+// resolverTimeout bounds each target name lookup on its own, so slow DNS
+// can't use up the whole connectDialTimeout. 0 leaves lookups bounded only
+// by the dial timeout.
+var resolverTimeout time.Duration
+
+// errDialBusy is returned when -max-dialing connection attempts are already
+// in progress.
+var errDialBusy = errors.New("too many dials in progress")
+
+// dialingLimiter caps outbound dials in progress across all targets, using
+// a single key. Established tunnels don't hold a slot.
+var dialingLimiter = newConnLimiter(0)
+
+// lookupNetIP resolves host names for dialTarget.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// dialTarget opens the outbound connection for a tunnel. Both the HTTP
+// CONNECT handler and the SOCKS5 servers dial through it. Host names are
+// resolved here, rather than inside net.Dialer, so resolution can be
+// bounded; the resolved addresses are tried in order until one connects.
+// connectDialTimeout covers resolution and all connection attempts.
+// -prewarm targets are served from their pool while it has connections.
+func dialTarget(ctx context.Context, addr string) (net.Conn, error) {
+	if conn := takeWarm(ctx, addr); conn != nil {
+		return conn, nil
+	}
+	return dialNetwork(ctx, "tcp", addr)
+}
+
+// dialNetwork is dialTarget for network "tcp" or "udp".
+func dialNetwork(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialResolved(ctx, network, addr)
+	if isFDExhausted(err) {
+		noteFDExhausted(addr, err)
+	}
+	return conn, err
+}
+
+func dialResolved(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	release, ok := dialingLimiter.acquire("")
+	if !ok {
+		return nil, errDialBusy
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, connectDialTimeout)
+	defer cancel()
+	var d net.Dialer
+	src, haveSrc := egressSource(ctx)
+	if haveSrc {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: src.AsSlice()}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+		}
+	}
+
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if err := checkDialAddr(netip.AddrPortFrom(ip, uint16(portNum))); err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+
+	ips, err := resolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if haveSrc {
+		// A bound source address can only reach targets of its own family.
+		ips = slices.DeleteFunc(ips, func(ip netip.Addr) bool { return ip.Is4() != src.Is4() })
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no addresses in the egress source's family", Name: host, IsNotFound: true}
+		}
+	}
+	for _, ip := range ips {
+		// A name with a refused address is refused outright, before any
+		// is dialed, rather than failed over.
+		if err := checkDialAddr(netip.AddrPortFrom(ip, uint16(portNum))); err != nil {
+			return nil, err
+		}
+	}
+	ips = orderAddrs(host, ips)
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialErrorKind names the error counter for a failed dialTarget.
+func dialErrorKind(err error) string {
+	switch {
+	case errors.Is(err, errDialBusy):
+		return "dial_busy"
+	case errors.Is(err, errDNSBusy):
+		return "dns_busy"
+	case errors.Is(err, errResolveTimeout):
+		return "dns_timeout"
+	case errors.Is(err, errSelfTarget):
+		return "self_target"
+	case errors.Is(err, errPrivateTarget):
+		return "private_target"
+	case isFDExhausted(err):
+		return "fd_exhausted"
+	default:
+		return "dial_failed"
+	}
+}
+
+// targetCloseProbe, when positive, is how long to wait after dialing for the
+// target to close or reset the connection before reporting success to the
+// client.
+var targetCloseProbe time.Duration
+
+// errTargetClosed reports a target that accepted the connection and then
+// closed it within the probe window.
+var errTargetClosed = errors.New("target closed connection immediately")
+
+// probeTarget waits up to d for target to close. Targets that simply wait
+// for the client to speak pass the probe; if the target sends data first
+// (SSH, SMTP banners) it is returned so the caller can forward it.
+func probeTarget(target net.Conn, d time.Duration) (early []byte, err error) {
+	_ = target.SetReadDeadline(time.Now().Add(d))
+	defer target.SetReadDeadline(time.Time{}) //nolint:errcheck // best-effort reset
+
+	buf := make([]byte, 4096)
+	n, err := target.Read(buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return nil, nil
+	}
+	immediateCloseTargets.Add(1)
+	return nil, fmt.Errorf("%w: %v", errTargetClosed, err)
+}
+
+// Dial strategies for choosing among a target's resolved addresses. Every
+// strategy still fails over to the remaining addresses in order.
+const (
+	dialFirst      = "first"      // resolver order
+	dialRandom     = "random"     // start at a random address
+	dialRoundRobin = "roundrobin" // rotate the starting address per host
+)
+
+// dialStrategy is the dial* constant orderAddrs uses to pick which
+// resolved address of a target is tried first.
+var dialStrategy = dialFirst
+
+// maxRoundRobinHosts bounds roundRobinNext; when it fills up it is reset,
+// which only restarts rotation.
+const maxRoundRobinHosts = 4096
+
+var (
+	roundRobinMu   sync.Mutex
+	roundRobinNext = make(map[string]int)
+)
+
+func validDialStrategy(s string) bool {
+	switch s {
+	case dialFirst, dialRandom, dialRoundRobin:
+		return true
+	}
+	return false
+}
+
+// orderAddrs returns ips rotated so that dialing starts at the address
+// picked by dialStrategy.
+func orderAddrs(host string, ips []netip.Addr) []netip.Addr {
+	if len(ips) < 2 {
+		return ips
+	}
+	var start int
+	switch dialStrategy {
+	case dialRandom:
+		start = rand.IntN(len(ips))
+	case dialRoundRobin:
+		key := hostKey(host)
+		roundRobinMu.Lock()
+		if len(roundRobinNext) >= maxRoundRobinHosts {
+			clear(roundRobinNext)
+		}
+		start = roundRobinNext[key] % len(ips)
+		roundRobinNext[key] = start + 1
+		roundRobinMu.Unlock()
+	default:
+		return ips
+	}
+	return slices.Concat(ips[start:], ips[:start])
+}
+
+// nameSuffix, when set, is appended to single-label target names before
+// resolution, e.g. "example.ts.net" turns "db" into "db.example.ts.net".
+var nameSuffix string
+
+// qualifyHost appends nameSuffix to single-label host names. Names with a
+// dot, IP literals, and localhost are returned unchanged.
+func qualifyHost(host string) string {
+	if nameSuffix == "" || host == "" || strings.Contains(host, ".") || strings.EqualFold(host, "localhost") {
+		return host
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return host // IPv6 literals contain no dot
+	}
+	return host + "." + nameSuffix
+}
+
+// resolveHost looks up host's addresses, waiting for a slot in dnsLimiter.
+// Single-label names are qualified with nameSuffix first.
+func resolveHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = qualifyHost(host)
+	release, err := dnsLimiter.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	defer release()
+
+	lookupCtx := ctx
+	if resolverTimeout > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, resolverTimeout)
+		defer cancel()
+	}
+	ips, err := lookupNetIP(lookupCtx, "ip", host)
+	if err != nil {
+		if ctx.Err() == nil && lookupCtx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("resolve %s: %w", host, errResolveTimeout)
+		}
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	for i := range ips {
+		ips[i] = ips[i].Unmap()
+	}
+	return ips, nil
+}
+
+// resolveLimiter is a semaphore for DNS lookups. A limiter with max <= 0
+// never blocks.
+type resolveLimiter struct {
+	sem  chan struct{}
+	wait time.Duration
+}
+
+func newResolveLimiter(max int, wait time.Duration) *resolveLimiter {
+	l := &resolveLimiter{wait: wait}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+// acquire waits up to the queue timeout for a lookup slot. It returns
+// errDNSBusy if none frees up in time.
+func (l *resolveLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil || l.sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	default:
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	case <-timer.C:
+		return nil, errDNSBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveLimiterBusy(t *testing.T) {
+	t.Parallel()
+
+	l := newResolveLimiter(1, 20*time.Millisecond)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first acquire unexpected err: %v", err)
+	}
+
+	if _, err := l.acquire(context.Background()); !errors.Is(err, errDNSBusy) {
+		t.Fatalf("expected errDNSBusy while slot is held, got %v", err)
+	}
+
+	release()
+	release2, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire after release unexpected err: %v", err)
+	}
+	release2()
+}
+
+func TestResolveLimiterWaitsForSlot(t *testing.T) {
+	t.Parallel()
+
+	l := newResolveLimiter(1, time.Second)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first acquire unexpected err: %v", err)
+	}
+	time.AfterFunc(20*time.Millisecond, release)
+
+	release2, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected queued acquire to get the freed slot, got %v", err)
+	}
+	release2()
+}
+
+func TestDialTargetResolvesAndFailsOver(t *testing.T) {
+	// Not parallel: mutates the package-level lookupNetIP.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	port := netip.MustParseAddrPort(targetAddr).Port()
+
+	origLookup := lookupNetIP
+	lookupNetIP = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		if host != "echo.test" {
+			t.Errorf("unexpected lookup of %q", host)
+		}
+		// Nothing listens on 127.0.0.2, so the dial must fail over.
+		return []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}, nil
+	}
+	defer func() { lookupNetIP = origLookup }()
+
+	conn, err := dialTarget(context.Background(), "echo.test:"+strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatalf("dialTarget unexpected err: %v", err)
+	}
+	_ = conn.Close()
+}
+
+// stallLookup is a lookupNetIP that never answers before ctx is done.
+func stallLookup(ctx context.Context, _, _ string) ([]netip.Addr, error) {
+	<-ctx.Done()
+	return nil, &net.DNSError{Err: ctx.Err().Error(), IsTimeout: true}
+}
+
+func TestResolveHostTimeout(t *testing.T) {
+	// Not parallel: mutates the package-level lookupNetIP and resolverTimeout.
+	origLookup, origTimeout := lookupNetIP, resolverTimeout
+	defer func() { lookupNetIP, resolverTimeout = origLookup, origTimeout }()
+	lookupNetIP = stallLookup
+	resolverTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := resolveHost(context.Background(), "slow.test")
+	if !errors.Is(err, errResolveTimeout) {
+		t.Fatalf("resolveHost err = %v, want errResolveTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("resolveHost took %v, want about %v", elapsed, resolverTimeout)
+	}
+	if got := dialErrorKind(err); got != "dns_timeout" {
+		t.Fatalf("dialErrorKind = %q, want dns_timeout", got)
+	}
+
+	// A caller's own cancellation is not reported as a resolver timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := resolveHost(ctx, "slow.test"); errors.Is(err, errResolveTimeout) {
+		t.Fatalf("resolveHost with expired caller ctx = %v, want the lookup error", err)
+	}
+}
+
+func TestQualifyHost(t *testing.T) {
+	// Not parallel: mutates the package-level nameSuffix.
+	origSuffix := nameSuffix
+	defer func() { nameSuffix = origSuffix }()
+
+	nameSuffix = "example.ts.net"
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "db", want: "db.example.ts.net"},
+		{host: "db.internal", want: "db.internal"},
+		{host: "db.", want: "db."},
+		{host: "192.0.2.10", want: "192.0.2.10"},
+		{host: "2001:db8::1", want: "2001:db8::1"},
+		{host: "::1", want: "::1"},
+		{host: "localhost", want: "localhost"},
+	}
+	for _, tc := range tests {
+		if got := qualifyHost(tc.host); got != tc.want {
+			t.Fatalf("qualifyHost(%q) = %q, want %q", tc.host, got, tc.want)
+		}
+	}
+
+	nameSuffix = ""
+	if got := qualifyHost("db"); got != "db" {
+		t.Fatalf("qualifyHost(%q) with no suffix = %q, want unchanged", "db", got)
+	}
+}
+
+func TestDialTargetAppliesNameSuffix(t *testing.T) {
+	// Not parallel: mutates the package-level nameSuffix and lookupNetIP.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	port := strconv.Itoa(int(netip.MustParseAddrPort(targetAddr).Port()))
+
+	origSuffix, origLookup := nameSuffix, lookupNetIP
+	defer func() { nameSuffix, lookupNetIP = origSuffix, origLookup }()
+	nameSuffix = "example.ts.net"
+	var looked []string
+	lookupNetIP = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		looked = append(looked, host)
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}
+
+	for _, host := range []string{"echo", "echo.test"} {
+		conn, err := dialTarget(context.Background(), net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("dialTarget(%q): %v", host, err)
+		}
+		_ = conn.Close()
+	}
+	if len(looked) != 2 || looked[0] != "echo.example.ts.net" || looked[1] != "echo.test" {
+		t.Fatalf("looked up %q, want [echo.example.ts.net echo.test]", looked)
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	// Not parallel: mutates the package-level dialStrategy.
+	origStrategy := dialStrategy
+	defer func() { dialStrategy = origStrategy }()
+
+	addrs := func() []netip.Addr {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")}
+	}
+
+	dialStrategy = dialFirst
+	if got := orderAddrs("svc.test", addrs()); got[0] != addrs()[0] {
+		t.Fatalf("first strategy started at %v", got[0])
+	}
+
+	dialStrategy = dialRoundRobin
+	starts := make(map[netip.Addr]int)
+	for range 6 {
+		got := orderAddrs("rr.test", addrs())
+		if len(got) != 3 {
+			t.Fatalf("orderAddrs dropped addresses: %v", got)
+		}
+		starts[got[0]]++
+		// Every address is still available for failover.
+		seen := make(map[netip.Addr]bool)
+		for _, a := range got {
+			seen[a] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("orderAddrs returned duplicates: %v", got)
+		}
+	}
+	for _, a := range addrs() {
+		if starts[a] != 2 {
+			t.Fatalf("round robin started at %v %d times in 6 dials, want 2: %v", a, starts[a], starts)
+		}
+	}
+
+	dialStrategy = dialRandom
+	for range 20 {
+		if got := orderAddrs("rand.test", addrs()); len(got) != 3 {
+			t.Fatalf("orderAddrs dropped addresses: %v", got)
+		}
+	}
+}
+
+func TestDialTargetMaxDialing(t *testing.T) {
+	// Not parallel: mutates the package-level dialingLimiter.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	origLimiter := dialingLimiter
+	dialingLimiter = newConnLimiter(1)
+	defer func() { dialingLimiter = origLimiter }()
+
+	release, ok := dialingLimiter.acquire("")
+	if !ok {
+		t.Fatal("could not take the only dial slot")
+	}
+	if _, err := dialTarget(context.Background(), targetAddr); !errors.Is(err, errDialBusy) {
+		t.Fatalf("expected errDialBusy while slot is held, got %v", err)
+	}
+	statusLine, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n")
+	if !strings.Contains(statusLine, "503") {
+		t.Fatalf("expected 503 while dial slot is held, got %q", statusLine)
+	}
+	release()
+
+	conn, err := dialTarget(context.Background(), targetAddr)
+	if err != nil {
+		t.Fatalf("dial after release: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // test cleanup
+
+	// The slot is only held while dialing, not for the connection's lifetime.
+	conn2, err := dialTarget(context.Background(), targetAddr)
+	if err != nil {
+		t.Fatalf("dial while first connection is open: %v", err)
+	}
+	_ = conn2.Close()
+}
+
+func TestProbeTarget(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+
+	// The server closes the first connection immediately, sends a banner on
+	// the second, and stays silent on the third.
+	go func() {
+		for i := 0; ; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			switch i {
+			case 0:
+				_ = c.Close()
+			case 1:
+				_, _ = c.Write([]byte("SSH-2.0-test\r\n"))
+				defer c.Close() //nolint:errcheck // test cleanup
+			default:
+				defer c.Close() //nolint:errcheck // test cleanup
+			}
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return c
+	}
+
+	closed := dial()
+	defer closed.Close() //nolint:errcheck // test cleanup
+	if _, err := probeTarget(closed, time.Second); !errors.Is(err, errTargetClosed) {
+		t.Fatalf("expected errTargetClosed for closing target, got %v", err)
+	}
+
+	banner := dial()
+	defer banner.Close() //nolint:errcheck // test cleanup
+	early, err := probeTarget(banner, time.Second)
+	if err != nil || string(early) != "SSH-2.0-test\r\n" {
+		t.Fatalf("expected banner to be returned, got %q, %v", early, err)
+	}
+
+	silent := dial()
+	defer silent.Close() //nolint:errcheck // test cleanup
+	if early, err := probeTarget(silent, 50*time.Millisecond); err != nil || len(early) != 0 {
+		t.Fatalf("expected silent target to pass the probe, got %q, %v", early, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// egressHeader lets an HTTP CONNECT request pick one of the configured
+// egress profiles.
+const egressHeader = "X-Tailgate-Egress"
+
+// defaultEgressProfile, if configured, applies to requests that don't send
+// egressHeader.
+const defaultEgressProfile = "default"
+
+// egressProfiles maps lowercase profile names to the source address tunnels
+// dial from. The header is ignored while it is empty.
+var egressProfiles = make(map[string]netip.Addr)
+
+// addEgressProfile parses a "name=source-ip" flag value into profiles.
+func addEgressProfile(profiles map[string]netip.Addr, s string) error {
+	name, ip, ok := strings.Cut(s, "=")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !ok || name == "" {
+		return fmt.Errorf("invalid egress profile %q: want name=source-ip", s)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return fmt.Errorf("invalid source address for egress profile %q: %w", name, err)
+	}
+	if _, dup := profiles[name]; dup {
+		return fmt.Errorf("duplicate egress profile %q", name)
+	}
+	profiles[name] = addr.Unmap()
+	return nil
+}
+
+// egressDirect is the egress rule profile that dials with the system's
+// routing, even when a default profile is defined.
+const egressDirect = "direct"
+
+// egressRules pick the egress profile for tunnels that don't name one, by
+// target host; the first rule matching wins.
+var egressRules []egressRule
+
+// egressRule routes targets whose host matches pattern, written like a
+// grant host ("db.internal", "*.eu.example.com", "10.0.0.0/8", "*"),
+// through profile or egressDirect.
+type egressRule struct {
+	pattern string
+	profile string
+}
+
+func (r egressRule) String() string {
+	return r.pattern + "=" + r.profile
+}
+
+// parseEgressRule parses a "pattern=profile" flag value.
+func parseEgressRule(s string) (egressRule, error) {
+	pattern, profile, ok := strings.Cut(s, "=")
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	profile = strings.ToLower(strings.TrimSpace(profile))
+	if !ok || pattern == "" || profile == "" {
+		return egressRule{}, fmt.Errorf("invalid egress rule %q: want host-pattern=profile", s)
+	}
+	if strings.Contains(pattern, "/") {
+		if _, err := netip.ParsePrefix(pattern); err != nil {
+			return egressRule{}, fmt.Errorf("invalid CIDR in egress rule %q: %w", s, err)
+		}
+	}
+	return egressRule{pattern: pattern, profile: profile}, nil
+}
+
+// checkEgressRules reports a rule naming a profile that isn't defined.
+func checkEgressRules(rules []egressRule, profiles map[string]netip.Addr) error {
+	for _, r := range rules {
+		if _, ok := profiles[r.profile]; !ok && r.profile != egressDirect {
+			return fmt.Errorf("egress rule %s=%s names undefined profile %q", r.pattern, r.profile, r.profile)
+		}
+	}
+	return nil
+}
+
+// selectEgress returns the source address for the profile a request names
+// in egressHeader. An empty name falls back to the first egressRules match
+// for host, then the default profile or, if there is none, the system's
+// choice (an invalid Addr). ok is false for names that aren't configured.
+func selectEgress(name, host string) (src netip.Addr, ok bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		if src, matched := ruleEgress(host); matched {
+			return src, true
+		}
+		return egressProfiles[defaultEgressProfile], true
+	}
+	src, ok = egressProfiles[name]
+	return src, ok
+}
+
+// ruleEgress returns the source address of the first egressRules match
+// for host: a profile's address, or an invalid Addr for egressDirect.
+func ruleEgress(host string) (src netip.Addr, matched bool) {
+	for _, r := range egressRules {
+		if hostPatternMatches(r.pattern, host) {
+			return egressProfiles[r.profile], true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// withRuleEgress binds a SOCKS5 dial to targetAddr, which has no egress
+// header, to the source address an egress rule picks.
+func withRuleEgress(ctx context.Context, targetAddr string) context.Context {
+	host, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return ctx
+	}
+	if src, matched := ruleEgress(host); matched && src.IsValid() {
+		return withEgressSource(ctx, src)
+	}
+	return ctx
+}
+
+type egressSourceKey struct{}
+
+// withEgressSource returns a context that makes dialTarget bind to src.
+func withEgressSource(ctx context.Context, src netip.Addr) context.Context {
+	return context.WithValue(ctx, egressSourceKey{}, src)
+}
+
+func egressSource(ctx context.Context) (netip.Addr, bool) {
+	src, ok := ctx.Value(egressSourceKey{}).(netip.Addr)
+	return src, ok && src.IsValid()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestAddEgressProfile(t *testing.T) {
+	t.Parallel()
+
+	profiles := make(map[string]netip.Addr)
+	if err := addEgressProfile(profiles, " EU = 198.51.100.7 "); err != nil {
+		t.Fatalf("addEgressProfile: %v", err)
+	}
+	if got := profiles["eu"]; got != netip.MustParseAddr("198.51.100.7") {
+		t.Fatalf("profile eu = %v, want 198.51.100.7", got)
+	}
+	for _, bad := range []string{"", "eu", "=198.51.100.7", "us=not-an-ip", "eu=192.0.2.1"} {
+		if err := addEgressProfile(profiles, bad); err == nil {
+			t.Fatalf("addEgressProfile(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestSelectEgress(t *testing.T) {
+	// Not parallel: mutates the package-level egressProfiles.
+	origProfiles := egressProfiles
+	defer func() { egressProfiles = origProfiles }()
+
+	egressProfiles = map[string]netip.Addr{"eu": netip.MustParseAddr("198.51.100.7")}
+	if src, ok := selectEgress("", "example.com"); !ok || src.IsValid() {
+		t.Fatalf("selectEgress(\"\") with no default = %v, %v; want system routing", src, ok)
+	}
+	if src, ok := selectEgress("EU", "example.com"); !ok || src != egressProfiles["eu"] {
+		t.Fatalf("selectEgress(EU) = %v, %v", src, ok)
+	}
+	if _, ok := selectEgress("us", "example.com"); ok {
+		t.Fatal("selectEgress accepted an unconfigured profile")
+	}
+
+	egressProfiles[defaultEgressProfile] = netip.MustParseAddr("203.0.113.10")
+	if src, ok := selectEgress("", "example.com"); !ok || src != egressProfiles[defaultEgressProfile] {
+		t.Fatalf("selectEgress(\"\") with default = %v, %v", src, ok)
+	}
+}
+
+func TestParseEgressRule(t *testing.T) {
+	t.Parallel()
+
+	r, err := parseEgressRule(" *.EU.example.com = EU ")
+	if err != nil || r != (egressRule{pattern: "*.eu.example.com", profile: "eu"}) {
+		t.Fatalf("parseEgressRule = %+v, %v", r, err)
+	}
+	for _, bad := range []string{"", "*.example.com", "=eu", "*.example.com=", "10.0.0.0/33=eu"} {
+		if _, err := parseEgressRule(bad); err == nil {
+			t.Errorf("parseEgressRule(%q) succeeded, want error", bad)
+		}
+	}
+
+	profiles := map[string]netip.Addr{"eu": netip.MustParseAddr("198.51.100.7")}
+	if err := checkEgressRules([]egressRule{{"*", "eu"}, {"db", egressDirect}}, profiles); err != nil {
+		t.Fatalf("checkEgressRules: %v", err)
+	}
+	if err := checkEgressRules([]egressRule{{"*", "us"}}, profiles); err == nil {
+		t.Fatal("checkEgressRules accepted an undefined profile")
+	}
+}
+
+func TestEgressRulePrecedence(t *testing.T) {
+	// Not parallel: mutates the package-level egressProfiles and
+	// egressRules.
+	origProfiles, origRules := egressProfiles, egressRules
+	defer func() { egressProfiles, egressRules = origProfiles, origRules }()
+
+	eu := netip.MustParseAddr("198.51.100.7")
+	us := netip.MustParseAddr("192.0.2.20")
+	def := netip.MustParseAddr("203.0.113.10")
+	egressProfiles = map[string]netip.Addr{"eu": eu, "us": us, defaultEgressProfile: def}
+	// Overlapping patterns: the first one listed wins, so the narrower
+	// rules come first.
+	egressRules = []egressRule{
+		{"db.eu.example.com", egressDirect},
+		{"*.eu.example.com", "eu"},
+		{"*.example.com", "us"},
+		{"10.1.0.0/16", "eu"},
+		{"10.0.0.0/8", "us"},
+	}
+	for _, tc := range []struct {
+		header, host string
+		want         netip.Addr
+	}{
+		{host: "db.eu.example.com", want: netip.Addr{}}, // direct overrides the default profile
+		{host: "API.eu.example.com.", want: eu},
+		{host: "www.example.com", want: us},
+		{host: "10.1.2.3", want: eu},
+		{host: "10.9.9.9", want: us},
+		{host: "example.org", want: def},                     // no rule: the default profile
+		{header: "us", host: "api.eu.example.com", want: us}, // the header beats any rule
+	} {
+		if src, ok := selectEgress(tc.header, tc.host); !ok || src != tc.want {
+			t.Errorf("selectEgress(%q, %q) = %v, %v; want %v", tc.header, tc.host, src, ok, tc.want)
+		}
+	}
+
+	// SOCKS5 follows the rules too, but without a default profile.
+	if src, ok := egressSource(withRuleEgress(context.Background(), "api.eu.example.com:443")); !ok || src != eu {
+		t.Fatalf("SOCKS5 egress for api.eu.example.com = %v, %v; want eu", src, ok)
+	}
+	if _, ok := egressSource(withRuleEgress(context.Background(), "example.org:443")); ok {
+		t.Fatal("SOCKS5 egress for an unmatched host is bound; want the system's routing")
+	}
+}
+
+func TestHandleHTTPConnectEgressProfile(t *testing.T) {
+	// Not parallel: mutates the package-level egressProfiles.
+	origProfiles := egressProfiles
+	defer func() { egressProfiles = origProfiles }()
+	egressProfiles = map[string]netip.Addr{"loop2": netip.MustParseAddr("127.0.0.2")}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+	peers := make(chan net.Addr, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peers <- c.RemoteAddr()
+			_ = c.Close()
+		}
+	}()
+	targetAddr := ln.Addr().String()
+
+	statusLine, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n"+egressHeader+": nope\r\n\r\n")
+	if !strings.Contains(statusLine, "400") {
+		t.Fatalf("unknown egress profile: got %q, want 400", statusLine)
+	}
+
+	// Check the dial itself first so hosts without 127.0.0.2 on loopback
+	// skip rather than fail.
+	conn, err := dialTarget(withEgressSource(context.Background(), egressProfiles["loop2"]), targetAddr)
+	if errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Skipf("cannot bind 127.0.0.2 on this host: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("dial from egress source: %v", err)
+	}
+	_ = conn.Close()
+	if got := netip.MustParseAddrPort((<-peers).String()).Addr(); got != egressProfiles["loop2"] {
+		t.Fatalf("target saw source %v, want 127.0.0.2", got)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	// Wait for the handler so it can't outlive the test and race with
+	// later ones on package-level config.
+	defer func() { _ = clientConn.Close(); <-done }()
+	go func() {
+		defer close(done)
+		defer serverConn.Close() //nolint:errcheck // test cleanup
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+	}()
+	go func() {
+		_, _ = io.WriteString(clientConn, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n"+egressHeader+": loop2\r\n\r\n")
+	}()
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT with egress profile: status %d, want 200", resp.StatusCode)
+	}
+	select {
+	case peer := <-peers:
+		if got := netip.MustParseAddrPort(peer.String()).Addr(); got != egressProfiles["loop2"] {
+			t.Fatalf("tunnel dialed from %v, want 127.0.0.2", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("target never saw the tunnel's connection")
+	}
+}
+
+func TestSOCKSEgressRuleByName(t *testing.T) {
+	// Not parallel: mutates the package-level egressProfiles, egressRules,
+	// and useBuiltinSOCKS.
+	origProfiles, origRules, origBuiltin := egressProfiles, egressRules, useBuiltinSOCKS
+	defer func() { egressProfiles, egressRules, useBuiltinSOCKS = origProfiles, origRules, origBuiltin }()
+	egressProfiles = map[string]netip.Addr{"loop2": netip.MustParseAddr("127.0.0.2")}
+	egressRules = []egressRule{{"localhost", "loop2"}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+	peers := make(chan net.Addr, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peers <- c.RemoteAddr()
+			_ = c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	conn, err := dialTarget(withEgressSource(context.Background(), egressProfiles["loop2"]), ln.Addr().String())
+	if errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Skipf("cannot bind 127.0.0.2 on this host: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("dial from egress source: %v", err)
+	}
+	_ = conn.Close()
+	<-peers
+
+	// The rule names the host, so it has to match the name the client
+	// sent, not the address it resolves to.
+	for _, builtin := range []bool{false, true} {
+		useBuiltinSOCKS = builtin
+		client, stop := startSOCKSConn(t)
+		if rep := socksConnect(t, client, net.JoinHostPort("localhost", port)); rep != statute.RepSuccess {
+			stop()
+			t.Fatalf("builtin=%v: SOCKS connect to localhost: reply %d, want success", builtin, rep)
+		}
+		select {
+		case peer := <-peers:
+			if got := netip.MustParseAddrPort(peer.String()).Addr(); got != egressProfiles["loop2"] {
+				t.Errorf("builtin=%v: tunnel dialed from %v, want 127.0.0.2 from the localhost rule", builtin, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("builtin=%v: target never saw the tunnel's connection", builtin)
+		}
+		stop()
+	}
+}
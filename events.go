@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentEvents keeps the last connection events for the admin /recent
+// endpoint.
+var recentEvents = newEventRing(256)
+
+// Connection event types.
+const (
+	eventOpen  = "open"
+	eventClose = "close"
+)
+
+// connEvent is one entry in recentEvents, served as JSON.
+type connEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Remote   string    `json:"remote"`
+	Local    string    `json:"local"`
+	Protocol string    `json:"protocol,omitempty"` // set on close
+	Duration string    `json:"duration,omitempty"` // set on close
+}
+
+// eventRing is a fixed-size, concurrency-safe ring of connEvents that
+// overwrites its oldest entry when full. A ring with size <= 0 records
+// nothing.
+type eventRing struct {
+	mu   sync.Mutex
+	buf  []connEvent
+	next int
+	full bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{buf: make([]connEvent, max(size, 0))}
+}
+
+func (r *eventRing) add(e connEvent) {
+	if r == nil || len(r.buf) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = e
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// snapshot returns the recorded events, oldest first.
+func (r *eventRing) snapshot() []connEvent {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]connEvent(nil), r.buf[:r.next]...)
+	}
+	out := make([]connEvent, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
+
+// recordEvent adds e to recentEvents and publishes it to /events
+// subscribers.
+func recordEvent(e connEvent) {
+	recentEvents.add(e)
+	eventStream.publish(e)
+}
+
+// serveRecentEvents writes recentEvents as a JSON array, oldest first.
+func serveRecentEvents(w http.ResponseWriter, _ *http.Request) {
+	events := recentEvents.snapshot()
+	if events == nil {
+		events = []connEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestEventRingOverwritesOldest(t *testing.T) {
+	t.Parallel()
+
+	r := newEventRing(3)
+	if got := r.snapshot(); len(got) != 0 {
+		t.Fatalf("empty ring snapshot has %d events", len(got))
+	}
+	for i := range 5 {
+		r.add(connEvent{Remote: strconv.Itoa(i)})
+	}
+
+	got := r.snapshot()
+	if len(got) != 3 {
+		t.Fatalf("snapshot has %d events, want 3", len(got))
+	}
+	for i, want := range []string{"2", "3", "4"} {
+		if got[i].Remote != want {
+			t.Fatalf("snapshot[%d].Remote = %q, want %q", i, got[i].Remote, want)
+		}
+	}
+}
+
+func TestEventRingDisabled(t *testing.T) {
+	t.Parallel()
+
+	r := newEventRing(0)
+	r.add(connEvent{Remote: "a"})
+	if got := r.snapshot(); len(got) != 0 {
+		t.Fatalf("disabled ring recorded %d events", len(got))
+	}
+}
+
+func TestEventRingConcurrentAdd(t *testing.T) {
+	t.Parallel()
+
+	r := newEventRing(16)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 100 {
+				r.add(connEvent{Type: eventOpen})
+				_ = r.snapshot()
+			}
+		})
+	}
+	wg.Wait()
+	if got := len(r.snapshot()); got != 16 {
+		t.Fatalf("snapshot has %d events, want 16", got)
+	}
+}
+
+func TestAdminRecent(t *testing.T) {
+	// Not parallel: mutates the package-level recentEvents.
+	origEvents := recentEvents
+	recentEvents = newEventRing(4)
+	defer func() { recentEvents = origEvents }()
+
+	recentEvents.add(connEvent{Type: eventOpen, Remote: "100.64.0.2:5000"})
+	recentEvents.add(connEvent{Type: eventClose, Remote: "100.64.0.2:5000", Protocol: "http", Duration: "1ms"})
+
+	srv := httptest.NewServer(newAdminMux())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/recent")
+	if err != nil {
+		t.Fatalf("get /recent: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // test cleanup
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", ct)
+	}
+
+	var events []connEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatalf("decode /recent: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != eventOpen || events[1].Protocol != "http" {
+		t.Fatalf("unexpected /recent events: %+v", events)
+	}
+}
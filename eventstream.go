@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventStream fans connection events out to admin /events subscribers.
+var eventStream = newEventHub(maxEventSubscribers, eventSubscriberBuffer)
+
+// maxEventSubscribers bounds concurrent /events streams; more get 503.
+const maxEventSubscribers = 8
+
+// eventSubscriberBuffer is how many events may queue for a subscriber
+// before further events are dropped for it.
+const eventSubscriberBuffer = 64
+
+// eventStreamKeepAlive is how often an idle stream gets an SSE comment, so
+// intermediaries don't time it out.
+const eventStreamKeepAlive = 30 * time.Second
+
+// eventHub delivers each published event to every subscriber without
+// blocking: a subscriber whose queue is full misses the event, and is told
+// how many it missed before its next one.
+type eventHub struct {
+	max, buffer int
+
+	mu   sync.Mutex
+	subs map[*eventSub]struct{}
+}
+
+type eventSub struct {
+	ch      chan connEvent
+	dropped atomic.Int64
+}
+
+func newEventHub(max, buffer int) *eventHub {
+	return &eventHub{max: max, buffer: buffer, subs: make(map[*eventSub]struct{})}
+}
+
+// subscribe registers a subscriber, or returns false when the hub is full.
+// The caller must unsubscribe it.
+func (h *eventHub) subscribe() (*eventSub, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= h.max {
+		return nil, false
+	}
+	s := &eventSub{ch: make(chan connEvent, h.buffer)}
+	h.subs[s] = struct{}{}
+	return s, true
+}
+
+func (h *eventHub) unsubscribe(s *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+func (h *eventHub) publish(e connEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// serveEventStream streams connection events as server-sent events until
+// the client goes away. Each event is a JSON connEvent whose SSE event name
+// is its type; a "dropped" event with {"dropped": n} precedes the next
+// delivered event when n events were dropped because the client read too
+// slowly.
+func serveEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, ok := eventStream.subscribe()
+	if !ok {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many event subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer eventStream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, _ = fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-sub.ch:
+			if n := sub.dropped.Swap(0); n > 0 {
+				writeSSE(w, "dropped", map[string]int64{"dropped": n})
+			}
+			writeSSE(w, e.Type, e)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, v any) {
+	data, _ := json.Marshal(v)
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
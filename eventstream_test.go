@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubDropsForSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	h := newEventHub(1, 2)
+	sub, ok := h.subscribe()
+	if !ok {
+		t.Fatal("first subscribe refused")
+	}
+	if _, ok := h.subscribe(); ok {
+		t.Fatal("subscribe past the limit should be refused")
+	}
+	for range 5 {
+		h.publish(connEvent{Type: eventOpen})
+	}
+	if got := len(sub.ch); got != 2 {
+		t.Fatalf("queued %d events, want 2", got)
+	}
+	if got := sub.dropped.Load(); got != 3 {
+		t.Fatalf("dropped %d events, want 3", got)
+	}
+
+	h.unsubscribe(sub)
+	h.publish(connEvent{Type: eventClose}) // no subscribers; must not block
+	if _, ok := h.subscribe(); !ok {
+		t.Fatal("subscribe after unsubscribe refused")
+	}
+}
+
+func TestServeEventStream(t *testing.T) {
+	// Not parallel: mutates the package-level eventStream.
+	orig := eventStream
+	defer func() { eventStream = orig }()
+	eventStream = newEventHub(1, 1)
+
+	srv := httptest.NewServer(newAdminMux())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // test cleanup
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// The stream is subscribed once headers arrive. A second subscriber is
+	// over the limit.
+	busy, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("second GET /events: %v", err)
+	}
+	_ = busy.Body.Close()
+	if busy.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second subscriber got %d, want 503", busy.StatusCode)
+	}
+
+	// A published event arrives named by its type, with the connEvent as
+	// JSON data.
+	eventStream.publish(connEvent{Type: eventOpen, Remote: "100.64.0.2:1"})
+	var sawOpen bool
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		if line == "event: open\n" {
+			sawOpen = true
+			continue
+		}
+		if sawOpen && strings.HasPrefix(line, "data: ") {
+			if !strings.Contains(line, `"remote":"100.64.0.2:1"`) {
+				t.Fatalf("event data = %q", line)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// fdShedThreshold, when positive, is the fraction of the soft open-file
+// limit at which serve starts closing new connections, so tunnels already
+// open keep working instead of every new dial failing.
+var fdShedThreshold float64
+
+// fdShedding is set while serve is shedding new connections for lack of
+// file descriptors.
+var fdShedding atomic.Bool
+
+// fdSampleInterval is how often watchFDUsage checks descriptor usage.
+const fdSampleInterval = time.Second
+
+func init() {
+	expvar.Publish("fds", expvar.Func(func() any {
+		open, _ := openFDCount()
+		soft, _, _ := fdLimits()
+		return map[string]any{"open": open, "limit": soft, "shedding": fdShedding.Load()}
+	}))
+}
+
+// isFDExhausted reports whether err is the process (EMFILE) or system
+// (ENFILE) running out of file descriptors.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// noteFDExhausted reports a dial that failed for lack of file descriptors.
+// With -fd-shed-threshold set it also starts shedding right away; the next
+// sample by watchFDUsage stops it once usage is back under the threshold.
+func noteFDExhausted(target string, err error) {
+	open, _ := openFDCount()
+	soft, _, _ := fdLimits()
+	slog.Error("out of file descriptors; dials are failing", "target", target, "open_fds", open, "fd_limit", soft, "error", err)
+	if fdShedThreshold > 0 {
+		fdShedding.Store(true)
+	}
+}
+
+// watchFDUsage sets fdShedding whenever open descriptors are at or above
+// threshold of the soft limit, until ctx is done.
+func watchFDUsage(ctx context.Context, threshold float64, logger *slog.Logger) {
+	t := time.NewTicker(fdSampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		open, ok := openFDCount()
+		soft, _, limitOK := fdLimits()
+		// Without a count, shedding started by noteFDExhausted lasts one
+		// interval.
+		shed := ok && limitOK && soft > 0 && float64(open) >= threshold*float64(soft)
+		if fdShedding.Swap(shed) != shed {
+			if shed {
+				logger.Warn("file descriptors nearly exhausted; closing new connections", "open_fds", open, "fd_limit", soft)
+			} else {
+				logger.Info("file descriptor usage recovered; accepting connections", "open_fds", open, "fd_limit", soft)
+			}
+		}
+	}
+}
+
+// openFDCount returns how many descriptors the process has open, where the
+// platform lists them under /proc/self/fd or /dev/fd.
+func openFDCount() (int, bool) {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return len(entries), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// fdLimits reports no limit on platforms without RLIMIT_NOFILE.
+func fdLimits() (soft, hard uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsFDExhausted(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.EMFILE)}, true},
+		{fmt.Errorf("resolve: %w", syscall.ENFILE), true},
+		{syscall.ECONNREFUSED, false},
+		{nil, false},
+	} {
+		if got := isFDExhausted(tc.err); got != tc.want {
+			t.Errorf("isFDExhausted(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	if got := dialErrorKind(&net.OpError{Op: "dial", Err: syscall.EMFILE}); got != "fd_exhausted" {
+		t.Errorf("dialErrorKind(EMFILE) = %q, want fd_exhausted", got)
+	}
+}
+
+func TestServeShedsWhileOutOfFDs(t *testing.T) {
+	// Not parallel: mutates the package-level fdShedding.
+	defer fdShedding.Store(false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(context.Background(), ln, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+	defer func() { _ = ln.Close(); <-served }()
+
+	fdShedding.Store(true)
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // test cleanup
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("read from shed connection = %d, %v, want it closed", n, err)
+	}
+}
+
+func TestWatchFDUsage(t *testing.T) {
+	// Not parallel: mutates the package-level fdShedding.
+	defer fdShedding.Store(false)
+	if _, ok := openFDCount(); !ok {
+		t.Skip("no descriptor listing on this platform")
+	}
+	if _, _, ok := fdLimits(); !ok {
+		t.Skip("no descriptor limit on this platform")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchFDUsage(ctx, 1e-9, slog.New(slog.DiscardHandler)) // any open fd is over
+	}()
+	deadline := time.Now().Add(3 * fdSampleInterval)
+	for !fdShedding.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if !fdShedding.Load() {
+		t.Fatal("watchFDUsage did not start shedding above the threshold")
+	}
+}
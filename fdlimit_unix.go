@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// fdLimits returns the soft and hard RLIMIT_NOFILE.
+func fdLimits() (soft, hard uint64, ok bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, 0, false
+	}
+	return uint64(rl.Cur), uint64(rl.Max), true
+}
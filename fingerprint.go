@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requiredProtocols, when non-nil, maps destination ports to the protocol
+// their tunnels must carry, checked against the client's first bytes once
+// the tunnel is up. Mismatches are closed as policy violations.
+var requiredProtocols map[int]string
+
+var errProtocolMismatch = errors.New("first bytes don't match the required protocol")
+
+// maxFingerprintLen is the most client bytes read to decide a fingerprint.
+const maxFingerprintLen = maxMethodLen + 1
+
+// protocolFingerprints check the start of a client's stream. A check
+// returns done once it has seen enough bytes to decide.
+var protocolFingerprints = map[string]func(b []byte) (ok, done bool){
+	// A TLS handshake record: content type 22, then a legacy version
+	// with major version 3 (SSL 3.0 through TLS 1.3).
+	"tls": prefixFingerprint([]byte{0x16, 0x03}),
+	// The SSH identification string (RFC 4253 section 4.2), which clients
+	// send without waiting for the server's.
+	"ssh": prefixFingerprint([]byte("SSH-")),
+	// An HTTP/1.x request line: an upper-case method token and a space.
+	"http": httpFingerprint,
+}
+
+func prefixFingerprint(prefix []byte) func([]byte) (bool, bool) {
+	return func(b []byte) (ok, done bool) {
+		n := min(len(b), len(prefix))
+		if !bytes.Equal(b[:n], prefix[:n]) {
+			return false, true
+		}
+		return n == len(prefix), n == len(prefix)
+	}
+}
+
+func httpFingerprint(b []byte) (ok, done bool) {
+	for i, c := range b {
+		switch {
+		case c == ' ':
+			return i > 0, true
+		case i >= maxMethodLen, c < 'A' || c > 'Z':
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// parseRequiredProtocols parses a -require-protocols value such as
+// "443=tls,22=ssh" into a port to protocol map.
+func parseRequiredProtocols(s string) (map[int]string, error) {
+	var out map[int]string
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		portStr, proto, ok := strings.Cut(field, "=")
+		port, err := strconv.ParseUint(strings.TrimSpace(portStr), 10, 16)
+		if !ok || err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid entry %q: want port=protocol", field)
+		}
+		proto = strings.ToLower(strings.TrimSpace(proto))
+		if protocolFingerprints[proto] == nil {
+			return nil, fmt.Errorf("unknown protocol %q in %q: want one of %s", proto, field, strings.Join(fingerprintNames(), ", "))
+		}
+		if out == nil {
+			out = make(map[int]string)
+		}
+		out[int(port)] = proto
+	}
+	return out, nil
+}
+
+func fingerprintNames() []string {
+	var names []string
+	for name := range protocolFingerprints {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// requiredProtocol returns the protocol tunnels to the "host:port"
+// targetAddr must carry, or "" when any is allowed.
+func requiredProtocol(targetAddr string) string {
+	if requiredProtocols == nil {
+		return ""
+	}
+	_, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return ""
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return ""
+	}
+	return requiredProtocols[port]
+}
+
+// checkClientProtocol reads the client's first bytes from conn, after
+// pending, until the proto fingerprint can decide, waiting at most timeout.
+// It returns the bytes read, which the relay must replay ahead of conn.
+// Clients that wait for the server to speak first time out.
+func checkClientProtocol(conn net.Conn, pending []byte, proto string, timeout time.Duration) ([]byte, error) {
+	check := protocolFingerprints[proto]
+	// pending may alias a bufio.Reader's buffer, so grow a copy.
+	b := append([]byte(nil), pending...)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{}) //nolint:errcheck // best-effort cleanup
+	buf := make([]byte, maxFingerprintLen)
+	for {
+		if ok, done := check(b); done {
+			if !ok {
+				return nil, errProtocolMismatch
+			}
+			return b, nil
+		}
+		if len(b) >= maxFingerprintLen {
+			return nil, errProtocolMismatch
+		}
+		n, err := conn.Read(buf[:maxFingerprintLen-len(b)])
+		b = append(b, buf[:n]...)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProtocolFingerprints(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		proto, first string
+		ok, done     bool
+	}{
+		{"tls", "\x16\x03\x01\x02\x00", true, true},
+		{"tls", "\x16", false, false},
+		{"tls", "\x16\x02", false, true},
+		{"tls", "GET / HTTP/1.1", false, true},
+		{"ssh", "SSH-2.0-OpenSSH_9.6\r\n", true, true},
+		{"ssh", "SS", false, false},
+		{"ssh", "\x16\x03\x01", false, true},
+		{"http", "GET / HTTP/1.1\r\n", true, true},
+		{"http", "OPTIONS * HTTP/1.1", true, true},
+		{"http", "GE", false, false},
+		{"http", " GET", false, true},
+		{"http", "get / HTTP/1.1", false, true},
+		{"http", "SSH-2.0-x", false, true},
+		{"http", "ABCDEFGHIJKLMNOPQ", false, true}, // longer than any method
+	} {
+		ok, done := protocolFingerprints[tc.proto]([]byte(tc.first))
+		if ok != tc.ok || done != tc.done {
+			t.Errorf("%s(%q) = %v, %v, want %v, %v", tc.proto, tc.first, ok, done, tc.ok, tc.done)
+		}
+	}
+}
+
+func TestParseRequiredProtocols(t *testing.T) {
+	t.Parallel()
+
+	got, err := parseRequiredProtocols(" 443=TLS, 22=ssh,,8080 = http")
+	if err != nil {
+		t.Fatalf("parseRequiredProtocols: %v", err)
+	}
+	if len(got) != 3 || got[443] != "tls" || got[22] != "ssh" || got[8080] != "http" {
+		t.Fatalf("parseRequiredProtocols = %v", got)
+	}
+	if got, err := parseRequiredProtocols(""); err != nil || got != nil {
+		t.Fatalf("parseRequiredProtocols(\"\") = %v, %v, want nil", got, err)
+	}
+	for _, bad := range []string{"443", "0=tls", "443=smtp", "x=tls"} {
+		if _, err := parseRequiredProtocols(bad); err == nil {
+			t.Errorf("parseRequiredProtocols(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestHandleHTTPConnectRequireProtocol(t *testing.T) {
+	// Not parallel: mutates the package-level requiredProtocols and
+	// tlsFirstByteTimeout.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	_, portStr, _ := net.SplitHostPort(targetAddr)
+	port, _ := strconv.Atoi(portStr)
+	origProtocols, origTimeout := requiredProtocols, tlsFirstByteTimeout
+	requiredProtocols = map[int]string{port: "ssh"}
+	tlsFirstByteTimeout = 200 * time.Millisecond
+	defer func() { requiredProtocols, tlsFirstByteTimeout = origProtocols, origTimeout }()
+
+	t.Run("matching", func(t *testing.T) {
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer func() { _ = clientConn.Close(); <-done }()
+
+		// Written in pieces, so the fingerprint has to wait for more.
+		go func() {
+			_, _ = io.WriteString(clientConn, "SS")
+			_, _ = io.WriteString(clientConn, "H-2.0-client\r\n")
+		}()
+		_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, len("SSH-2.0-client\r\n"))
+		if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatalf("read echoed banner: %v", err)
+		}
+		if string(buf) != "SSH-2.0-client\r\n" {
+			t.Fatalf("echoed %q", buf)
+		}
+	})
+
+	t.Run("mismatch_closed", func(t *testing.T) {
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer clientConn.Close() //nolint:errcheck // test cleanup
+
+		go func() { _, _ = io.WriteString(clientConn, "GET / HTTP/1.1\r\n\r\n") }()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("tunnel carrying the wrong protocol was not closed")
+		}
+	})
+
+	t.Run("silent_client_closed", func(t *testing.T) {
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer clientConn.Close() //nolint:errcheck // test cleanup
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("tunnel with no client data was not closed")
+		}
+	})
+}
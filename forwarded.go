@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies lists the peers whose X-Forwarded-For headers are honored
+// for the client address in logs.
+var trustedProxies []netip.Prefix
+
+// parsePrefixList parses a comma-separated list of CIDRs. Bare IPs are
+// accepted as single-address prefixes.
+func parsePrefixList(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", field, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", field, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP extracts the IP from a net.Addr such as *net.TCPAddr.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(addr.String()); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// effectiveClient returns the address to treat as the client for a request
+// received on conn. When the immediate peer is a trusted proxy, the
+// X-Forwarded-For chain is walked from the right, skipping further trusted
+// hops, and the first untrusted address is used. Otherwise, or if the header
+// is absent or unparseable, the peer address is returned and forwarded
+// headers are ignored. The result is only logged: per-user limits and
+// grants look up the immediate peer's tailnet identity, which a forwarded
+// address doesn't have.
+func effectiveClient(conn net.Conn, header http.Header) string {
+	return forwardedClient(conn.RemoteAddr(), header, trustedProxies)
+}
+
+func forwardedClient(peerAddr net.Addr, header http.Header, trusted []netip.Prefix) string {
+	peer := addrString(peerAddr)
+	peerIP, ok := addrIP(peerAddr)
+	if !ok || !prefixesContain(trusted, peerIP) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return peer
+		}
+		if !prefixesContain(trusted, ip) {
+			return ip.Unmap().String()
+		}
+	}
+	return peer
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParsePrefixList(t *testing.T) {
+	t.Parallel()
+
+	prefixes, err := parsePrefixList("10.0.0.0/8, 192.168.1.5 ,fd00::/8")
+	if err != nil {
+		t.Fatalf("parsePrefixList unexpected err: %v", err)
+	}
+	if len(prefixes) != 3 {
+		t.Fatalf("expected 3 prefixes, got %d", len(prefixes))
+	}
+	if got := prefixes[1].String(); got != "192.168.1.5/32" {
+		t.Fatalf("bare IP parsed as %q, want 192.168.1.5/32", got)
+	}
+
+	if _, err := parsePrefixList("not-a-cidr"); err == nil {
+		t.Fatal("expected error for invalid CIDR")
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := parsePrefixList("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("parsePrefixList: %v", err)
+	}
+	trustedPeer := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}
+	untrustedPeer := &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5000}
+
+	tests := []struct {
+		name string
+		peer net.Addr
+		xff  []string
+		want string
+	}{
+		{name: "trusted_peer", peer: trustedPeer, xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted_chain", peer: trustedPeer, xff: []string{"198.51.100.7, 10.9.9.9"}, want: "198.51.100.7"},
+		{name: "spoofed_left_entry", peer: trustedPeer, xff: []string{"1.1.1.1, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "multiple_headers", peer: trustedPeer, xff: []string{"198.51.100.7", "10.9.9.9"}, want: "198.51.100.7"},
+		{name: "trusted_no_header", peer: trustedPeer, want: "10.1.2.3:5000"},
+		{name: "trusted_garbage", peer: trustedPeer, xff: []string{"not-an-ip"}, want: "10.1.2.3:5000"},
+		{name: "untrusted_peer", peer: untrustedPeer, xff: []string{"198.51.100.7"}, want: "203.0.113.9:5000"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			h := make(http.Header)
+			for _, v := range tc.xff {
+				h.Add("X-Forwarded-For", v)
+			}
+			if got := forwardedClient(tc.peer, h, trusted); got != tc.want {
+				t.Fatalf("forwardedClient = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// serveCheckInterval is how often watchServeExposure reloads the node's
+// Serve config, so Funnel turned on after startup is still caught.
+const serveCheckInterval = time.Minute
+
+// currentExposure is the last exposure watchServeExposure found, published
+// as the serve expvar.
+var currentExposure atomic.Pointer[serveExposure]
+
+func init() {
+	expvar.Publish("serve", expvar.Func(func() any { return currentExposure.Load() }))
+}
+
+// serveExposure lists the Serve endpoints ("host:port") whose backend is
+// one of tailgate's proxy listeners. Funnel holds those of them that
+// Funnel also opens to the public internet.
+type serveExposure struct {
+	Served []string `json:"served"`
+	Funnel []string `json:"funnel"`
+}
+
+func (e *serveExposure) equal(o *serveExposure) bool {
+	return slices.Equal(e.Served, o.Served) && slices.Equal(e.Funnel, o.Funnel)
+}
+
+// proxyExposure returns where sc serves a backend on one of proxyPorts: a
+// TCP forward or web proxy to a proxy listener, matched by port alone
+// since Serve backends are local addresses. Anything serving the proxy
+// port is an open egress to whoever can reach that endpoint.
+func proxyExposure(sc *ipn.ServeConfig, proxyPorts []int) *serveExposure {
+	e := &serveExposure{Served: []string{}, Funnel: []string{}}
+	var walk func(sc *ipn.ServeConfig)
+	walk = func(sc *ipn.ServeConfig) {
+		if sc == nil {
+			return
+		}
+		for port, h := range sc.TCP {
+			if h == nil || !backendIsProxy(h.TCPForward, proxyPorts) {
+				continue
+			}
+			e.Served = append(e.Served, ":"+strconv.Itoa(int(port)))
+			for hp, on := range sc.AllowFunnel {
+				if p, err := hp.Port(); err == nil && p == port && on {
+					e.Funnel = append(e.Funnel, string(hp))
+				}
+			}
+		}
+		for hp, web := range sc.Web {
+			if web == nil {
+				continue
+			}
+			for _, h := range web.Handlers {
+				if h != nil && backendIsProxy(h.Proxy, proxyPorts) {
+					e.Served = append(e.Served, string(hp))
+					if sc.AllowFunnel[hp] {
+						e.Funnel = append(e.Funnel, string(hp))
+					}
+					break
+				}
+			}
+		}
+		for _, fg := range sc.Foreground {
+			walk(fg)
+		}
+	}
+	walk(sc)
+	slices.Sort(e.Served)
+	e.Served = slices.Compact(e.Served)
+	slices.Sort(e.Funnel)
+	e.Funnel = slices.Compact(e.Funnel)
+	return e
+}
+
+// backendIsProxy reports whether a Serve backend, in any of the forms
+// Serve accepts ("127.0.0.1:1080", "localhost:1080", "1080",
+// "http://127.0.0.1:1080/"), has one of proxyPorts.
+func backendIsProxy(backend string, proxyPorts []int) bool {
+	if backend == "" {
+		return false
+	}
+	if u, err := url.Parse(backend); err == nil && u.Host != "" {
+		backend = u.Host
+		if u.Port() == "" {
+			return false
+		}
+	}
+	portStr := backend
+	if _, p, err := net.SplitHostPort(backend); err == nil {
+		portStr = p
+	}
+	port, err := strconv.Atoi(portStr)
+	return err == nil && slices.Contains(proxyPorts, port)
+}
+
+// listenerPorts returns the ports of the proxy listeners, for
+// proxyExposure.
+func listenerPorts(lns []net.Listener) []int {
+	var ports []int
+	for _, l := range lns {
+		if _, p, err := net.SplitHostPort(l.Addr().String()); err == nil {
+			if port, err := strconv.Atoi(p); err == nil && port > 0 {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+// watchServeExposure checks the node's Serve config now and every
+// serveCheckInterval until ctx is done, logging whenever the proxy's
+// exposure changes: an error while Funnel opens the proxy to the
+// internet, a warning while Serve alone exposes it to the tailnet.
+func watchServeExposure(ctx context.Context, getServeConfig func(context.Context) (*ipn.ServeConfig, error), proxyPorts []int, logger *slog.Logger) {
+	ticker := time.NewTicker(serveCheckInterval)
+	defer ticker.Stop()
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, serveCheckInterval)
+		sc, err := getServeConfig(callCtx)
+		cancel()
+		switch {
+		case err != nil && ctx.Err() == nil:
+			logger.Debug("failed to read serve config", "error", err)
+		case err == nil:
+			e := proxyExposure(sc, proxyPorts)
+			if prev := currentExposure.Swap(e); prev == nil || !prev.equal(e) {
+				logExposure(e, prev, logger)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func logExposure(e, prev *serveExposure, logger *slog.Logger) {
+	switch {
+	case len(e.Funnel) > 0:
+		logger.Error("PROXY IS EXPOSED TO THE PUBLIC INTERNET via Tailscale Funnel: anyone can use it as an open proxy; turn Funnel off for these endpoints", "funnel", e.Funnel, "served", e.Served)
+	case len(e.Served) > 0:
+		logger.Warn("proxy is also exposed via Tailscale Serve", "served", e.Served)
+	case prev != nil:
+		logger.Info("proxy is no longer exposed via Tailscale Serve or Funnel")
+	default:
+		logger.Info("proxy is not exposed via Tailscale Serve or Funnel")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestBackendIsProxy(t *testing.T) {
+	t.Parallel()
+
+	ports := []int{1080, 8080}
+	for _, tc := range []struct {
+		backend string
+		want    bool
+	}{
+		{"127.0.0.1:1080", true},
+		{"localhost:8080", true},
+		{"1080", true},
+		{"http://127.0.0.1:1080/", true},
+		{"https+insecure://localhost:8080", true},
+		{"127.0.0.1:3000", false},
+		{"http://localhost/", false},
+		{"3000", false},
+		{"", false},
+	} {
+		if got := backendIsProxy(tc.backend, ports); got != tc.want {
+			t.Errorf("backendIsProxy(%q) = %v, want %v", tc.backend, got, tc.want)
+		}
+	}
+}
+
+func TestProxyExposure(t *testing.T) {
+	t.Parallel()
+
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {TCPForward: "127.0.0.1:1080"},
+			9000: {TCPForward: "127.0.0.1:9000"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"node.example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Proxy: "http://127.0.0.1:3000"},
+				"/proxy": {Proxy: "http://127.0.0.1:1080"},
+			}},
+		},
+		AllowFunnel: map[ipn.HostPort]bool{
+			"node.example.ts.net:8443": true,
+			"node.example.ts.net:9000": true,
+		},
+		Foreground: map[string]*ipn.ServeConfig{
+			"session": {
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"node.example.ts.net:10000": {Handlers: map[string]*ipn.HTTPHandler{"/": {Proxy: "1080"}}},
+				},
+				AllowFunnel: map[ipn.HostPort]bool{"node.example.ts.net:10000": true},
+			},
+		},
+	}
+	e := proxyExposure(sc, []int{1080})
+	wantServed := []string{":8443", "node.example.ts.net:10000", "node.example.ts.net:443"}
+	wantFunnel := []string{"node.example.ts.net:10000", "node.example.ts.net:8443"}
+	if !slices.Equal(e.Served, wantServed) || !slices.Equal(e.Funnel, wantFunnel) {
+		t.Fatalf("proxyExposure = served %q funnel %q, want served %q funnel %q", e.Served, e.Funnel, wantServed, wantFunnel)
+	}
+
+	if e := proxyExposure(nil, []int{1080}); len(e.Served) != 0 || len(e.Funnel) != 0 {
+		t.Fatalf("proxyExposure(nil) = %+v, want nothing exposed", e)
+	}
+}
+
+func TestWatchServeExposure(t *testing.T) {
+	// Not parallel: sets the package-level currentExposure.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer currentExposure.Store(nil)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	get := func(context.Context) (*ipn.ServeConfig, error) {
+		cancel() // stop after this check
+		return &ipn.ServeConfig{
+			TCP:         map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:1080"}},
+			AllowFunnel: map[ipn.HostPort]bool{"node.example.ts.net:443": true},
+		}, nil
+	}
+	watchServeExposure(ctx, get, []int{1080}, logger)
+
+	if !strings.Contains(buf.String(), "level=ERROR") || !strings.Contains(buf.String(), "PUBLIC INTERNET") {
+		t.Fatalf("log = %q, want an error about Funnel exposure", buf.String())
+	}
+	if e := currentExposure.Load(); e == nil || !slices.Equal(e.Funnel, []string{"node.example.ts.net:443"}) {
+		t.Fatalf("currentExposure = %+v, want the funneled endpoint", e)
+	}
+
+	// A failed read keeps the last exposure rather than clearing it.
+	ctx, cancel = context.WithCancel(context.Background())
+	watchServeExposure(ctx, func(context.Context) (*ipn.ServeConfig, error) {
+		cancel()
+		return nil, errors.New("local API down")
+	}, []int{1080}, logger)
+	if e := currentExposure.Load(); e == nil || len(e.Funnel) != 1 {
+		t.Fatalf("currentExposure after a failed read = %+v, want it kept", e)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// grantCapability, when set, is the app capability a peer must be granted
+// in the tailnet policy file to use the proxy, and the grant's values scope
+// which targets it may reach.
+var grantCapability tailcfg.PeerCapability
+
+// whoIsCaps returns the capabilities the tailnet grants the peer at
+// remoteAddr. main sets it from the tsnet LocalClient when grantCapability
+// is set.
+var whoIsCaps func(ctx context.Context, remoteAddr string) (tailcfg.PeerCapMap, error)
+
+var errNoGrant = errors.New("no grant for target")
+
+// proxyGrant is one value of grantCapability, for example
+//
+//	"app": {"example.com/cap/tailgate": [{"hosts": ["*.example.com"], "ports": [443]}]}
+//
+// Empty Hosts or Ports allow any. A host is an exact name or IP, "*" for
+// any host, "*.suffix" for names under suffix, or a CIDR matching IP
+// literal targets. Names are matched as the client sent them, before
+// resolution.
+type proxyGrant struct {
+	Hosts []string `json:"hosts"`
+	Ports []uint16 `json:"ports"`
+}
+
+func (g proxyGrant) allows(host string, port uint16) bool {
+	if len(g.Ports) > 0 && !slices.Contains(g.Ports, port) {
+		return false
+	}
+	if len(g.Hosts) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(g.Hosts, func(pattern string) bool {
+		return hostPatternMatches(pattern, host)
+	})
+}
+
+// hostPatternMatches reports whether host matches a grant host pattern: an
+// exact name or IP, "*", "*.suffix", or a CIDR, which only matches IP
+// literals.
+func hostPatternMatches(pattern, host string) bool {
+	host = hostKey(host)
+	switch {
+	case pattern == "*":
+		return true
+	case strings.Contains(pattern, "/"):
+		p, err := netip.ParsePrefix(pattern)
+		ip, ipErr := netip.ParseAddr(host)
+		return err == nil && ipErr == nil && p.Contains(ip.Unmap())
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, hostKey(pattern[1:]))
+	default:
+		return hostKey(pattern) == host
+	}
+}
+
+// checkGrant reports whether the peer at remote holds a grantCapability
+// value allowing targetAddr. It always passes when grantCapability is
+// unset, and fails for peers without a tailnet identity, such as
+// -local-listen clients. Callers pass whoIsAddr of the client conn.
+func checkGrant(ctx context.Context, remote, targetAddr string) error {
+	if grantCapability == "" {
+		return nil
+	}
+	if whoIsCaps == nil {
+		return fmt.Errorf("%w: peer identity unavailable", errNoGrant)
+	}
+	ctx, cancel := context.WithTimeout(ctx, whoIsTimeout)
+	defer cancel()
+	caps, err := whoIsCaps(ctx, remote)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNoGrant, err)
+	}
+	grants, err := tailcfg.UnmarshalCapJSON[proxyGrant](caps, grantCapability)
+	if err != nil {
+		return fmt.Errorf("%w: invalid %s value: %v", errNoGrant, grantCapability, err)
+	}
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	for _, g := range grants {
+		if g.allows(host, uint16(port)) {
+			return nil
+		}
+	}
+	return errNoGrant
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestProxyGrantAllows(t *testing.T) {
+	t.Parallel()
+
+	g := proxyGrant{Hosts: []string{"*.Example.com", "db.internal.", "10.0.0.0/8", "2001:db8::1"}, Ports: []uint16{443, 5432}}
+	for _, tc := range []struct {
+		host string
+		port uint16
+		want bool
+	}{
+		{"api.example.com", 443, true},
+		{"API.EXAMPLE.COM.", 443, true},
+		{"example.com", 443, false}, // the apex isn't under *.example.com
+		{"badexample.com", 443, false},
+		{"db.internal", 5432, true},
+		{"10.1.2.3", 443, true},
+		{"11.1.2.3", 443, false},
+		{"2001:db8::1", 443, true},
+		{"api.example.com", 80, false},
+	} {
+		if got := g.allows(tc.host, tc.port); got != tc.want {
+			t.Errorf("allows(%q, %d) = %v, want %v", tc.host, tc.port, got, tc.want)
+		}
+	}
+	if !(proxyGrant{}).allows("anything.example", 1) {
+		t.Error("an empty grant should allow any target")
+	}
+	if !(proxyGrant{Hosts: []string{"*"}, Ports: []uint16{22}}).allows("host", 22) {
+		t.Error(`"*" should allow any host`)
+	}
+}
+
+// grantCaps makes checkGrant require cap and treat every peer as holding
+// caps for the duration of the test.
+func grantCaps(t *testing.T, caps tailcfg.PeerCapMap, err error) {
+	t.Helper()
+	origCap, origWhoIs := grantCapability, whoIsCaps
+	grantCapability = "example.com/cap/tailgate"
+	whoIsCaps = func(context.Context, string) (tailcfg.PeerCapMap, error) { return caps, err }
+	t.Cleanup(func() { grantCapability, whoIsCaps = origCap, origWhoIs })
+}
+
+func TestCheckGrant(t *testing.T) {
+	// Not parallel: mutates the package-level grantCapability and
+	// whoIsCaps.
+	const peer = "100.64.0.1:40000"
+
+	if err := checkGrant(context.Background(), peer, "example.com:443"); err != nil {
+		t.Fatalf("checkGrant without -grant-cap = %v, want nil", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		caps    tailcfg.PeerCapMap
+		lookup  error
+		allowed bool
+	}{
+		{"granted", tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"hosts":["example.com"],"ports":[443]}`}}, nil, true},
+		{"second_value", tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"ports":[22]}`, `{"hosts":["*.com"]}`}}, nil, true},
+		{"other_target", tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"hosts":["other.example"]}`}}, nil, false},
+		{"no_capability", tailcfg.PeerCapMap{"example.com/cap/other": {`{}`}}, nil, false},
+		{"malformed", tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"ports":"443"}`}}, nil, false},
+		{"no_identity", nil, errors.New("no match for IP:port"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			grantCaps(t, tc.caps, tc.lookup)
+			err := checkGrant(context.Background(), peer, "example.com:443")
+			if tc.allowed && err != nil {
+				t.Fatalf("checkGrant = %v, want allowed", err)
+			}
+			if !tc.allowed && !errors.Is(err, errNoGrant) {
+				t.Fatalf("checkGrant = %v, want errNoGrant", err)
+			}
+		})
+	}
+}
+
+func TestHandleHTTPConnectWithoutGrant(t *testing.T) {
+	// Not parallel: mutates the package-level grantCapability and
+	// whoIsCaps.
+	grantCaps(t, tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"ports":[22]}`}}, nil)
+
+	status, _ := executeProxyRequest(t, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if !strings.Contains(status, "403") {
+		t.Fatalf("status = %q, want 403", status)
+	}
+}
+
+func TestCheckGrantIgnoresProxyHeaderAddress(t *testing.T) {
+	// Not parallel: mutates the package-level grantCapability and
+	// whoIsCaps.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	grantCaps(t, nil, nil)
+	var lookedUp []string
+	var mu sync.Mutex
+	whoIsCaps = func(_ context.Context, remote string) (tailcfg.PeerCapMap, error) {
+		mu.Lock()
+		lookedUp = append(lookedUp, remote)
+		mu.Unlock()
+		// Only the tailnet node the PROXY header names holds a grant.
+		if strings.HasPrefix(remote, "100.64.0.5:") {
+			return tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{}`}}, nil
+		}
+		return nil, errors.New("no match for IP:port")
+	}
+
+	req := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n"
+	resp, _ := runProxiedConn(t, "127.0.0.0/8", "PROXY TCP4 100.64.0.5 192.0.2.1 51000 1080\r\n"+req)
+	if !strings.HasPrefix(resp, "HTTP/1.1 403") {
+		t.Fatalf("CONNECT forwarded from a tailnet address = %q, want 403", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lookedUp) != 1 || !strings.HasPrefix(lookedUp[0], "127.0.0.1:") {
+		t.Fatalf("WhoIs looked up %v, want only the socket peer", lookedUp)
+	}
+}
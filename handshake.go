@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// handshakeTimeout bounds the time from accept until a tunnel starts
+// relaying: protocol peek, request parsing, and the target dial together.
+// Zero, the default, leaves only the per-step timeouts.
+var handshakeTimeout time.Duration
+
+// handshake tracks the overall handshake deadline for one connection. When
+// the deadline passes before done is called, the client connection is
+// closed and ctx is canceled, aborting any in-flight dial.
+type handshake struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   func() bool
+}
+
+// newHandshake arms the handshake deadline for conn. A timeout <= 0 disables
+// it. ctx is canceled along with parent. Callers must call release when the
+// connection is finished.
+func newHandshake(parent context.Context, conn net.Conn, timeout time.Duration) *handshake {
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(parent)
+		return &handshake{ctx: ctx, cancel: cancel, stop: func() bool { return true }}
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	stop := context.AfterFunc(ctx, func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			_ = conn.Close()
+		}
+	})
+	return &handshake{ctx: ctx, cancel: cancel, stop: stop}
+}
+
+// done disarms the deadline once the tunnel is established. It reports
+// false if the deadline already fired.
+func (h *handshake) done() bool {
+	return h.stop()
+}
+
+// expired reports whether the handshake deadline has passed.
+func (h *handshake) expired() bool {
+	return h.ctx.Err() == context.DeadlineExceeded
+}
+
+func (h *handshake) release() {
+	h.stop()
+	h.cancel()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleConnHandshakeTimeout(t *testing.T) {
+	// Not parallel: mutates the package-level handshakeTimeout.
+
+	origTimeout := handshakeTimeout
+	handshakeTimeout = 100 * time.Millisecond
+	defer func() { handshakeTimeout = origTimeout }()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		handleConn(context.Background(), serverConn, listenerOptions{}, logger)
+	}()
+
+	// Trickle a request in slowly enough that no single read deadline
+	// fires, but the overall handshake deadline does.
+	go func() {
+		for _, b := range []byte("CONNECT example.com:443 HTTP/1.1\r\n") {
+			if _, err := clientConn.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not exit after handshake timeout")
+	}
+}
+
+func TestHandshakeDoneDisarms(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+
+	hs := newHandshake(context.Background(), serverConn, 50*time.Millisecond)
+	defer hs.release()
+	if !hs.done() {
+		t.Fatal("expected done before the deadline to succeed")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The conn must still be usable after the deadline would have fired.
+	go func() { _, _ = clientConn.Write([]byte{'x'}) }()
+	_ = serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := serverConn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after disarmed handshake failed: %v", err)
+	}
+}
+
+func TestHandshakeOffByDefault(t *testing.T) {
+	t.Parallel()
+
+	if handshakeTimeout != 0 {
+		t.Fatalf("handshakeTimeout = %v by default, want 0", handshakeTimeout)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+
+	hs := newHandshake(context.Background(), serverConn, handshakeTimeout)
+	defer hs.release()
+	time.Sleep(50 * time.Millisecond)
+	if hs.expired() {
+		t.Fatal("handshake expired with the default timeout")
+	}
+	if !hs.done() {
+		t.Fatal("expected done to succeed with the default timeout")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// healthCheckFrom lists the sources of L4 health checks. Their connections
+// skip protocol detection, which would otherwise wait for a first byte
+// they never send, and are answered with healthCheckBanner and closed.
+var healthCheckFrom []netip.Prefix
+
+// healthCheckBanner is the line written to health checks before closing
+// them; empty closes them as soon as they are accepted.
+var healthCheckBanner string
+
+// isHealthCheck reports whether conn comes directly from a healthCheckFrom
+// source. A PROXY header is never consulted: the checker is the peer
+// itself.
+func isHealthCheck(conn net.Conn) bool {
+	if len(healthCheckFrom) == 0 {
+		return false
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	return ok && prefixesContain(healthCheckFrom, ip)
+}
+
+// answerHealthCheck writes healthCheckBanner, if any, as a CRLF-terminated
+// line. The caller closes conn.
+func answerHealthCheck(conn net.Conn) {
+	healthChecks.Add(1)
+	if healthCheckBanner == "" {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	_, _ = conn.Write([]byte(healthCheckBanner + "\r\n"))
+}
+
+// healthRequests holds the "METHOD target" requests, such as "GET /healthz"
+// or "OPTIONS *", that HTTP health checkers may send to the proxy port
+// itself, answered like admin /healthz instead of 405 or 400.
+var healthRequests = make(map[string]bool)
+
+// addHealthRequest parses a -health-path value into requests: a "/path"
+// (GET and HEAD), "METHOD /path", or "OPTIONS *".
+func addHealthRequest(requests map[string]bool, s string) error {
+	fields := strings.Fields(s)
+	var method, target string
+	switch len(fields) {
+	case 1:
+		method, target = http.MethodGet, fields[0]
+	case 2:
+		method, target = strings.ToUpper(fields[0]), fields[1]
+	default:
+		return fmt.Errorf("invalid health path %q: want /path, \"METHOD /path\", or \"OPTIONS *\"", s)
+	}
+	switch {
+	case method == http.MethodConnect:
+		return fmt.Errorf("invalid health path %q: CONNECT is always a tunnel request", s)
+	case target == "*" && method != http.MethodOptions:
+		return fmt.Errorf("invalid health path %q: only OPTIONS takes *", s)
+	case target != "*" && !strings.HasPrefix(target, "/"):
+		return fmt.Errorf("invalid health path %q: path must start with /", s)
+	}
+	requests[method+" "+target] = true
+	if method == http.MethodGet {
+		requests[http.MethodHead+" "+target] = true
+	}
+	return nil
+}
+
+// isHealthRequest reports whether req, read on a proxy port, is one of
+// healthRequests. Paths match exactly, ignoring any query; absolute-form
+// requests never match.
+func isHealthRequest(req *http.Request) bool {
+	if len(healthRequests) == 0 {
+		return false
+	}
+	if req.RequestURI == "*" {
+		return healthRequests[req.Method+" *"]
+	}
+	return isOriginFormRequest(req) && healthRequests[req.Method+" "+req.URL.Path]
+}
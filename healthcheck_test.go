@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleConnAnswersHealthCheck(t *testing.T) {
+	// Not parallel: mutates the package-level healthCheckFrom and
+	// healthCheckBanner.
+	origFrom, origBanner := healthCheckFrom, healthCheckBanner
+	defer func() { healthCheckFrom, healthCheckBanner = origFrom, origBanner }()
+	healthCheckFrom = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+
+	for _, tc := range []struct {
+		banner string
+		want   string
+	}{
+		{banner: "tailgate ok", want: "tailgate ok\r\n"},
+		{banner: "", want: ""},
+	} {
+		healthCheckBanner = tc.banner
+		clientConn, serverConn := net.Pipe()
+		checker := remoteAddrConn{Conn: serverConn, remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleConn(context.Background(), checker, listenerOptions{}, slog.New(slog.DiscardHandler))
+		}()
+
+		// The checker sends nothing and still gets its answer at once.
+		_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		got, err := io.ReadAll(clientConn)
+		_ = clientConn.Close()
+		if err != nil || string(got) != tc.want {
+			t.Fatalf("banner %q: read %q, %v, want %q then EOF", tc.banner, got, err, tc.want)
+		}
+		<-done
+	}
+}
+
+func TestIsHealthCheck(t *testing.T) {
+	// Not parallel: mutates the package-level healthCheckFrom.
+	orig := healthCheckFrom
+	defer func() { healthCheckFrom = orig }()
+
+	checker := remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 1}}
+	if isHealthCheck(checker) {
+		t.Fatal("isHealthCheck = true with no -health-check-from")
+	}
+	healthCheckFrom = []netip.Prefix{netip.MustParsePrefix("10.0.0.5/32")}
+	if !isHealthCheck(checker) {
+		t.Fatal("isHealthCheck = false for a listed source")
+	}
+	if isHealthCheck(remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.6"), Port: 1}}) {
+		t.Fatal("isHealthCheck = true for an unlisted source")
+	}
+	if isHealthCheck(remoteAddrConn{remote: pipeAddr{}}) {
+		t.Fatal("isHealthCheck = true for an address without an IP")
+	}
+}
+
+func TestAddHealthRequest(t *testing.T) {
+	t.Parallel()
+
+	requests := make(map[string]bool)
+	for _, s := range []string{"/healthz", "options *", "POST /probe"} {
+		if err := addHealthRequest(requests, s); err != nil {
+			t.Fatalf("addHealthRequest(%q): %v", s, err)
+		}
+	}
+	want := []string{"GET /healthz", "HEAD /healthz", "OPTIONS *", "POST /probe"}
+	if got := slices.Sorted(maps.Keys(requests)); !slices.Equal(got, want) {
+		t.Fatalf("requests = %q, want %q", got, want)
+	}
+	for _, bad := range []string{"", "healthz", "GET *", "CONNECT /healthz", "GET /a /b"} {
+		if err := addHealthRequest(requests, bad); err == nil {
+			t.Errorf("addHealthRequest(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestHandleHTTPConnectHealthPath(t *testing.T) {
+	// Not parallel: mutates the package-level healthRequests.
+	orig := healthRequests
+	defer func() { healthRequests = orig }()
+
+	healthRequests = make(map[string]bool)
+	if status, _ := executeProxyRequest(t, "OPTIONS * HTTP/1.1\r\nHost: proxy\r\n\r\n"); !strings.HasPrefix(status, "405") {
+		t.Fatalf("OPTIONS * without -health-path = %q, want the default 405", status)
+	}
+
+	for _, s := range []string{"/healthz", "OPTIONS *"} {
+		if err := addHealthRequest(healthRequests, s); err != nil {
+			t.Fatalf("addHealthRequest(%q): %v", s, err)
+		}
+	}
+	for _, tc := range []struct {
+		request string
+		want    string
+	}{
+		{"OPTIONS * HTTP/1.1\r\nHost: proxy\r\n\r\n", "200"},
+		{"GET /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n", "200"},
+		{"GET /healthz?probe=1 HTTP/1.1\r\nHost: proxy\r\n\r\n", "200"},
+		{"HEAD /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n", "200"},
+		{"GET /healthz/ HTTP/1.1\r\nHost: proxy\r\n\r\n", "400"},
+		{"GET http://proxy/healthz HTTP/1.1\r\nHost: proxy\r\n\r\n", "405"},
+		{"OPTIONS /healthz HTTP/1.1\r\nHost: proxy\r\n\r\n", "400"},
+	} {
+		if status, _ := executeProxyRequest(t, tc.request); !strings.HasPrefix(status, tc.want) {
+			t.Errorf("%q = %q, want %s", strings.Fields(tc.request)[:2], status, tc.want)
+		}
+	}
+}
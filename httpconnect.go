@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/textproto"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,69 +22,408 @@ const (
 	connectReadTimeout     = 15 * time.Second
 	connectDialTimeout     = 10 * time.Second
 	maxConnectRequestBytes = 8192 // 8KB; generous for CONNECT host:port + headers
+	dialRetryAfterSeconds  = 5
 )
 
+// maxHeaderCount bounds the header lines other than Host in a request on
+// the proxy port, which for CONNECT are few; more get 431. 0 means no limit beyond
+// maxConnectRequestBytes.
+var maxHeaderCount = 32
+
+// responseWriteTimeout bounds writing a response to the client, so a client
+// that stops reading can't hold a handler.
+var responseWriteTimeout = 5 * time.Second
+
 // tunnelIdleTimeout is the duration with no data in either direction before
 // a tunnel is torn down. It is a var so tests can override it.
 var tunnelIdleTimeout = 5 * time.Minute
 
-func handleHTTPConnect(conn net.Conn, br *bufio.Reader, logger *slog.Logger) {
+// tunnelWriteTimeout, when positive, is how long a single relay write may
+// go without the peer accepting a byte before the tunnel fails with
+// errWriteStalled, even while the other direction keeps it from going
+// idle.
+var tunnelWriteTimeout time.Duration
+
+// errWriteStalled ends a tunnel whose peer stopped reading for
+// tunnelWriteTimeout.
+var errWriteStalled = errors.New("write stalled")
+
+// connectResponseHeader holds extra headers (e.g. Proxy-Agent) sent with
+// the 200 reply to CONNECT. It is empty by default.
+var connectResponseHeader = make(http.Header)
+
+func handleHTTPConnect(ctx context.Context, hs *handshake, conn net.Conn, br *bufio.Reader, opts listenerOptions, logger *slog.Logger) {
 	_ = conn.SetReadDeadline(time.Now().Add(connectReadTimeout))
 	lr := &io.LimitedReader{R: br, N: maxConnectRequestBytes}
-	req, err := http.ReadRequest(bufio.NewReader(lr))
+	var src io.Reader = lr
+	var raw bytes.Buffer
+	if strictHost {
+		// http.ReadRequest drops the Host header when the request line has
+		// an authority, so keep the raw bytes to compare them.
+		src = io.TeeReader(lr, &raw)
+	}
+	reqReader := bufio.NewReader(src)
+	req, err := http.ReadRequest(reqReader)
 	_ = conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		status := classifyReadRequestError(lr, err)
 		if status == http.StatusRequestHeaderFieldsTooLarge {
-			writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge, "request too large\n")
+			writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge, "request too large\n", nil)
 		} else {
-			writeHTTPError(conn, http.StatusBadRequest, "malformed request\n")
+			writeHTTPError(conn, http.StatusBadRequest, "malformed request\n", nil)
 		}
+		countError(errorKindForStatus(status))
 		logger.Debug("failed to read http request", "remote", remoteAddr(conn), "error", err)
 		return
 	}
 	defer req.Body.Close() //nolint:errcheck // best-effort cleanup
+	if n := headerLineCount(req); maxHeaderCount > 0 && n > maxHeaderCount {
+		countError("too_many_headers")
+		logger.Debug("too many request headers", "remote", remoteAddr(conn), "headers", n, "max", maxHeaderCount)
+		writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge, "too many headers\n", nil)
+		return
+	}
+
+	client := effectiveClient(conn, req.Header)
+	if client != remoteAddr(conn) {
+		logger.Debug("using forwarded client address", "remote", remoteAddr(conn), "client", client)
+	}
+
+	// A CONNECT consumes the connection, so any further request already
+	// pipelined behind it is a protocol error rather than tunnel payload.
+	// Anything else read past the request (typically a TLS ClientHello from
+	// a client that didn't wait for the 200) is forwarded to the target.
+	pending, _ := reqReader.Peek(reqReader.Buffered())
+	if looksLikeHTTPRequestLine(pending) {
+		countError("pipelined_request")
+		logger.Debug("pipelined request after CONNECT", "remote", client)
+		writeHTTPError(conn, http.StatusBadRequest, "pipelined requests not supported\n", nil)
+		return
+	}
 
 	if req.Method != http.MethodConnect {
-		writeHTTPError(conn, http.StatusMethodNotAllowed, "CONNECT required\n")
+		if isHealthRequest(req) {
+			healthChecks.Add(1)
+			serveInlineAdmin(conn, req, http.HandlerFunc(serveHealthz))
+			return
+		}
+		if opts.admin != nil && isInlineAdminRequest(req) {
+			logger.Debug("serving admin request on proxy port", "remote", client, "path", req.URL.Path)
+			serveInlineAdmin(conn, req, opts.admin)
+			return
+		}
+		if connectUDP && isConnectUDPRequest(req) {
+			handleConnectUDP(ctx, hs, conn, req, pending, client, logger)
+			return
+		}
+		if isOriginFormRequest(req) {
+			countError("origin_form_request")
+			logger.Debug("origin-form request to proxy port", "remote", client, "method", req.Method, "path", req.URL.Path)
+			writeHTTPError(conn, http.StatusBadRequest, notAWebServerBody, nil)
+			return
+		}
+		countError("method_not_allowed")
+		writeHTTPError(conn, http.StatusMethodNotAllowed, "CONNECT required\n", nil)
 		return
 	}
 
-	targetAddr, err := connectTarget(req.Host)
+	if strictHost && req.URL.Host != "" {
+		if hostHeader := rawHostHeader(raw.Bytes()); hostMismatch(req.URL.Host, hostHeader) {
+			countError("host_mismatch")
+			logger.Warn("CONNECT Host header does not match request target", "remote", client, "target", req.URL.Host, "host", hostHeader)
+			writeHTTPError(conn, http.StatusBadRequest, "Host header does not match CONNECT target\n", nil)
+			return
+		}
+	}
+
+	host := connectHost(req)
+	targetAddr, err := connectTarget(host)
 	if err != nil {
-		logger.Debug("invalid connect target", "remote", remoteAddr(conn), "host", req.Host, "error", err)
-		writeHTTPError(conn, http.StatusBadRequest, "invalid CONNECT host\n")
+		countError("invalid_target")
+		logger.Debug("invalid connect target", "remote", client, "host", host, "error", err)
+		writeHTTPError(conn, http.StatusBadRequest, "invalid CONNECT host\n", nil)
+		return
+	}
+	if !targetPortAllowed(targetAddr) {
+		countError("port_denied")
+		logger.Debug("destination port not allowed", "remote", client, "target", targetAddr, "protocol", "http")
+		writeHTTPError(conn, http.StatusForbidden, "destination port not allowed\n", nil)
 		return
 	}
+	if err := checkGrant(hs.ctx, whoIsAddr(conn), targetAddr); err != nil {
+		countError("no_grant")
+		logger.Debug("peer not granted access to target", "remote", client, "target", targetAddr, "protocol", "http", "error", err)
+		writeHTTPError(conn, http.StatusForbidden, "not granted access to this destination\n", nil)
+		return
+	}
+
+	releaseUser, user, ok := acquireUserSlot(hs.ctx, conn, logger)
+	if !ok {
+		countError("user_limit")
+		logger.Debug("per-user connection limit reached", "remote", client, "user", user, "protocol", "http")
+		writeHTTPError(conn, http.StatusForbidden, "too many tunnels for this user\n", nil)
+		return
+	}
+	defer releaseUser()
+	ctx = withTunnelUser(ctx, user)
+
+	targetHost, _, _ := net.SplitHostPort(targetAddr)
+	release, ok := perHostLimiter.acquire(hostKey(targetHost))
+	if !ok {
+		countError("host_limit")
+		logger.Debug("per-host connection limit reached", "remote", client, "host", targetHost, "protocol", "http")
+		writeHTTPError(conn, http.StatusServiceUnavailable, "too many connections to target\n", retryAfterHeader(dialRetryAfterSeconds))
+		return
+	}
+	defer release()
+
+	dialCtx := hs.ctx
+	if len(egressProfiles) > 0 {
+		profile := req.Header.Get(egressHeader)
+		src, ok := selectEgress(profile, targetHost)
+		if !ok {
+			countError("unknown_egress")
+			logger.Debug("unknown egress profile", "remote", client, "profile", profile)
+			writeHTTPError(conn, http.StatusBadRequest, "unknown egress profile\n", nil)
+			return
+		}
+		if src.IsValid() {
+			dialCtx = withEgressSource(hs.ctx, src)
+		}
+	}
 
-	target, err := net.DialTimeout("tcp", targetAddr, connectDialTimeout)
+	if raw := req.Header.Get(labelHeader); raw != "" {
+		if label, ok := tunnelLabel(raw); ok {
+			ctx = withTunnelLabel(ctx, label)
+			if allowedLabels != nil {
+				tunnelsByLabel.Add(label, 1)
+			}
+		} else {
+			countError("invalid_label")
+			logger.Debug("ignoring invalid tunnel label", "remote", client, "target", targetAddr, "label_len", len(raw))
+		}
+	}
+
+	target, err := dialTarget(dialCtx, targetAddr)
 	if err != nil {
+		if hs.expired() {
+			countError("handshake_timeout")
+			logger.Debug("handshake timeout", "remote", client, "target", targetAddr, "timeout", handshakeTimeout)
+			return
+		}
+		if ctx.Err() != nil {
+			// conn is already closed, so there is no one to reply to.
+			countError("shutdown")
+			logger.Debug("dial canceled by shutdown", "remote", client, "target", targetAddr)
+			return
+		}
+		if errors.Is(err, errSelfTarget) {
+			countError("self_target")
+			logger.Warn("refusing tunnel to tailgate's own admin endpoint", "remote", client, "target", targetAddr)
+			writeHTTPError(conn, http.StatusForbidden, "target is a tailgate admin endpoint\n", nil)
+			return
+		}
+		if errors.Is(err, errPrivateTarget) {
+			countError("private_target")
+			logger.Debug("private destination not allowed", "remote", client, "target", targetAddr)
+			writeHTTPError(conn, http.StatusForbidden, "private destination not allowed\n", nil)
+			return
+		}
+		if errors.Is(err, errDialBusy) {
+			countError("dial_busy")
+			logger.Warn("concurrent dial limit reached", "remote", client, "target", targetAddr)
+			writeHTTPError(conn, http.StatusServiceUnavailable, "too many dials in progress\n", retryAfterHeader(dialRetryAfterSeconds))
+			return
+		}
+		if errors.Is(err, errDNSBusy) {
+			countError("dns_busy")
+			logger.Warn("DNS lookup limit reached", "remote", client, "target", targetAddr)
+			writeHTTPError(conn, http.StatusServiceUnavailable, "resolver busy\n", retryAfterHeader(dialRetryAfterSeconds))
+			return
+		}
+		if errors.Is(err, errResolveTimeout) {
+			countError("dns_timeout")
+			logger.Warn("DNS lookup timed out", "remote", client, "target", targetAddr, "timeout", resolverTimeout)
+			writeHTTPError(conn, http.StatusGatewayTimeout, "DNS lookup timed out\n", nil)
+			return
+		}
+		if isFDExhausted(err) {
+			countError("fd_exhausted")
+			writeHTTPError(conn, http.StatusServiceUnavailable, "proxy out of file descriptors\n", retryAfterHeader(dialRetryAfterSeconds))
+			return
+		}
+		countError("dial_failed")
 		logger.Debug("failed to dial target", "target", targetAddr, "error", err)
-		writeHTTPError(conn, http.StatusBadGateway, "dial failed\n")
+		writeHTTPError(conn, http.StatusBadGateway, "dial failed\n", dialFailureHeader(err))
 		return
 	}
+	if tlsProbeRequired(targetAddr) {
+		if err := probeTargetTLS(dialCtx, target, targetAddr); err != nil {
+			countError("tls_probe_failed")
+			logger.Debug("target failed TLS probe", "remote", client, "target", targetAddr, "error", err)
+			writeHTTPError(conn, http.StatusBadGateway, "target TLS handshake failed\n", nil)
+			return
+		}
+		// The probe used up its connection, so the tunnel gets a fresh one.
+		if target, err = dialTarget(dialCtx, targetAddr); err != nil {
+			countError("dial_failed")
+			logger.Debug("failed to redial target after TLS probe", "target", targetAddr, "error", err)
+			writeHTTPError(conn, http.StatusBadGateway, "dial failed\n", dialFailureHeader(err))
+			return
+		}
+	}
 	defer target.Close() //nolint:errcheck // best-effort cleanup
 
-	_, _ = fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	var early []byte
+	if targetCloseProbe > 0 {
+		if early, err = probeTarget(target, targetCloseProbe); err != nil {
+			countError("target_closed")
+			logger.Debug("target closed during probe", "remote", client, "target", targetAddr, "error", err)
+			writeHTTPError(conn, http.StatusBadGateway, "target closed connection\n", nil)
+			return
+		}
+	}
+
+	if !hs.done() {
+		countError("handshake_timeout")
+		logger.Debug("handshake timeout", "remote", client, "target", targetAddr, "timeout", handshakeTimeout)
+		return
+	}
+
+	if err := writeConnectEstablished(conn, connectResponseHeader); err != nil {
+		countError("client_write")
+		logger.Debug("failed to write CONNECT response", "remote", client, "target", targetAddr, "error", err)
+		return
+	}
+	established := time.Now()
+	if tlsRequired(targetAddr) {
+		if pending, err = firstClientBytes(conn, pending, tlsFirstByteTimeout); err != nil || pending[0] != tlsRecordTypeHandshake {
+			countError("tls_required")
+			logTunnelClosed(ctx, logger, "http", client, targetAddr, target, closePolicyClosed, sideProxy, established, 0, 0)
+			logger.Warn("policy violation: closing non-TLS tunnel to TLS-only port", "remote", client, "target", targetAddr, "error", err)
+			return
+		}
+	}
+	if proto := requiredProtocol(targetAddr); proto != "" {
+		if pending, err = checkClientProtocol(conn, pending, proto, tlsFirstByteTimeout); err != nil {
+			countError("protocol_mismatch")
+			logTunnelClosed(ctx, logger, "http", client, targetAddr, target, closePolicyClosed, sideProxy, established, 0, 0)
+			logger.Warn("policy violation: closing tunnel that doesn't carry the port's required protocol", "remote", client, "target", targetAddr, "required", proto, "error", err)
+			return
+		}
+	}
+	if len(early) > 0 {
+		if err := writeBeforeRelay(conn, early); err != nil {
+			countError("client_write")
+			logger.Debug("failed to write early target bytes", "remote", client, "target", targetAddr, "error", err)
+			return
+		}
+	}
+
+	clientConn := conn
+	if len(pending) > 0 {
+		clientConn = &prefixedConn{Conn: conn, prefix: pending}
+	}
+	if logSNI {
+		clientConn = newSNIConn(clientConn, func(sni string) {
+			if sni == "" {
+				logger.Debug("tunnel carries no TLS SNI", "remote", client, "target", targetAddr)
+				return
+			}
+			logger.Info("tunnel TLS SNI", "remote", client, "target", targetAddr, "sni", sni, "matches_target", hostKey(sni) == hostKey(targetHost))
+		})
+	}
+	relay(ctx, clientConn, target, logger, "http", client, targetAddr)
+}
+
+// connectHost returns the CONNECT target: the authority in the request line
+// when there is one, otherwise the Host header (for clients that send
+// "CONNECT / HTTP/1.1" with the target only in Host). It is "" when both
+// are missing, which connectTarget rejects.
+func connectHost(req *http.Request) string {
+	if req.URL != nil && req.URL.Host != "" {
+		return req.URL.Host
+	}
+	return req.Host
+}
+
+// strictHost, when set, rejects CONNECT requests whose Host header names a
+// different target than the request line, a possible sign of a request
+// smuggled past an intermediary that read the other one. Otherwise the
+// request line wins (see connectHost).
+var strictHost bool
+
+// rawHostHeader returns the Host header from the raw bytes of a request,
+// or "" if there is none.
+func rawHostHeader(raw []byte) string {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	if _, err := tp.ReadLine(); err != nil {
+		return ""
+	}
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(hdr.Get("Host"))
+}
+
+// hostMismatch reports whether hostHeader names a different target than the
+// CONNECT authority. Hosts compare like hostKey; a Host without a port
+// only has to match the host, since clients often leave the port out.
+func hostMismatch(authority, hostHeader string) bool {
+	if authority == "" || hostHeader == "" {
+		return false
+	}
+	aHost, aPort, err := net.SplitHostPort(authority)
+	if err != nil {
+		aHost = authority
+	}
+	hHost, hPort, err := net.SplitHostPort(hostHeader)
+	if err != nil {
+		hHost = hostHeader
+	}
+	trim := func(h string) string { return hostKey(strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")) }
+	if trim(aHost) != trim(hHost) {
+		return true
+	}
+	return hPort != "" && aPort != "" && hPort != aPort
+}
+
+const notAWebServerBody = `This is tailgate, a SOCKS5 and HTTP CONNECT proxy, not a web server.
 
-	// Wrap both sides with an idle timeout so tunnels with no traffic
-	// in either direction are cleaned up after tunnelIdleTimeout.
-	idleConn := &idleTimeoutConn{Conn: conn, timeout: tunnelIdleTimeout}
-	idleTarget := &idleTimeoutConn{Conn: target, timeout: tunnelIdleTimeout}
+Configure it as a proxy instead of browsing to it directly, e.g.:
 
-	// Relay bytes bidirectionally. Each goroutine closes the destination
-	// when its copy finishes, which unblocks the other goroutine's read.
-	// The defers above are safety nets for the redundant close.
-	var wg sync.WaitGroup
-	wg.Go(func() {
-		_, _ = io.Copy(idleTarget, idleConn)
-		_ = target.Close()
-	})
-	wg.Go(func() {
-		_, _ = io.Copy(idleConn, idleTarget)
-		_ = conn.Close()
-	})
-	wg.Wait()
+    curl --proxy http://<tailgate-host>:<port> https://example.com
+    curl --proxy socks5h://<tailgate-host>:<port> https://example.com
+`
+
+// isOriginFormRequest reports whether req uses an origin-form target
+// (e.g. "GET /index.html"), as sent by a client talking to tailgate as if
+// it were an origin server. Proxy-aware clients send absolute-form targets
+// ("GET http://host/") or CONNECT.
+func isOriginFormRequest(req *http.Request) bool {
+	return req.URL != nil && !req.URL.IsAbs() && strings.HasPrefix(req.RequestURI, "/")
+}
+
+// maxMethodLen bounds the method token accepted by looksLikeHTTPRequestLine.
+const maxMethodLen = 16
+
+// looksLikeHTTPRequestLine reports whether b starts with an upper-case method
+// token followed by a space ("CONNECT ", "GET "). Tunnel payloads such as a
+// TLS ClientHello (0x16) or an SSH banner ("SSH-2.0-...") do not match.
+func looksLikeHTTPRequestLine(b []byte) bool {
+	for i, c := range b {
+		if i > maxMethodLen {
+			return false
+		}
+		if c == ' ' {
+			return i > 0
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return false
 }
 
 func connectTarget(hostport string) (string, error) {
@@ -104,6 +447,16 @@ func connectTarget(hostport string) (string, error) {
 		return net.JoinHostPort(host, port), nil
 	}
 
+	if inner, ok := strings.CutPrefix(hostport, "["); ok && strings.HasSuffix(inner, "]") {
+		// Bracketed IPv6 literal without a port (e.g. "[::1]" or
+		// "[fe80::1%eth0]"). Brackets only ever wrap IPv6 addresses.
+		inner = strings.TrimSuffix(inner, "]")
+		if ip, err := netip.ParseAddr(inner); err != nil || !ip.Is6() {
+			return "", fmt.Errorf("invalid bracketed address %q", hostport)
+		}
+		return net.JoinHostPort(inner, "443"), nil
+	}
+
 	if strings.Count(hostport, ":") >= 2 && !strings.HasPrefix(hostport, "[") {
 		// Bare IPv6 literal without a port (e.g. "::1"). This heuristic
 		// relies on the fact that CONNECT targets are host:port or host,
@@ -119,24 +472,119 @@ func connectTarget(hostport string) (string, error) {
 	return "", err
 }
 
-// idleTimeoutConn resets the connection deadline on every Read or Write,
-// so the tunnel is torn down if no data flows for the configured duration.
+// idleDeadlineResetInterval is the most often idleTimeoutConn pushes its
+// deadline forward. It is a var so benchmarks can compare against resetting
+// on every operation.
+var idleDeadlineResetInterval = time.Second
+
+// idleTimeoutConn extends the connection deadline on Read and Write, so the
+// tunnel is torn down if no data flows for the configured duration.
+//
+// Resetting the deadline on every operation is costly on busy tunnels, so
+// resets are skipped when the previous one was less than
+// idleDeadlineResetInterval (capped at a tenth of the timeout) ago. The
+// effective idle timeout is therefore between timeout minus that interval
+// and timeout.
+//
+// With writeTimeout set, the idle deadline only covers reads, and each
+// Write gets its own deadline instead, renewed for as long as the peer
+// keeps accepting bytes: a slow client making steady progress is never
+// cut off, a stalled one is after writeTimeout.
 type idleTimeoutConn struct {
 	net.Conn
-	timeout time.Duration
+	timeout      time.Duration
+	writeTimeout time.Duration
+
+	lastReset atomic.Int64 // UnixNano of the last SetDeadline; shared by the relay goroutines
+	expired   atomic.Bool  // a Read or Write failed because the idle deadline fired
 }
 
 func (c *idleTimeoutConn) Read(p []byte) (int, error) {
-	_ = c.SetDeadline(time.Now().Add(c.timeout))
-	return c.Conn.Read(p)
+	c.extendDeadline()
+	n, err := c.Conn.Read(p)
+	c.noteTimeout(err)
+	return n, err
 }
 
 func (c *idleTimeoutConn) Write(p []byte) (int, error) {
-	_ = c.SetDeadline(time.Now().Add(c.timeout))
-	return c.Conn.Write(p)
+	c.extendDeadline()
+	if c.writeTimeout <= 0 {
+		n, err := c.Conn.Write(p)
+		c.noteTimeout(err)
+		return n, err
+	}
+	var written int
+	for {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		n, err := c.Conn.Write(p[written:])
+		written += n
+		var ne net.Error
+		if err == nil || !errors.As(err, &ne) || !ne.Timeout() {
+			return written, err
+		}
+		if n == 0 {
+			return written, fmt.Errorf("%w: no bytes accepted for %v: %w", errWriteStalled, c.writeTimeout, err)
+		}
+		// The deadline cut off a write that was still making progress.
+	}
 }
 
-func writeHTTPError(conn net.Conn, code int, body string) {
+func (c *idleTimeoutConn) noteTimeout(err error) {
+	var ne net.Error
+	if err != nil && errors.As(err, &ne) && ne.Timeout() {
+		c.expired.Store(true)
+	}
+}
+
+// idleExpired reports whether the idle deadline closed this connection.
+func (c *idleTimeoutConn) idleExpired() bool {
+	return c.expired.Load()
+}
+
+// lastActive returns when the deadline was last extended, which is within
+// the reset interval of the last Read or Write.
+func (c *idleTimeoutConn) lastActive() time.Time {
+	return time.Unix(0, c.lastReset.Load())
+}
+
+func (c *idleTimeoutConn) extendDeadline() {
+	now := time.Now()
+	interval := min(idleDeadlineResetInterval, c.timeout/10)
+	last := c.lastReset.Load()
+	if last != 0 && now.UnixNano()-last < int64(interval) {
+		return
+	}
+	if !c.lastReset.CompareAndSwap(last, now.UnixNano()) {
+		return // the other relay goroutine just reset it
+	}
+	if c.writeTimeout > 0 {
+		_ = c.SetReadDeadline(now.Add(c.timeout))
+		return
+	}
+	_ = c.SetDeadline(now.Add(c.timeout))
+}
+
+// dialFailureHeader returns extra response headers for a failed dial. Timeouts
+// usually mean the target (or the path to it) is overloaded, so clients are
+// asked to back off via Retry-After. Other failures (refused, unreachable)
+// are unlikely to resolve on retry and get no extra headers.
+func dialFailureHeader(err error) http.Header {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return retryAfterHeader(dialRetryAfterSeconds)
+	}
+	return nil
+}
+
+func retryAfterHeader(seconds int) http.Header {
+	h := make(http.Header)
+	h.Set("Retry-After", strconv.Itoa(seconds))
+	return h
+}
+
+// writeHTTPError writes a plain-text error response. Entries in header are
+// added to the response; it may be nil.
+func writeHTTPError(conn net.Conn, code int, body string, header http.Header) {
 	resp := &http.Response{
 		StatusCode:    code,
 		ProtoMajor:    1,
@@ -146,11 +594,72 @@ func writeHTTPError(conn net.Conn, code int, body string) {
 		Body:          io.NopCloser(strings.NewReader(body)),
 		Header:        make(http.Header),
 	}
+	for k, vs := range header {
+		for _, v := range vs {
+			resp.Header.Add(k, v)
+		}
+	}
 	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
 	resp.Header.Set("Connection", "close")
+	_ = conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
 	_ = resp.Write(conn)
 }
 
+// writeConnectEstablished writes the 200 reply to a CONNECT in a single
+// write. Unlike writeHTTPError it can't use http.Response.Write, which
+// always adds Content-Length and RFC 9110 forbids that on a 2xx CONNECT
+// response.
+func writeConnectEstablished(conn net.Conn, header http.Header) error {
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 200 Connection Established\r\n")
+	_ = header.Write(&b)
+	b.WriteString("\r\n")
+	return writeBeforeRelay(conn, []byte(b.String()))
+}
+
+// writeBeforeRelay writes b to the client ahead of the relay, within
+// responseWriteTimeout, and then clears the write deadline for the relay.
+func writeBeforeRelay(conn net.Conn, b []byte) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	_, err := conn.Write(b)
+	_ = conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// addConnectResponseHeader parses a "Name: value" flag value into h. Framing
+// headers are rejected because a 2xx CONNECT response must not carry them.
+func addConnectResponseHeader(h http.Header, s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" || strings.ContainsFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) {
+		return fmt.Errorf("invalid header %q: want \"Name: value\"", s)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid header %q: value contains a line break", s)
+	}
+	switch http.CanonicalHeaderKey(name) {
+	case "Content-Length", "Transfer-Encoding":
+		return fmt.Errorf("header %s is not allowed on a CONNECT response", name)
+	}
+	h.Add(name, value)
+	return nil
+}
+
+// headerLineCount returns how many header lines other than Host req was
+// sent with. http.ReadRequest folds repeated names into one key, counted
+// back out here, and moves Host out of the map. It fills req.Host from the
+// CONNECT authority whether or not a Host line was sent, so Host can't be
+// counted reliably and isn't counted at all.
+func headerLineCount(req *http.Request) int {
+	n := 0
+	for _, vs := range req.Header {
+		n += len(vs)
+	}
+	return n
+}
+
 // classifyReadRequestError returns 431 if the request exceeded the size limit,
 // 400 otherwise. The lr.N <= 0 check is reliable because the underlying reader
 // is a blocking network stream: bytes are only consumed when actually available,
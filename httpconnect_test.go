@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
@@ -25,7 +27,7 @@ func TestHandleHTTPConnectTunnel(t *testing.T) {
 	go func() {
 		defer close(done)
 		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-		handleHTTPConnect(serverConn, bufio.NewReader(serverConn), logger)
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
 	}()
 
 	req := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n"
@@ -68,6 +70,49 @@ func TestHandleHTTPConnectTunnel(t *testing.T) {
 	}
 }
 
+func TestHandleHTTPConnectForwardsEarlyClientData(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+	}()
+	defer func() {
+		_ = clientConn.Close()
+		<-done
+	}()
+
+	// The payload arrives in the same write as the request, so it is
+	// buffered while the request is parsed and must not be dropped.
+	payload := "\x16\x03\x01early-client-hello"
+	req := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n" + payload
+	go func() { _, _ = io.WriteString(clientConn, req) }()
+
+	br := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("read echoed early data: %v", err)
+	}
+	if string(buf) != payload {
+		t.Fatalf("echoed early data = %q, want %q", buf, payload)
+	}
+}
+
 func TestHandleHTTPConnectMethodNotAllowed(t *testing.T) {
 	t.Parallel()
 
@@ -77,6 +122,75 @@ func TestHandleHTTPConnectMethodNotAllowed(t *testing.T) {
 	}
 }
 
+func TestHandleHTTPConnectOriginFormRequest(t *testing.T) {
+	t.Parallel()
+
+	statusLine, _ := executeProxyRequest(t, "GET / HTTP/1.1\r\nHost: tailgate:1080\r\n\r\n")
+	if !strings.Contains(statusLine, "400") {
+		t.Fatalf("expected 400, got %q", statusLine)
+	}
+}
+
+func TestIsOriginFormRequest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		raw  string
+		want bool
+	}{
+		{name: "origin_root", raw: "GET / HTTP/1.1\r\nHost: tailgate\r\n\r\n", want: true},
+		{name: "origin_path", raw: "GET /favicon.ico HTTP/1.1\r\nHost: tailgate\r\n\r\n", want: true},
+		{name: "absolute_form", raw: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", want: false},
+		{name: "asterisk_form", raw: "OPTIONS * HTTP/1.1\r\nHost: tailgate\r\n\r\n", want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tc.raw)))
+			if err != nil {
+				t.Fatalf("parse request: %v", err)
+			}
+			if got := isOriginFormRequest(req); got != tc.want {
+				t.Fatalf("isOriginFormRequest(%q) = %v, want %v", tc.raw, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleHTTPConnectPipelinedRequest(t *testing.T) {
+	t.Parallel()
+
+	req := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	statusLine, _ := executeProxyRequest(t, req+req)
+	if !strings.Contains(statusLine, "400") {
+		t.Fatalf("expected 400 for pipelined CONNECT, got %q", statusLine)
+	}
+}
+
+func TestLooksLikeHTTPRequestLine(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{in: "CONNECT example.com:443 HTTP/1.1\r\n", want: true},
+		{in: "GET / HTTP/1.1\r\n", want: true},
+		{in: "\x16\x03\x01\x02\x00", want: false},
+		{in: "SSH-2.0-OpenSSH_9.6 Ubuntu\r\n", want: false},
+		{in: "CONNECT", want: false},
+		{in: "", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := looksLikeHTTPRequestLine([]byte(tc.in)); got != tc.want {
+			t.Fatalf("looksLikeHTTPRequestLine(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
 func TestHandleHTTPConnectOversizedRequest(t *testing.T) {
 	t.Parallel()
 
@@ -87,6 +201,40 @@ func TestHandleHTTPConnectOversizedRequest(t *testing.T) {
 	}
 }
 
+func TestHandleHTTPConnectTooManyHeaders(t *testing.T) {
+	t.Parallel()
+
+	// Port 0 is refused with 400 once the headers pass, so nothing dials.
+	request := func(headers int, host bool) string {
+		var b strings.Builder
+		b.WriteString("CONNECT example.com:0 HTTP/1.1\r\n")
+		if host {
+			b.WriteString("Host: example.com:0\r\n")
+		}
+		for i := range headers {
+			fmt.Fprintf(&b, "X-%d: v\r\n", i)
+		}
+		b.WriteString("\r\n")
+		return b.String()
+	}
+	many := request(300, true)
+	if len(many) >= maxConnectRequestBytes {
+		t.Fatalf("test request is %d bytes, want it under the %d byte limit", len(many), maxConnectRequestBytes)
+	}
+	if statusLine, _ := executeProxyRequest(t, many); !strings.Contains(statusLine, "431") {
+		t.Fatalf("300 headers: expected 431, got %q", statusLine)
+	}
+	// Host doesn't count toward the limit, whether or not it was sent.
+	for _, host := range []bool{true, false} {
+		if statusLine, _ := executeProxyRequest(t, request(maxHeaderCount, host)); !strings.Contains(statusLine, "400") {
+			t.Fatalf("%d headers, host=%v: expected to pass the header limit and get 400, got %q", maxHeaderCount, host, statusLine)
+		}
+		if statusLine, _ := executeProxyRequest(t, request(maxHeaderCount+1, host)); !strings.Contains(statusLine, "431") {
+			t.Fatalf("%d headers, host=%v: expected 431, got %q", maxHeaderCount+1, host, statusLine)
+		}
+	}
+}
+
 func TestHandleHTTPConnectBadTarget(t *testing.T) {
 	t.Parallel()
 
@@ -96,6 +244,158 @@ func TestHandleHTTPConnectBadTarget(t *testing.T) {
 	}
 }
 
+func TestHandleHTTPConnectResolverTimeout(t *testing.T) {
+	// Not parallel: mutates the package-level lookupNetIP and resolverTimeout.
+	origLookup, origTimeout := lookupNetIP, resolverTimeout
+	defer func() { lookupNetIP, resolverTimeout = origLookup, origTimeout }()
+	lookupNetIP = stallLookup
+	resolverTimeout = 50 * time.Millisecond
+
+	statusLine, _ := executeProxyRequest(t, "CONNECT slow.test:443 HTTP/1.1\r\nHost: slow.test:443\r\n\r\n")
+	if !strings.Contains(statusLine, "504") {
+		t.Fatalf("expected 504 on resolver timeout, got %q", statusLine)
+	}
+}
+
+func TestConnectHost(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		req  string
+		want string
+	}{
+		{name: "request_line_and_host", req: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", want: "example.com:443"},
+		{name: "request_line_only", req: "CONNECT example.com:443 HTTP/1.1\r\n\r\n", want: "example.com:443"},
+		{name: "request_line_wins", req: "CONNECT example.com:443 HTTP/1.1\r\nHost: other.example:443\r\n\r\n", want: "example.com:443"},
+		{name: "host_header_only", req: "CONNECT / HTTP/1.1\r\nHost: example.com:443\r\n\r\n", want: "example.com:443"},
+		{name: "neither", req: "CONNECT / HTTP/1.1\r\n\r\n", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.req)))
+			if err != nil {
+				t.Fatalf("read request: %v", err)
+			}
+			if got := connectHost(req); got != tt.want {
+				t.Fatalf("connectHost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostMismatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		authority, host string
+		want            bool
+	}{
+		{"example.com:443", "example.com:443", false},
+		{"example.com:443", "Example.COM.:443", false},
+		{"example.com:8443", "example.com", false},
+		{"[::1]:443", "[::1]:443", false},
+		{"[::1]:443", "::1", false},
+		{"example.com:443", "", false},
+		{"example.com:443", "other.example:443", true},
+		{"example.com:443", "example.com:8443", true},
+		{"example.com:443", "other.example", true},
+	}
+	for _, tt := range tests {
+		if got := hostMismatch(tt.authority, tt.host); got != tt.want {
+			t.Errorf("hostMismatch(%q, %q) = %v, want %v", tt.authority, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRawHostHeader(t *testing.T) {
+	t.Parallel()
+
+	raw := []byte("CONNECT example.com:443 HTTP/1.1\r\nUser-Agent: x\r\nhost:  other.example:443 \r\n\r\n\x16\x03\x01")
+	if got := rawHostHeader(raw); got != "other.example:443" {
+		t.Fatalf("rawHostHeader = %q", got)
+	}
+	if got := rawHostHeader([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n")); got != "" {
+		t.Fatalf("rawHostHeader without Host = %q", got)
+	}
+}
+
+func TestHandleHTTPConnectStrictHost(t *testing.T) {
+	// Not parallel: mutates the package-level strictHost.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	_, port, _ := net.SplitHostPort(targetAddr)
+
+	tests := []struct {
+		name   string
+		host   string
+		strict bool
+		want   string
+	}{
+		{name: "matching", host: targetAddr, strict: true, want: "200"},
+		{name: "matching_without_port", host: "127.0.0.1", strict: true, want: "200"},
+		{name: "conflicting_strict", host: "10.0.0.1:" + port, strict: true, want: "400"},
+		{name: "conflicting_port_strict", host: "127.0.0.1:1", strict: true, want: "400"},
+		{name: "conflicting_lenient", host: "10.0.0.1:" + port, strict: false, want: "200"},
+	}
+	orig := strictHost
+	defer func() { strictHost = orig }()
+	for _, tt := range tests {
+		strictHost = tt.strict
+		status, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+tt.host+"\r\n\r\n")
+		if !strings.Contains(status, tt.want) {
+			t.Errorf("%s: status = %q, want %s", tt.name, status, tt.want)
+		}
+	}
+}
+
+func TestHandleHTTPConnectTargetForms(t *testing.T) {
+	t.Parallel()
+
+	// Cleanup, not defer: the parallel subtests outlive this function body.
+	targetAddr, stopTarget := startEchoServer(t)
+	t.Cleanup(stopTarget)
+
+	tests := []struct {
+		name string
+		req  string
+		want int
+	}{
+		{name: "request_line_only", req: "CONNECT " + targetAddr + " HTTP/1.1\r\n\r\n", want: http.StatusOK},
+		{name: "host_header_only", req: "CONNECT / HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n", want: http.StatusOK},
+		{name: "neither", req: "CONNECT / HTTP/1.1\r\n\r\n", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			clientConn, serverConn := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+				handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+				_ = serverConn.Close()
+			}()
+			defer func() {
+				_ = clientConn.Close()
+				<-done
+			}()
+
+			go func() { _, _ = io.WriteString(clientConn, tt.req) }()
+			_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(clientConn), &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
 func TestHandleHTTPConnectMalformedRequest(t *testing.T) {
 	t.Parallel()
 
@@ -105,6 +405,47 @@ func TestHandleHTTPConnectMalformedRequest(t *testing.T) {
 	}
 }
 
+func TestDialFailureHeaderRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	h := dialFailureHeader(&stubNetError{timeout: true})
+	if got := h.Get("Retry-After"); got != "5" {
+		t.Fatalf("expected Retry-After 5 on dial timeout, got %q", got)
+	}
+	if h := dialFailureHeader(errors.New("connection refused")); h.Get("Retry-After") != "" {
+		t.Fatalf("expected no Retry-After on non-timeout dial failure, got %v", h)
+	}
+}
+
+func TestWriteHTTPErrorExtraHeader(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	go func() {
+		defer serverConn.Close() //nolint:errcheck // test cleanup
+		writeHTTPError(serverConn, http.StatusServiceUnavailable, "overloaded\n", retryAfterHeader(7))
+	}()
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // test cleanup
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %q", resp.Status)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "7" {
+		t.Fatalf("expected Retry-After 7, got %q", got)
+	}
+	if !resp.Close {
+		t.Fatal("expected Connection: close")
+	}
+}
+
 func executeProxyRequest(t *testing.T, request string) (statusLine, body string) {
 	t.Helper()
 
@@ -115,7 +456,7 @@ func executeProxyRequest(t *testing.T, request string) (statusLine, body string)
 	go func() {
 		defer close(done)
 		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-		handleHTTPConnect(serverConn, bufio.NewReader(serverConn), logger)
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
 	}()
 
 	writeDone := make(chan error, 1)
@@ -148,6 +489,72 @@ func executeProxyRequest(t *testing.T, request string) (statusLine, body string)
 	return resp.Status, ""
 }
 
+func TestHandleHTTPConnectResponseHeaders(t *testing.T) {
+	// Not parallel: mutates the package-level connectResponseHeader.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	origHeader := connectResponseHeader
+	connectResponseHeader = make(http.Header)
+	defer func() { connectResponseHeader = origHeader }()
+	for _, h := range []string{"Proxy-Agent: tailgate", "X-Tunnel: a", "X-Tunnel: b"} {
+		if err := addConnectResponseHeader(connectResponseHeader, h); err != nil {
+			t.Fatalf("addConnectResponseHeader(%q): %v", h, err)
+		}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+	}()
+	defer func() {
+		_ = clientConn.Close()
+		<-done
+	}()
+
+	if _, err := io.WriteString(clientConn, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n"); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Agent"); got != "tailgate" {
+		t.Fatalf("Proxy-Agent = %q, want tailgate", got)
+	}
+	if got := resp.Header.Values("X-Tunnel"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("X-Tunnel = %q, want [a b]", got)
+	}
+	if _, ok := resp.Header["Content-Length"]; ok {
+		t.Fatal("200 reply to CONNECT must not carry Content-Length")
+	}
+}
+
+func TestAddConnectResponseHeader(t *testing.T) {
+	t.Parallel()
+
+	for _, bad := range []string{"", "NoColon", ": value", "Bad Name: x", "X-A: b\r\nX-B: c", "Content-Length: 5", "transfer-encoding: chunked"} {
+		if err := addConnectResponseHeader(make(http.Header), bad); err == nil {
+			t.Fatalf("addConnectResponseHeader(%q) succeeded, want error", bad)
+		}
+	}
+
+	h := make(http.Header)
+	if err := addConnectResponseHeader(h, "  proxy-agent :  tailgate/1.0 "); err != nil {
+		t.Fatalf("addConnectResponseHeader: %v", err)
+	}
+	if got := h.Get("Proxy-Agent"); got != "tailgate/1.0" {
+		t.Fatalf("Proxy-Agent = %q, want tailgate/1.0", got)
+	}
+}
+
 func TestHandleHTTPConnectIdleTunnelTeardown(t *testing.T) {
 	// Not parallel: mutates the package-level tunnelIdleTimeout.
 
@@ -166,7 +573,7 @@ func TestHandleHTTPConnectIdleTunnelTeardown(t *testing.T) {
 	go func() {
 		defer close(done)
 		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-		handleHTTPConnect(serverConn, bufio.NewReader(serverConn), logger)
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
 	}()
 
 	req := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n"
@@ -195,6 +602,98 @@ func TestHandleHTTPConnectIdleTunnelTeardown(t *testing.T) {
 	}
 }
 
+func TestHandleHTTPConnectClientNeverReads(t *testing.T) {
+	// Not parallel: mutates the package-level responseWriteTimeout.
+	orig := responseWriteTimeout
+	responseWriteTimeout = 50 * time.Millisecond
+	defer func() { responseWriteTimeout = orig }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	for name, req := range map[string]string{
+		"error":       "NOT A REQUEST\r\n\r\n",
+		"established": "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			// net.Pipe writes block until the other end reads, like a
+			// client whose receive window is full.
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close() //nolint:errcheck // test cleanup
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer serverConn.Close() //nolint:errcheck // test cleanup
+				logger := slog.New(slog.DiscardHandler)
+				handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+			}()
+			if _, err := io.WriteString(clientConn, req); err != nil {
+				t.Fatalf("write request: %v", err)
+			}
+
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("handler blocked writing to a client that never reads")
+			}
+		})
+	}
+}
+
+func TestHandleHTTPConnectPerHostLimit(t *testing.T) {
+	// Not parallel: mutates the package-level perHostLimiter.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	origLimiter := perHostLimiter
+	perHostLimiter = newConnLimiter(1)
+	defer func() { perHostLimiter = origLimiter }()
+
+	clientConn, done := openHTTPTunnel(t, targetAddr)
+	defer func() {
+		_ = clientConn.Close()
+		<-done
+	}()
+
+	statusLine, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n")
+	if !strings.Contains(statusLine, "503") {
+		t.Fatalf("expected 503 for tunnel over per-host limit, got %q", statusLine)
+	}
+}
+
+// openHTTPTunnel establishes a CONNECT tunnel to targetAddr through
+// handleHTTPConnect. done is closed when the handler returns.
+func openHTTPTunnel(t *testing.T, targetAddr string) (clientConn net.Conn, done chan struct{}) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+	}()
+
+	req := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n\r\n"
+	if _, err := io.WriteString(clientConn, req); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	br := bufio.NewReader(clientConn)
+	statusLine, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read status line: %v", err)
+	}
+	if !strings.Contains(statusLine, "200") {
+		t.Fatalf("expected 200 status line, got %q", statusLine)
+	}
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("read header terminator: %v", err)
+	}
+	return clientConn, done
+}
+
 func TestIdleTimeoutConn(t *testing.T) {
 	t.Parallel()
 
@@ -216,6 +715,129 @@ func TestIdleTimeoutConn(t *testing.T) {
 	}
 }
 
+func TestIdleTimeoutConnStaysOpenWithTraffic(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+
+	wrapped := &idleTimeoutConn{Conn: serverConn, timeout: 100 * time.Millisecond}
+
+	// Keep data flowing for several timeout periods; rate-limited deadline
+	// resets must still keep the connection alive.
+	go func() {
+		for range 20 {
+			if _, err := clientConn.Write([]byte{'x'}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	buf := make([]byte, 1)
+	for range 20 {
+		if _, err := wrapped.Read(buf); err != nil {
+			t.Fatalf("read on active conn failed: %v", err)
+		}
+	}
+}
+
+func TestIdleTimeoutConnWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+
+	wrapped := &idleTimeoutConn{Conn: serverConn, timeout: time.Minute, writeTimeout: 50 * time.Millisecond}
+
+	// The client never reads, so the write stalls long before the idle
+	// timeout.
+	start := time.Now()
+	_, err := wrapped.Write([]byte("stuck"))
+	if !errors.Is(err, errWriteStalled) {
+		t.Fatalf("write to a client that never reads = %v, want errWriteStalled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("write stalled for %v, want about the 50ms write timeout", elapsed)
+	}
+	if wrapped.idleExpired() {
+		t.Fatal("a write stall was reported as an idle timeout")
+	}
+}
+
+func TestIdleTimeoutConnWriteTimeoutAllowsSlowProgress(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+
+	wrapped := &idleTimeoutConn{Conn: serverConn, timeout: time.Minute, writeTimeout: 50 * time.Millisecond}
+
+	// The client reads a byte every 20ms, so the 10-byte write takes four
+	// write timeouts but never goes 50ms without progress.
+	go func() {
+		buf := make([]byte, 1)
+		for range 10 {
+			if _, err := clientConn.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	n, err := wrapped.Write([]byte("0123456789"))
+	if err != nil || n != 10 {
+		t.Fatalf("slow but steady write = %d, %v; want all 10 bytes", n, err)
+	}
+}
+
+func BenchmarkIdleTimeoutConnWrite(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		interval time.Duration
+	}{
+		{name: "reset_every_op", interval: 0},
+		{name: "rate_limited", interval: time.Second},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			orig := idleDeadlineResetInterval
+			idleDeadlineResetInterval = bc.interval
+			defer func() { idleDeadlineResetInterval = orig }()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("listen: %v", err)
+			}
+			defer ln.Close() //nolint:errcheck // test cleanup
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close() //nolint:errcheck // test cleanup
+				_, _ = io.Copy(io.Discard, c)
+			}()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatalf("dial: %v", err)
+			}
+			defer conn.Close() //nolint:errcheck // test cleanup
+			wrapped := &idleTimeoutConn{Conn: conn, timeout: time.Minute}
+
+			buf := make([]byte, 512)
+			b.SetBytes(int64(len(buf)))
+			for b.Loop() {
+				if _, err := wrapped.Write(buf); err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+		})
+	}
+}
+
 func startEchoServer(t *testing.T) (addr string, stop func()) {
 	t.Helper()
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// perUserLimiter caps concurrent tunnels per tailnet login name, so a user
+// with several devices shares one budget.
+var perUserLimiter = newConnLimiter(0)
+
+// whoIsLogin returns the tailnet login name of the peer at remoteAddr. main
+// sets it from the tsnet LocalClient.
+var whoIsLogin func(ctx context.Context, remoteAddr string) (string, error)
+
+// whoIsTimeout bounds the identity lookup for one tunnel.
+const whoIsTimeout = 2 * time.Second
+
+// acquireUserSlot reserves a tunnel slot for the tailnet user behind conn.
+// ok is false only when that user is at -per-user-max-conns. Peers without
+// a tailnet identity, such as -local-listen clients, are not limited by
+// user. The caller must call release once the tunnel closes.
+func acquireUserSlot(ctx context.Context, conn net.Conn, logger *slog.Logger) (release func(), user string, ok bool) {
+	if perUserLimiter.max <= 0 || whoIsLogin == nil {
+		return func() {}, "", true
+	}
+	ctx, cancel := context.WithTimeout(ctx, whoIsTimeout)
+	defer cancel()
+	user, err := whoIsLogin(ctx, whoIsAddr(conn))
+	if err != nil || user == "" {
+		logger.Debug("no tailnet identity for peer; per-user limit not applied", "remote", remoteAddr(conn), "error", err)
+		return func() {}, "", true
+	}
+	release, ok = perUserLimiter.acquire(user)
+	return release, user, ok
+}
+
+// whoIsAddr returns the address to look up conn's tailnet identity by: the
+// socket peer, never a client address from a PROXY header. A -local-listen
+// upstream could otherwise forward a tailnet IP and borrow that node's
+// grants and login.
+func whoIsAddr(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case *proxiedConn:
+			return remoteAddr(c.Conn)
+		case *peekedConn:
+			conn = c.Conn
+		case *prefixedConn:
+			conn = c.Conn
+		case *sniConn:
+			conn = c.Conn
+		case *capsuleConn:
+			conn = c.Conn
+		default:
+			return remoteAddr(conn)
+		}
+	}
+}
+
+type tunnelUserKey struct{}
+
+// withTunnelUser returns a context whose tunnel's access log record carries
+// the tailnet login user, if any.
+func withTunnelUser(ctx context.Context, user string) context.Context {
+	if user == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tunnelUserKey{}, user)
+}
+
+// tunnelUserFrom returns the user set by withTunnelUser, or "".
+func tunnelUserFrom(ctx context.Context) string {
+	user, _ := ctx.Value(tunnelUserKey{}).(string)
+	return user
+}
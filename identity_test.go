@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeWhoIs makes every peer the given user, or unidentifiable if user is "".
+func fakeWhoIs(user string) func(context.Context, string) (string, error) {
+	return func(context.Context, string) (string, error) {
+		if user == "" {
+			return "", errors.New("no match for IP:port")
+		}
+		return user, nil
+	}
+}
+
+func TestAcquireUserSlot(t *testing.T) {
+	// Not parallel: mutates the package-level perUserLimiter and whoIsLogin.
+	origLimiter, origWhoIs := perUserLimiter, whoIsLogin
+	defer func() { perUserLimiter, whoIsLogin = origLimiter, origWhoIs }()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	conn, peer := net.Pipe()
+	defer conn.Close() //nolint:errcheck // test cleanup
+	defer peer.Close() //nolint:errcheck // test cleanup
+
+	perUserLimiter = newConnLimiter(1)
+	whoIsLogin = fakeWhoIs("alice@example.com")
+
+	release, user, ok := acquireUserSlot(context.Background(), conn, logger)
+	if !ok || user != "alice@example.com" {
+		t.Fatalf("first acquire = %q, %v; want alice@example.com, true", user, ok)
+	}
+	if _, _, ok := acquireUserSlot(context.Background(), conn, logger); ok {
+		t.Fatal("second acquire for the same user succeeded past the limit")
+	}
+	release()
+	release2, _, ok := acquireUserSlot(context.Background(), conn, logger)
+	if !ok {
+		t.Fatal("acquire after release failed")
+	}
+	release2()
+
+	// Peers with no tailnet identity are never limited by user.
+	whoIsLogin = fakeWhoIs("")
+	for range 3 {
+		if _, _, ok := acquireUserSlot(context.Background(), conn, logger); !ok {
+			t.Fatal("unidentified peer was limited")
+		}
+	}
+
+	// A zero limit skips the lookup entirely.
+	perUserLimiter = newConnLimiter(0)
+	whoIsLogin = func(context.Context, string) (string, error) {
+		t.Fatal("whoIsLogin called with no per-user limit")
+		return "", nil
+	}
+	if _, _, ok := acquireUserSlot(context.Background(), conn, logger); !ok {
+		t.Fatal("acquire with no limit failed")
+	}
+}
+
+func TestHandleHTTPConnectPerUserLimit(t *testing.T) {
+	// Not parallel: mutates the package-level perUserLimiter and whoIsLogin.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	origLimiter, origWhoIs := perUserLimiter, whoIsLogin
+	defer func() { perUserLimiter, whoIsLogin = origLimiter, origWhoIs }()
+	perUserLimiter = newConnLimiter(1)
+	whoIsLogin = fakeWhoIs("alice@example.com")
+
+	clientConn, done := openHTTPTunnel(t, targetAddr)
+	defer func() {
+		_ = clientConn.Close()
+		<-done
+	}()
+
+	// Same user (even from another device), different target.
+	otherTarget, stopOther := startEchoServer(t)
+	defer stopOther()
+	statusLine, _ := executeProxyRequest(t, "CONNECT "+otherTarget+" HTTP/1.1\r\nHost: "+otherTarget+"\r\n\r\n")
+	if !strings.Contains(statusLine, "403") {
+		t.Fatalf("expected 403 for tunnel over per-user limit, got %q", statusLine)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// labelHeader lets an HTTP CONNECT request tag its tunnel with a
+// client-chosen label (a job name, say) that is added to the tunnel's
+// access log record. Like every CONNECT header it is never sent to the
+// target.
+const labelHeader = "X-Tailgate-Label"
+
+// maxLabelLen is the longest label accepted; longer ones are ignored.
+var maxLabelLen = 64
+
+// allowedLabels, when non-nil, is the set of labels accepted; others are
+// ignored. Allowlisted labels are also counted in tunnels_by_label, which
+// an open-ended label set would make unbounded.
+var allowedLabels map[string]bool
+
+// tunnelLabel validates a labelHeader value. ok is false for labels that
+// aren't validLabel or aren't in allowedLabels.
+func tunnelLabel(raw string) (label string, ok bool) {
+	label = strings.TrimSpace(raw)
+	if !validLabel(label) || allowedLabels != nil && !allowedLabels[label] {
+		return "", false
+	}
+	return label, true
+}
+
+// validLabel reports whether label is 1 to maxLabelLen of A-Z, a-z, 0-9,
+// '.', '_' and '-', so it can't break log formats.
+func validLabel(label string) bool {
+	if label == "" || len(label) > maxLabelLen {
+		return false
+	}
+	for _, c := range []byte(label) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLabelList parses -allowed-labels, returning entries that aren't
+// validLabel as invalid.
+func parseLabelList(s string) (labels map[string]bool, invalid []string) {
+	labels = make(map[string]bool)
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !validLabel(field) {
+			invalid = append(invalid, field)
+			continue
+		}
+		labels[field] = true
+	}
+	return labels, invalid
+}
+
+type tunnelLabelKey struct{}
+
+// withTunnelLabel returns a context whose tunnel's access log record
+// carries label.
+func withTunnelLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, tunnelLabelKey{}, label)
+}
+
+// tunnelLabelFrom returns the label set by withTunnelLabel, or "".
+func tunnelLabelFrom(ctx context.Context) string {
+	label, _ := ctx.Value(tunnelLabelKey{}).(string)
+	return label
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelLabel(t *testing.T) {
+	// Not parallel: mutates the package-level allowedLabels.
+	orig := allowedLabels
+	defer func() { allowedLabels = orig }()
+
+	allowedLabels = nil
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{" nightly-backup ", "nightly-backup", true},
+		{"job_1.A", "job_1.A", true},
+		{strings.Repeat("a", maxLabelLen), strings.Repeat("a", maxLabelLen), true},
+		{strings.Repeat("a", maxLabelLen+1), "", false},
+		{"", "", false},
+		{"has space", "", false},
+		{"quote\"", "", false},
+		{"new\nline", "", false},
+		{"ünicode", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := tunnelLabel(tt.raw); got != tt.want || ok != tt.ok {
+			t.Errorf("tunnelLabel(%q) = %q, %v; want %q, %v", tt.raw, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	allowedLabels = map[string]bool{"ci": true}
+	if _, ok := tunnelLabel("ci"); !ok {
+		t.Error("allowlisted label rejected")
+	}
+	if _, ok := tunnelLabel("other"); ok {
+		t.Error("label outside the allowlist accepted")
+	}
+}
+
+func TestParseLabelList(t *testing.T) {
+	t.Parallel()
+
+	labels, invalid := parseLabelList("ci, nightly ,,bad label")
+	if len(labels) != 2 || !labels["ci"] || !labels["nightly"] {
+		t.Errorf("labels = %v", labels)
+	}
+	if len(invalid) != 1 || invalid[0] != "bad label" {
+		t.Errorf("invalid = %q", invalid)
+	}
+}
+
+func TestHandleHTTPConnectLabelInAccessLog(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	for _, tc := range []struct {
+		header, want string
+	}{
+		{header: "job-42", want: "label=job-42"},
+		{header: "not valid", want: ""},
+	} {
+		var logs syncBuffer
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			logger := slog.New(slog.NewTextHandler(&logs, nil))
+			handleHTTPConnect(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, bufio.NewReader(serverConn), listenerOptions{}, logger)
+			_ = serverConn.Close()
+		}()
+
+		_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+		req := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n" + labelHeader + ": " + tc.header + "\r\n\r\n"
+		if _, err := io.WriteString(clientConn, req); err != nil {
+			t.Fatalf("write CONNECT: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(clientConn), &http.Request{Method: http.MethodConnect})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT response = %v, %v; want 200", resp, err)
+		}
+		_ = clientConn.Close()
+		<-done
+
+		out := logs.String()
+		if !strings.Contains(out, "tunnel closed") {
+			t.Fatalf("no access log record: %s", out)
+		}
+		if tc.want != "" && !strings.Contains(out, tc.want) {
+			t.Errorf("label %q: access log missing %q: %s", tc.header, tc.want, out)
+		}
+		if tc.want == "" && strings.Contains(out, "label=") {
+			t.Errorf("invalid label %q logged: %s", tc.header, out)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// lifetimeWarningLead is how long before a -max-process-lifetime shutdown
+// the upcoming restart is logged again.
+const lifetimeWarningLead = time.Minute
+
+// withMaxLifetime returns a context that is canceled once lifetime has
+// elapsed, starting the same graceful shutdown as SIGTERM so a supervisor
+// can restart the process. The shutdown time is logged immediately and
+// again warnLead before it, when lifetime is long enough for that to be
+// useful. lifetime <= 0 disables the limit.
+func withMaxLifetime(parent context.Context, lifetime, warnLead time.Duration, logger *slog.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if lifetime <= 0 {
+		return ctx, cancel
+	}
+
+	at := time.Now().Add(lifetime)
+	logger.Info("scheduled shutdown for max process lifetime", "lifetime", lifetime, "at", at.Format(time.RFC3339))
+
+	go func() {
+		if warnLead > 0 && lifetime > 2*warnLead {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(lifetime - warnLead):
+			}
+			logger.Warn("max process lifetime shutdown approaching", "in", warnLead, "at", at.Format(time.RFC3339))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(at)):
+		}
+		logger.Warn("max process lifetime reached; shutting down", "lifetime", lifetime)
+		cancel()
+	}()
+	return ctx, cancel
+}
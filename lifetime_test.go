@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithMaxLifetimeCancels(t *testing.T) {
+	t.Parallel()
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	ctx, cancel := withMaxLifetime(context.Background(), 100*time.Millisecond, 20*time.Millisecond, logger)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("context not canceled after max lifetime")
+	}
+
+	out := logs.String()
+	for _, msg := range []string{"scheduled shutdown", "shutdown approaching", "max process lifetime reached"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("log missing %q:\n%s", msg, out)
+		}
+	}
+}
+
+func TestWithMaxLifetimeDisabled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := withMaxLifetime(context.Background(), 0, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context canceled with lifetime disabled")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWithMaxLifetimeParentCanceled(t *testing.T) {
+	t.Parallel()
+
+	parent, stop := context.WithCancel(context.Background())
+	var logs syncBuffer
+	ctx, cancel := withMaxLifetime(parent, time.Hour, time.Minute, slog.New(slog.NewTextHandler(&logs, nil)))
+	defer cancel()
+
+	stop()
+	<-ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+	if strings.Contains(logs.String(), "lifetime reached") {
+		t.Fatalf("lifetime shutdown logged after parent was canceled:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenBacklog, when positive, is the accept backlog of the -local-listen
+// socket in place of the system default. It only applies to the socket
+// tailgate binds itself: tsnet listeners have no OS backlog, and systemd
+// sets its own with Backlog=.
+var listenBacklog int
+
+// maxListenBacklog is the largest -listen-backlog accepted; Linux kernels
+// before 5.4 keep the backlog in 16 bits.
+const maxListenBacklog = 1<<16 - 1
+
+// somaxconnPath is where Linux exposes its cap on listen backlogs.
+var somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+// clampListenBacklog limits n to the kernel's somaxconn where that can be
+// read; the kernel would silently cap it there anyway.
+func clampListenBacklog(n int) (backlog int, clamped bool) {
+	b, err := os.ReadFile(somaxconnPath)
+	if err != nil {
+		return n, false
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || limit <= 0 || n <= limit {
+		return n, false
+	}
+	return limit, true
+}
+
+// applyListenBacklog sets ln's accept backlog to listenBacklog, clamped to
+// somaxconn.
+func applyListenBacklog(ln net.Listener) error {
+	backlog, clamped := clampListenBacklog(listenBacklog)
+	if clamped {
+		slog.Warn("-listen-backlog exceeds the kernel's somaxconn; using somaxconn", "listen_backlog", listenBacklog, "somaxconn", backlog, "sysctl", "net.core.somaxconn")
+	}
+	if err := setListenBacklog(ln, backlog); err != nil {
+		return fmt.Errorf("set listen backlog %d: %w", backlog, err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setListenBacklog is unsupported where listen(2) can't be called again on
+// a listening socket.
+func setListenBacklog(net.Listener, int) error {
+	return errors.ErrUnsupported
+}
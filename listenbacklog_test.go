@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClampListenBacklog(t *testing.T) {
+	// Not parallel: mutates the package-level somaxconnPath.
+	orig := somaxconnPath
+	defer func() { somaxconnPath = orig }()
+
+	somaxconnPath = filepath.Join(t.TempDir(), "somaxconn")
+	if err := os.WriteFile(somaxconnPath, []byte("4096\n"), 0o600); err != nil {
+		t.Fatalf("write fake somaxconn: %v", err)
+	}
+	if got, clamped := clampListenBacklog(1024); got != 1024 || clamped {
+		t.Fatalf("clampListenBacklog(1024) = %d, %v; want it unchanged", got, clamped)
+	}
+	if got, clamped := clampListenBacklog(8192); got != 4096 || !clamped {
+		t.Fatalf("clampListenBacklog(8192) = %d, %v; want 4096, clamped", got, clamped)
+	}
+
+	somaxconnPath = filepath.Join(t.TempDir(), "missing")
+	if got, clamped := clampListenBacklog(8192); got != 8192 || clamped {
+		t.Fatalf("clampListenBacklog without somaxconn = %d, %v; want it unchanged", got, clamped)
+	}
+}
+
+func TestSetListenBacklog(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+
+	err = setListenBacklog(ln, 512)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("listen backlog can't be changed on this platform")
+	}
+	if err != nil {
+		t.Fatalf("setListenBacklog: %v", err)
+	}
+
+	// The socket still accepts after listen(2) is called again.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // test cleanup
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	_ = accepted.Close()
+}
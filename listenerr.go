@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// Listen failure reasons reported by classifyListenError.
+const (
+	listenAddrInUse   = "address_in_use"
+	listenPermission  = "permission_denied"
+	listenOtherFailed = "bind_failed"
+)
+
+// classifyListenError maps a failed bind to a reason and an actionable hint
+// by inspecting the underlying errno. Errors without a recognised errno
+// (including most tsnet netstack failures) are reported as bind_failed.
+func classifyListenError(err error) (reason, hint string) {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EADDRINUSE:
+			return listenAddrInUse, "another process is already bound to this address; stop it or choose a different port"
+		case syscall.EACCES, syscall.EPERM:
+			return listenPermission, "ports below 1024 need root or CAP_NET_BIND_SERVICE; choose a higher port or grant the capability"
+		}
+	}
+	return listenOtherFailed, "check that the address is well-formed and available on this host"
+}
+
+// exitListenError logs a classified listen failure for the named flag and
+// exits with status 1.
+func exitListenError(msg, flagName, addr string, err error) {
+	reason, hint := classifyListenError(err)
+	slog.Error(msg, flagName, addr, "reason", reason, "hint", hint, "error", err)
+	os.Exit(1)
+}
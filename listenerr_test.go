@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyListenError(t *testing.T) {
+	t.Parallel()
+
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", errno)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "addr_in_use", err: opErr(syscall.EADDRINUSE), want: listenAddrInUse},
+		{name: "eacces", err: opErr(syscall.EACCES), want: listenPermission},
+		{name: "eperm", err: opErr(syscall.EPERM), want: listenPermission},
+		{name: "wrapped", err: fmt.Errorf("local listener: %w", opErr(syscall.EADDRINUSE)), want: listenAddrInUse},
+		{name: "other_errno", err: opErr(syscall.EADDRNOTAVAIL), want: listenOtherFailed},
+		{name: "no_errno", err: errors.New("listener already open"), want: listenOtherFailed},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, hint := classifyListenError(tc.err)
+			if got != tc.want {
+				t.Fatalf("classifyListenError(%v) = %q, want %q", tc.err, got, tc.want)
+			}
+			if hint == "" {
+				t.Fatalf("classifyListenError(%v) returned empty hint", tc.err)
+			}
+		})
+	}
+}
+
+func TestClassifyListenErrorRealBind(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+
+	_, err = net.Listen("tcp", ln.Addr().String())
+	if err == nil {
+		t.Fatal("second listen on the same address succeeded")
+	}
+	if got, _ := classifyListenError(err); got != listenAddrInUse {
+		t.Fatalf("classifyListenError(%v) = %q, want %q", err, got, listenAddrInUse)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000000000"
+
+// rotatingFile is an io.Writer that appends to a log file and rotates it by
+// size. Rotated files are renamed to "<path>.<UTC timestamp>" and pruned by
+// count and age. It is safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // bytes; 0 disables size-based rotation
+	maxBackups int           // 0 keeps all backups
+	maxAge     time.Duration // 0 keeps backups regardless of age
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// A failed rotation leaves r.f open, so the line still lands in
+		// the current file and the next write retries.
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Reopen reopens the log file at its path. It is used on SIGHUP so
+// external tools that move the file away (logrotate) keep working
+// alongside native rotation. If the path can't be opened, logging
+// continues to the old file.
+func (r *rotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.open()
+}
+
+// reopenOnHangup reopens r whenever the process receives SIGHUP.
+func reopenOnHangup(r *rotatingFile) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := r.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reopen log file: %v\n", err)
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// open opens r.path for appending and makes it the current file. The
+// previous one, if any, is closed only once the new one is open.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if r.f != nil {
+		_ = r.f.Close()
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file to a timestamped backup and opens a new
+// one at r.path. The old handle stays open across the rename, so when
+// either step fails r.f is still usable.
+func (r *rotatingFile) rotate() error {
+	backup := r.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes backups beyond maxBackups (oldest first) and backups older
+// than maxAge. Errors are ignored; a stale backup is not worth failing a
+// log write over.
+func (r *rotatingFile) prune() {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, r.path+".")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// The timestamp format sorts lexically in chronological order.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, b := range backups {
+		expired := false
+		if r.maxAge > 0 {
+			if info, err := os.Stat(b); err == nil && time.Since(info.ModTime()) > r.maxAge {
+				expired = true
+			}
+		}
+		if expired || (r.maxBackups > 0 && i >= r.maxBackups) {
+			_ = os.Remove(b)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "tailgate.log")
+	r, err := openRotatingFile(path, 10, 2, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close() //nolint:errcheck // test cleanup
+
+	for range 5 {
+		if _, err := r.Write([]byte("123456\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		// Keep backup timestamps distinct.
+		time.Sleep(time.Millisecond)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read current log: %v", err)
+	}
+	if string(data) != "123456\n" {
+		t.Fatalf("expected current log to hold only the last line, got %q", data)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups after pruning, got %v", backups)
+	}
+}
+
+func TestRotatingFilePrunesByAge(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tailgate.log")
+	old := path + "." + time.Now().Add(-48*time.Hour).UTC().Format(backupTimeFormat)
+	if err := os.WriteFile(old, []byte("old\n"), 0o644); err != nil {
+		t.Fatalf("write old backup: %v", err)
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	r, err := openRotatingFile(path, 4, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close() //nolint:errcheck // test cleanup
+	_, _ = r.Write([]byte("abcd"))
+	_, _ = r.Write([]byte("efgh")) // triggers rotation and pruning
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("expected expired backup to be removed, stat err = %v", err)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "tailgate.log")
+	r, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close() //nolint:errcheck // test cleanup
+
+	_, _ = r.Write([]byte("before\n"))
+	// Simulate an external logrotate moving the file away.
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := r.Reopen(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	_, _ = r.Write([]byte("after\n"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read reopened log: %v", err)
+	}
+	if !strings.Contains(string(data), "after") || strings.Contains(string(data), "before") {
+		t.Fatalf("unexpected reopened log contents %q", data)
+	}
+}
+
+func TestRotatingFileReopenFailureKeepsLogging(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "tailgate.log")
+	r, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer r.Close() //nolint:errcheck // test cleanup
+
+	// A directory at the path makes the reopen fail.
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := r.Reopen(); err == nil {
+		t.Fatal("reopen onto a directory succeeded")
+	}
+	if _, err := r.Write([]byte("after\n")); err != nil {
+		t.Fatalf("write after failed reopen: %v", err)
+	}
+
+	data, err := os.ReadFile(path + ".moved")
+	if err != nil {
+		t.Fatalf("read moved log: %v", err)
+	}
+	if string(data) != "after\n" {
+		t.Fatalf("moved log = %q, want the write kept in the old file", data)
+	}
+}
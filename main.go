@@ -2,37 +2,449 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"golang.org/x/time/rate"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
+// version is set with -ldflags "-X main.version=..." for releases. When it
+// is left as "dev", main fills it from the module build info if present.
 var version = "dev"
 
 func main() {
 	hostname := flag.String("hostname", "tailgate", "Tailscale hostname")
 	listen := flag.String("listen", ":1080", "Port to listen on")
 	stateDir := flag.String("state-dir", "", "tsnet state directory")
+	localListen := flag.String("local-listen", "", "Also listen on this host address outside the tailnet (e.g. 127.0.0.1:1080)")
+	flag.IntVar(&listenBacklog, "listen-backlog", 0, "Accept backlog of the -local-listen socket, clamped to net.core.somaxconn; doesn't apply to the tsnet listener or systemd sockets (0 = system default)")
+	localProxyProtocol := flag.String("local-proxy-protocol", "", "Comma-separated CIDRs of upstreams allowed to send a PROXY protocol v1/v2 header on -local-listen")
+	localAdmin := flag.Bool("local-admin", false, "Also answer plain GET requests for admin paths (/healthz, /debug/vars, /recent) on -local-listen")
+	adminListen := flag.String("admin-listen", "", "Serve admin endpoints (/healthz, /debug/vars, /recent) on this tailnet address (off by default)")
+	pprofListen := flag.String("pprof-listen", "", "Serve net/http/pprof on this tailnet address (off by default)")
+
+	flag.DurationVar(&handshakeTimeout, "handshake-timeout", handshakeTimeout, "Maximum time from accept until a tunnel is established, on top of the per-step timeouts (0 = off)")
+	flag.DurationVar(&peekTimeout, "peek-timeout", peekTimeout, "Longest a new connection may take to send its first byte before it is closed as peek_timeout")
+	flag.DurationVar(&silentConnTimeout, "silent-conn-timeout", silentConnTimeout, "Close connections that send nothing for this long, counting them as silent_conn; recently active sources and PROXY-forwarded clients get the full -peek-timeout (0 = off; every connection gets -peek-timeout)")
+	flag.DurationVar(&resolverTimeout, "resolver-timeout", 0, "Maximum time for one target DNS lookup; timeouts get 504 for HTTP CONNECT (0 = bounded only by the dial timeout)")
+	flag.DurationVar(&tunnelWriteTimeout, "write-timeout", 0, "Fail a tunnel when one side accepts no bytes of a relay write for this long, even while the other direction is busy; slow but steady writes are never cut off (0 = only the 5m idle timeout applies)")
+	flag.DurationVar(&targetCloseProbe, "target-close-probe", 0, "After dialing, wait this long for the target to close before reporting success (0 = off)")
+	flag.StringVar(&shutdownMode, "shutdown-mode", shutdownMode, "On shutdown, drain (wait for open tunnels, up to 10s) or immediate (close them at once)")
+	maxProcessLifetime := flag.Duration("max-process-lifetime", 0, "Gracefully shut down after running this long so a supervisor restarts tailgate (0 = never)")
+	tailnetSampleInterval := flag.Duration("tailnet-sample-interval", 30*time.Second, "How often to sample tailnet peer status into /debug/vars when -admin-listen is set (0 disables)")
+
+	acceptRate := flag.Int("accept-rate", 0, "Maximum new connections admitted per second across all listeners; bursts are delayed up to 250ms, then dropped (0 = unlimited)")
+	perHostMaxConns := flag.Int("per-host-max-conns", 0, "Maximum concurrent tunnels per destination host (0 = unlimited)")
+	perUserMaxConns := flag.Int("per-user-max-conns", 0, "Maximum concurrent tunnels per tailnet user (login name) across all their devices (0 = unlimited)")
+	maxConns := flag.Int("max-conns", 0, "Maximum concurrent client connections across all listeners; more SOCKS5 connections are closed and HTTP ones get 503 (0 = unlimited)")
+	reserveSOCKS := flag.Int("reserve-socks", 0, "Slots of -max-conns only SOCKS5 connections may use, so bulk HTTP CONNECT can't take them all")
+	reserveHTTP := flag.Int("reserve-http", 0, "Slots of -max-conns only HTTP connections may use")
+	maxDialing := flag.Int("max-dialing", 0, "Maximum outbound dials in progress at once; more are rejected with 503 (0 = unlimited)")
+	flag.Float64Var(&fdShedThreshold, "fd-shed-threshold", 0, "Close new connections while open file descriptors are at or above this fraction of the soft limit, e.g. 0.9 (0 = never shed)")
+	memShedMB := flag.Int("mem-shed-limit", 0, "Close new connections while the heap and stacks in use reach this many megabytes (0 = never shed)")
+	memCheckInterval := flag.Duration("mem-check-interval", 5*time.Second, "How often -mem-shed-limit samples memory in use")
+	memShedCloseIdle := flag.Bool("mem-shed-close-idle", false, "While over -mem-shed-limit, also close the tunnels idle longest, up to 16 per check")
+	recentEventCount := flag.Int("recent-events", 256, "Number of recent connection events kept for the admin /recent endpoint (0 disables)")
+	topTargetCount := flag.Int("top-targets", 0, "Publish the N targets with the most tunnels as top_targets in /debug/vars, and log them every -top-targets-window (0 disables)")
+	topTargetsWindow := flag.Duration("top-targets-window", 5*time.Minute, "Rolling window -top-targets counts tunnels over")
+	topTalkerCount := flag.Int("top-talkers", 0, "Publish the N open tunnels relaying the most bytes per second over -top-talkers-window as top_talkers in /debug/vars and at admin /talkers (0 disables)")
+	topTalkersWindow := flag.Duration("top-talkers-window", 10*time.Second, "Sliding window -top-talkers measures throughput over")
+	maxDNSInflight := flag.Int("max-dns-inflight", 0, "Maximum concurrent DNS lookups for targets (0 = unlimited)")
+	dnsQueueTimeout := flag.Duration("dns-queue-timeout", 2*time.Second, "How long a lookup waits for a slot under -max-dns-inflight")
+	flag.IntVar(&maxHeaderCount, "max-header-count", maxHeaderCount, "Most header lines accepted in a request on the proxy port, not counting Host; more get 431 (0 = limited only by the 8KB request size)")
+
+	flag.BoolVar(&useBuiltinSOCKS, "builtin-socks", useBuiltinSOCKS, "Use the minimal built-in SOCKS5 handler (CONNECT only) instead of go-socks5")
+	flag.StringVar(&socksBindFamily, "socks-bind-family", socksBindFamily, "Address family of BND.ADDR in SOCKS5 replies: auto (the node's tailnet IPv4 address), 4, 6, or client (the client connection's family)")
+	flag.StringVar(&dialStrategy, "dial-strategy", dialStrategy, "Which resolved target address to try first: first, random, or roundrobin")
+	flag.Func("egress-profile", "Define an egress profile as `name=source-ip`, selectable per CONNECT with the X-Tailgate-Egress header; a profile named \"default\" applies when the header is absent (repeatable)", func(s string) error {
+		return addEgressProfile(egressProfiles, s)
+	})
+	flag.Func("egress-rule", "Route tunnels to targets matching a host pattern through an egress profile, as `pattern=profile` (\"*.eu.example.com=eu\", \"10.0.0.0/8=direct\"); the first matching rule wins and X-Tailgate-Egress overrides it (repeatable)", func(s string) error {
+		r, err := parseEgressRule(s)
+		if err == nil {
+			egressRules = append(egressRules, r)
+		}
+		return err
+	})
+	flag.StringVar(&nameSuffix, "name-suffix", "", "DNS suffix appended to single-label target names before resolution (e.g. example.ts.net)")
+	trustedProxyList := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose X-Forwarded-For sets the client address logged for HTTP CONNECT (logs only; limits and grants use the immediate peer)")
+	healthCheckList := flag.String("health-check-from", "", "Comma-separated CIDRs of L4 health checkers; their connections get -health-check-banner and are closed without protocol detection")
+	flag.StringVar(&healthCheckBanner, "health-check-banner", "", "Line written to -health-check-from connections before closing them (empty = close at once)")
+	flag.Func("health-path", "Answer this HTTP health check on the proxy port with 200 instead of 405: a `/path` (GET and HEAD), \"METHOD /path\", or \"OPTIONS *\" (repeatable)", func(s string) error {
+		return addHealthRequest(healthRequests, s)
+	})
+	flag.BoolVar(&denyPrivate, "deny-private", false, "Refuse tunnels to loopback, private, link-local (incl. cloud metadata), unspecified and multicast addresses, including IPv4-mapped IPv6 forms")
+	flag.BoolVar(&strictHost, "strict-host", false, "Reject HTTP CONNECT requests whose Host header names a different target than the request line with 400")
+	flag.BoolVar(&connectUDP, "connect-udp", false, "Proxy UDP via RFC 9298 CONNECT-UDP requests upgraded over HTTP/1.1 (experimental; no HTTP/3)")
+	flag.BoolVar(&tunnelNoDelay, "nodelay", true, "Set TCP_NODELAY on both sides of TCP tunnels; false re-enables Nagle's algorithm for bulk transfers (tailnet client connections are unaffected)")
+	webOnly := flag.Bool("web-only", false, "Only allow tunnels to ports 80 and 443, plus any in -web-only-ports")
+	webOnlyExtra := flag.String("web-only-ports", "", "Comma-separated extra destination ports allowed under -web-only (e.g. 8443)")
+	requireTLSList := flag.String("require-tls-ports", "", "Comma-separated destination ports whose HTTP CONNECT tunnels must start with a TLS handshake (e.g. 443)")
+	requireProtoList := flag.String("require-protocols", "", "Comma-separated port=protocol pairs (tls, ssh, http) whose tunnels are closed unless the client's first bytes match, e.g. 443=tls,22=ssh")
+	tlsProbeList := flag.String("tls-probe-targets", "", "Comma-separated host[:port] targets whose HTTP CONNECT succeeds only after a TLS handshake with the target does; failures get 502")
+	prewarmList := flag.String("prewarm", "", "Comma-separated host[:port]=N targets to keep N idle connections open to, handed to CONNECTs for them instead of dialing, e.g. db.internal:5432=4")
+	flag.Func("connect-response-header", "Add a `Name: value` header to the 200 reply to HTTP CONNECT (repeatable)", func(s string) error {
+		return addConnectResponseHeader(connectResponseHeader, s)
+	})
+	allowedLabelList := flag.String("allowed-labels", "", "Comma-separated X-Tailgate-Label values to accept (and count in tunnels_by_label); others are ignored (default: any valid label)")
+	flag.IntVar(&maxLabelLen, "label-max-len", maxLabelLen, "Longest X-Tailgate-Label value accepted for tagging a tunnel's access log record")
+
+	socksUsersFile := flag.String("socks-users-file", "", "Require SOCKS5 username/password auth against this file of `user:password` lines (needs -builtin-socks)")
+	grantCap := flag.String("grant-cap", "", "Require peers to hold this app capability in a tailnet policy grant (e.g. example.com/cap/tailgate); its values scope allowed targets and peers without it are denied")
+	adminUserList := flag.String("admin-users", "", "Comma-separated tailnet login names allowed to POST /pause and /resume on -admin-listen (default: nobody)")
+
 	verbose := flag.Bool("verbose", false, "Enable verbose logging")
+	flag.BoolVar(&logSNI, "log-sni", logSNI, "Log the TLS server name (SNI) clients send inside HTTP CONNECT tunnels")
+	flag.BoolVar(&logResolvedIP, "log-resolved-ip", logResolvedIP, "Log the IP address dialed (resolved_ip) in the access log record of tunnels to host names")
+	logFile := flag.String("log-file", "", "Write logs to this file instead of stderr")
+	logMaxSize := flag.Int("log-max-size", 0, "Rotate -log-file when it reaches this many megabytes (0 = never)")
+	logMaxBackups := flag.Int("log-max-backups", 0, "Rotated log files to keep (0 = all)")
+	logMaxAge := flag.Duration("log-max-age", 0, "Delete rotated log files older than this (0 = never)")
+	accessLogBuffer := flag.Int("access-log-buffer", 0, "Queue up to this many access log records for a background writer, dropping records when full (0 = write synchronously)")
+	flag.Float64Var(&accessLogSample, "log-sample", 1, "Fraction of normally closed tunnels whose access log record is written, e.g. 0.1; others are always logged (1 = all)")
+	flag.StringVar(&captureDir, "capture-dir", "", "Write a copy of the bytes of tunnels matching -capture-filter to files in this directory (debugging only; off by default)")
+	captureFilterSpec := flag.String("capture-filter", "", "Tunnels to capture with -capture-dir: client=<ip or CIDR> or target=<host[:port]>")
+	netflowCollector := flag.String("netflow-collector", "", "Send an IPFIX flow record for each direction of every tunnel to this UDP collector address (off by default)")
+
 	showVersion := flag.Bool("version", false, "Print version and exit")
+	showVersionJSON := flag.Bool("version-json", false, "Print version and build metadata as JSON and exit")
 	flag.Parse()
 
+	build := currentBuildInfo(version)
+	version = build.Version
 	if *showVersion {
 		fmt.Println(version)
 		return
 	}
+	if *showVersionJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(build); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write version: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	perHostLimiter = newConnLimiter(*perHostMaxConns)
+	perUserLimiter = newConnLimiter(*perUserMaxConns)
+	grantCapability = tailcfg.PeerCapability(*grantCap)
+	dialingLimiter = newConnLimiter(*maxDialing)
+	if *reserveSOCKS < 0 || *reserveHTTP < 0 || (*reserveSOCKS+*reserveHTTP > 0 && *reserveSOCKS+*reserveHTTP > *maxConns) {
+		fmt.Fprintf(os.Stderr, "invalid -reserve-socks %d and -reserve-http %d: together they must fit within -max-conns %d\n", *reserveSOCKS, *reserveHTTP, *maxConns)
+		os.Exit(2)
+	}
+	connSlots = newSlotPool(*maxConns, map[string]int{"socks5": *reserveSOCKS, "http": *reserveHTTP})
+	acceptLimiter = newAcceptLimiter(*acceptRate)
+	recentEvents = newEventRing(*recentEventCount)
+	targetCounts = newTargetCounter(*topTargetCount, *topTargetsWindow)
+	tunnelRates = newRateTracker(*topTalkerCount, *topTalkersWindow)
+	dnsLimiter = newResolveLimiter(*maxDNSInflight, *dnsQueueTimeout)
+	nameSuffix = strings.Trim(nameSuffix, ".")
+	if !validDialStrategy(dialStrategy) {
+		fmt.Fprintf(os.Stderr, "invalid -dial-strategy %q: want first, random, or roundrobin\n", dialStrategy)
+		os.Exit(2)
+	}
+	if !validSOCKSBindFamily(socksBindFamily) {
+		fmt.Fprintf(os.Stderr, "invalid -socks-bind-family %q: want auto, 4, 6, or client\n", socksBindFamily)
+		os.Exit(2)
+	}
+	if *socksUsersFile != "" {
+		if !useBuiltinSOCKS {
+			fmt.Fprintln(os.Stderr, "invalid -socks-users-file: requires -builtin-socks")
+			os.Exit(2)
+		}
+		creds, err := loadSOCKSCredentials(*socksUsersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -socks-users-file: %v\n", err)
+			os.Exit(2)
+		}
+		socksCredentials = creds
+	}
+	if accessLogSample < 0 || accessLogSample > 1 {
+		fmt.Fprintf(os.Stderr, "invalid -log-sample %v: want a fraction between 0 and 1\n", accessLogSample)
+		os.Exit(2)
+	}
+	if fdShedThreshold < 0 || fdShedThreshold > 1 {
+		fmt.Fprintf(os.Stderr, "invalid -fd-shed-threshold %v: want a fraction between 0 and 1\n", fdShedThreshold)
+		os.Exit(2)
+	}
+	if *memShedMB < 0 || *memCheckInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -mem-shed-limit %d or -mem-check-interval %v: want a non-negative limit and a positive interval\n", *memShedMB, *memCheckInterval)
+		os.Exit(2)
+	}
+	memShedLimit = uint64(*memShedMB) << 20
+	if memShedLimit > 0 && *memShedCloseIdle {
+		shedTunnels = newTunnelSet()
+	}
+	if err := checkEgressRules(egressRules, egressProfiles); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -egress-rule: %v\n", err)
+		os.Exit(2)
+	}
+	if tunnelWriteTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -write-timeout %v: want a positive duration, or 0 to disable\n", tunnelWriteTimeout)
+		os.Exit(2)
+	}
+	if peekTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -peek-timeout %v: want a positive duration\n", peekTimeout)
+		os.Exit(2)
+	}
+	if listenBacklog < 0 || listenBacklog > maxListenBacklog {
+		fmt.Fprintf(os.Stderr, "invalid -listen-backlog %d: want 0 to %d\n", listenBacklog, maxListenBacklog)
+		os.Exit(2)
+	}
+	if !validShutdownMode(shutdownMode) {
+		fmt.Fprintf(os.Stderr, "invalid -shutdown-mode %q: want drain or immediate\n", shutdownMode)
+		os.Exit(2)
+	}
+	var err error
+	if trustedProxies, err = parsePrefixList(*trustedProxyList); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -trusted-proxies: %v\n", err)
+		os.Exit(2)
+	}
+	if healthCheckFrom, err = parsePrefixList(*healthCheckList); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -health-check-from: %v\n", err)
+		os.Exit(2)
+	}
+	proxyProtocolFrom, err := parsePrefixList(*localProxyProtocol)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -local-proxy-protocol: %v\n", err)
+		os.Exit(2)
+	}
+	extraPorts, err := parsePortList(*webOnlyExtra)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -web-only-ports: %v\n", err)
+		os.Exit(2)
+	}
+	if len(extraPorts) > 0 && !*webOnly {
+		fmt.Fprintln(os.Stderr, "-web-only-ports requires -web-only")
+		os.Exit(2)
+	}
+	if *webOnly {
+		allowedPorts = webOnlyPorts(extraPorts)
+	}
+	if requiredProtocols, err = parseRequiredProtocols(*requireProtoList); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -require-protocols: %v\n", err)
+		os.Exit(2)
+	}
+	tlsPorts, err := parsePortList(*requireTLSList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -require-tls-ports: %v\n", err)
+		os.Exit(2)
+	}
+	if len(tlsPorts) > 0 {
+		tlsRequiredPorts = make(map[int]bool, len(tlsPorts))
+		for _, p := range tlsPorts {
+			tlsRequiredPorts[p] = true
+		}
+	}
+	adminUsers = parseAdminUsers(*adminUserList)
+	if *allowedLabelList != "" {
+		labels, invalid := parseLabelList(*allowedLabelList)
+		if len(invalid) > 0 {
+			fmt.Fprintf(os.Stderr, "invalid -allowed-labels %q: labels are 1-%d of A-Z a-z 0-9 . _ -\n", invalid, maxLabelLen)
+			os.Exit(2)
+		}
+		allowedLabels = labels
+	}
+	if probeTargets, err := parseTLSProbeTargets(*tlsProbeList); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -tls-probe-targets: %v\n", err)
+		os.Exit(2)
+	} else if len(probeTargets) > 0 {
+		tlsProbeTargets = probeTargets
+	}
+	if warmPools, err = parseWarmPools(*prewarmList); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -prewarm: %v\n", err)
+		os.Exit(2)
+	}
+	if (captureDir == "") != (*captureFilterSpec == "") {
+		fmt.Fprintln(os.Stderr, "-capture-dir and -capture-filter must be set together")
+		os.Exit(2)
+	}
+	if captureDir != "" {
+		if captureFilter, err = parseTunnelFilter(*captureFilterSpec); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -capture-filter: %v\n", err)
+			os.Exit(2)
+		}
+		if err := os.MkdirAll(captureDir, 0o700); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create -capture-dir: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *pprofListen != "" && samePort(*pprofListen, *listen) {
+		fmt.Fprintln(os.Stderr, "-pprof-listen must not use the proxy port")
+		os.Exit(2)
+	}
+	if *adminListen != "" && samePort(*adminListen, *listen) {
+		fmt.Fprintln(os.Stderr, "-admin-listen must not use the proxy port")
+		os.Exit(2)
+	}
 
 	level := slog.LevelInfo
 	if *verbose {
 		level = slog.LevelDebug
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	var logOut io.Writer = os.Stderr
+	if *logFile != "" {
+		rf, err := openRotatingFile(*logFile, int64(*logMaxSize)<<20, *logMaxBackups, *logMaxAge)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open -log-file: %v\n", err)
+			os.Exit(1)
+		}
+		defer rf.Close() //nolint:errcheck // best-effort cleanup
+		go reopenOnHangup(rf)
+		logOut = rf
+	}
+	logger := slog.New(slog.NewTextHandler(logOut, &slog.HandlerOptions{Level: level}))
 	slog.SetDefault(logger)
+	if *accessLogBuffer > 0 {
+		al := newAsyncLog(*accessLogBuffer)
+		defer al.Close()
+		accessLogger = slog.New(al.handler(logger.Handler()))
+	}
+	if *netflowCollector != "" {
+		fe, err := newFlowExporter(*netflowCollector)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -netflow-collector: %v\n", err)
+			os.Exit(2)
+		}
+		defer fe.Close()
+		flows = fe
+	}
+	if captureDir != "" {
+		slog.Warn("tunnel capture enabled; matching tunnel contents are written to disk", "dir", captureDir, "filter", *captureFilterSpec)
+	}
+
+	socksImpl := "go-socks5"
+	if useBuiltinSOCKS {
+		socksImpl = "builtin"
+	}
+	proxyAuth := "none"
+	if len(socksCredentials) > 0 {
+		proxyAuth = "socks5-userpass"
+	}
+	slog.Info(
+		"effective configuration",
+		"hostname", *hostname,
+		"state_dir", *stateDir,
+		slog.Group("listeners",
+			"listen", *listen,
+			"local_listen", *localListen,
+			"listen_backlog", listenBacklog,
+			"local_admin", *localAdmin,
+			"local_proxy_protocol", *localProxyProtocol,
+			"admin_listen", *adminListen,
+			"pprof_listen", *pprofListen,
+		),
+		slog.Group("timeouts",
+			"handshake", handshakeTimeout,
+			"protocol_peek", peekTimeout,
+			"silent_conn", silentConnTimeout,
+			"connect_read", connectReadTimeout,
+			"dial", connectDialTimeout,
+			"resolver", resolverTimeout,
+			"tunnel_idle", tunnelIdleTimeout,
+			"tunnel_write", tunnelWriteTimeout,
+			"target_close_probe", targetCloseProbe,
+			"shutdown_mode", shutdownMode,
+			"shutdown_drain", shutdownDrainTimeout,
+			"max_process_lifetime", *maxProcessLifetime,
+			"tailnet_sample_interval", *tailnetSampleInterval,
+		),
+		slog.Group("limits",
+			"accept_rate", *acceptRate,
+			"per_host_max_conns", *perHostMaxConns,
+			"per_user_max_conns", *perUserMaxConns,
+			"max_conns", *maxConns,
+			"reserve_socks", *reserveSOCKS,
+			"reserve_http", *reserveHTTP,
+			"max_dialing", *maxDialing,
+			"fd_shed_threshold", fdShedThreshold,
+			"mem_shed_limit_mb", *memShedMB,
+			"mem_check_interval", *memCheckInterval,
+			"mem_shed_close_idle", shedTunnels != nil,
+			"recent_events", *recentEventCount,
+			"top_targets", *topTargetCount,
+			"top_targets_window", *topTargetsWindow,
+			"top_talkers", *topTalkerCount,
+			"top_talkers_window", *topTalkersWindow,
+			"max_dns_inflight", *maxDNSInflight,
+			"dns_queue_timeout", *dnsQueueTimeout,
+			"max_connect_request_bytes", maxConnectRequestBytes,
+			"max_header_count", maxHeaderCount,
+		),
+		slog.Group("proxy",
+			"socks5", socksImpl,
+			"socks_bind_family", socksBindFamily,
+			"dial_mode", "direct",
+			"dial_strategy", dialStrategy,
+			"egress_profiles", egressProfiles,
+			"egress_rules", egressRules,
+			"name_suffix", nameSuffix,
+			"trusted_proxies", *trustedProxyList,
+			"health_check_from", *healthCheckList,
+			"health_check_banner", healthCheckBanner,
+			"health_paths", slices.Sorted(maps.Keys(healthRequests)),
+			"deny_private", denyPrivate,
+			"strict_host", strictHost,
+			"connect_udp", connectUDP,
+			"nodelay", tunnelNoDelay,
+			"web_only", *webOnly,
+			"web_only_ports", extraPorts,
+			"require_tls_ports", tlsPorts,
+			"require_protocols", *requireProtoList,
+			"tls_probe_targets", *tlsProbeList,
+			"prewarm", *prewarmList,
+			"connect_response_header", connectResponseHeader,
+			"allowed_labels", *allowedLabelList,
+			"label_max_len", maxLabelLen,
+		),
+		slog.Group("auth",
+			"proxy_auth", proxyAuth,
+			"socks_users", len(socksCredentials),
+			"grant_cap", grantCapability,
+			"admin_users", slices.Sorted(maps.Keys(adminUsers)),
+			"ts_authkey", setOrUnset(os.Getenv("TS_AUTHKEY")),
+		),
+		slog.Group("logging",
+			"level", level.String(),
+			"sni", logSNI,
+			"resolved_ip", logResolvedIP,
+			"file", *logFile,
+			"max_size_mb", *logMaxSize,
+			"max_backups", *logMaxBackups,
+			"max_age", *logMaxAge,
+			"access_log_buffer", *accessLogBuffer,
+			"log_sample", accessLogSample,
+			"capture_dir", captureDir,
+			"capture_filter", *captureFilterSpec,
+			"netflow_collector", *netflowCollector,
+		),
+	)
+
+	localLns, err := openLocalListeners(*localListen)
+	if err != nil {
+		exitListenError("failed to open local listener", "local_listen", *localListen, err)
+	}
+
+	if *stateDir != "" {
+		if reason, hint, err := checkStateDir(*stateDir); err != nil {
+			exitStateDirError(*stateDir, reason, hint, err)
+		}
+	}
 
 	tsServer := &tsnet.Server{
 		Hostname: *hostname,
@@ -45,6 +457,8 @@ func main() {
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	ctx, cancelLifetime := withMaxLifetime(ctx, *maxProcessLifetime, lifetimeWarningLead, logger)
+	defer cancelLifetime()
 
 	status, err := tsServer.Up(ctx)
 	if err != nil {
@@ -54,6 +468,13 @@ func main() {
 	tailscaleIP := ""
 	if len(status.TailscaleIPs) > 0 {
 		tailscaleIP = status.TailscaleIPs[0].String()
+		socksBindIP = status.TailscaleIPs[0]
+	}
+	for _, ip := range status.TailscaleIPs {
+		if ip.Is6() {
+			socksBindIP6 = ip
+			break
+		}
 	}
 	slog.Info(
 		"tailgate started",
@@ -61,19 +482,210 @@ func main() {
 		"tailscale_ip", tailscaleIP,
 		"listen", *listen,
 		"version", version,
+		"commit", build.Commit,
 	)
 
 	ln, err := tsServer.Listen("tcp", *listen)
 	if err != nil {
-		slog.Error("failed to listen", "listen", *listen, "error", err)
+		exitListenError("failed to listen", "listen", *listen, err)
+	}
+	var wg sync.WaitGroup
+	if *pprofListen != "" {
+		pprofLn, err := tsServer.Listen("tcp", *pprofListen)
+		if err != nil {
+			exitListenError("failed to listen for pprof", "pprof_listen", *pprofListen, err)
+		}
+		slog.Info("serving pprof", "pprof_listen", *pprofListen)
+		wg.Go(func() {
+			serveHTTPUntilDone(ctx, pprofLn, newPprofMux(), logger)
+		})
+	}
+
+	if *adminListen != "" {
+		adminLn, err := tsServer.Listen("tcp", *adminListen)
+		if err != nil {
+			exitListenError("failed to listen for admin", "admin_listen", *adminListen, err)
+		}
+		slog.Info("serving admin endpoints", "admin_listen", *adminListen)
+		adminMux := newAdminMux()
+		adminMux.Handle("/probe", newProbeHandler(rate.NewLimiter(rate.Every(probeRateLimit), probeBurst)))
+		adminMux.Handle("/pause", newPauseHandler(true, logger))
+		adminMux.Handle("/resume", newPauseHandler(false, logger))
+		wg.Go(func() {
+			serveHTTPUntilDone(ctx, adminLn, adminMux, logger)
+		})
+
+		if *tailnetSampleInterval > 0 {
+			lc, err := tsServer.LocalClient()
+			if err != nil {
+				slog.Error("failed to get tsnet local client", "error", err)
+				os.Exit(1)
+			}
+			wg.Go(func() {
+				sampleTailnet(ctx, *tailnetSampleInterval, lc.Status, logger)
+			})
+		}
+	}
+
+	if *perUserMaxConns > 0 || len(adminUsers) > 0 {
+		lc, err := tsServer.LocalClient()
+		if err != nil {
+			slog.Error("failed to get tsnet local client", "error", err)
+			os.Exit(1)
+		}
+		whoIsLogin = func(ctx context.Context, remoteAddr string) (string, error) {
+			who, err := lc.WhoIs(ctx, remoteAddr)
+			if err != nil {
+				return "", err
+			}
+			return who.UserProfile.LoginName, nil
+		}
+	}
+	if grantCapability != "" {
+		lc, err := tsServer.LocalClient()
+		if err != nil {
+			slog.Error("failed to get tsnet local client", "error", err)
+			os.Exit(1)
+		}
+		whoIsCaps = func(ctx context.Context, remoteAddr string) (tailcfg.PeerCapMap, error) {
+			who, err := lc.WhoIs(ctx, remoteAddr)
+			if err != nil {
+				return nil, err
+			}
+			return who.CapMap, nil
+		}
+	}
+
+	selfEndpoints = make(map[netip.AddrPort]bool)
+	addSelf := func(addr string, ips []netip.Addr) {
+		eps, err := listenEndpoints(addr, ips)
+		if err != nil {
+			slog.Warn("cannot protect admin endpoint from tunnels", "addr", addr, "error", err)
+			return
+		}
+		for _, ep := range eps {
+			selfEndpoints[ep] = true
+		}
+	}
+	for _, addr := range []string{*adminListen, *pprofListen} {
+		if addr != "" {
+			addSelf(addr, status.TailscaleIPs)
+		}
+	}
+	if *localAdmin {
+		for _, l := range localLns {
+			addSelf(l.Addr().String(), hostIPs())
+		}
+	}
+
+	if accessLogSample < 1 {
+		wg.Go(func() {
+			logSampledOut(ctx, logger)
+		})
+	}
+
+	if soft, hard, ok := fdLimits(); ok {
+		logger.Info("file descriptor limit", "soft", soft, "hard", hard)
+	}
+	if fdShedThreshold > 0 {
+		if _, ok := openFDCount(); !ok {
+			logger.Warn("cannot count open file descriptors on this platform; -fd-shed-threshold only applies after a dial fails with EMFILE")
+		}
+		wg.Go(func() {
+			watchFDUsage(ctx, fdShedThreshold, logger)
+		})
+	}
+
+	if memShedLimit > 0 {
+		wg.Go(func() {
+			watchMemory(ctx, memShedLimit, *memCheckInterval, logger)
+		})
+	}
+
+	for _, p := range warmPools {
+		wg.Go(func() {
+			p.run(ctx, logger)
+		})
+	}
+
+	if targetCounts != nil {
+		wg.Go(func() {
+			logTopTargets(ctx, targetCounts, logger)
+		})
+	}
+
+	listeners := append([]net.Listener{ln}, localLns...)
+
+	serveLC, err := tsServer.LocalClient()
+	if err != nil {
+		slog.Error("failed to get tsnet local client", "error", err)
 		os.Exit(1)
 	}
-	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	proxyPorts := listenerPorts(listeners)
+	wg.Go(func() {
+		watchServeExposure(ctx, serveLC.GetServeConfig, proxyPorts, logger)
+	})
+
+	opts := make(map[net.Listener]listenerOptions, len(listeners))
+	for _, l := range localLns {
+		slog.Info("serving local listener", "addr", l.Addr().String(), "inline_admin", *localAdmin, "proxy_protocol", len(proxyProtocolFrom) > 0)
+		o := listenerOptions{proxyProtocolFrom: proxyProtocolFrom}
+		if *localAdmin {
+			o.admin = newAdminMux()
+		}
+		opts[l] = o
+	}
 
 	go func() {
 		<-ctx.Done()
-		_ = ln.Close()
+		for _, l := range listeners {
+			_ = l.Close()
+		}
 	}()
 
-	serve(ctx, ln, logger)
+	for _, l := range listeners {
+		wg.Go(func() {
+			defer l.Close() //nolint:errcheck // best-effort cleanup
+			serve(ctx, l, opts[l], logger)
+		})
+	}
+	wg.Wait()
+}
+
+// setOrUnset reports whether a secret is configured without revealing it.
+func setOrUnset(secret string) string {
+	if secret == "" {
+		return "unset"
+	}
+	return "set"
+}
+
+// openLocalListeners returns the OS-level listeners served alongside the
+// tsnet listener. Sockets inherited via systemd socket activation take
+// precedence over -local-listen, so systemd can own the bind.
+func openLocalListeners(addr string) ([]net.Listener, error) {
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		if addr != "" {
+			slog.Warn("using systemd socket activation; ignoring -local-listen", "local_listen", addr)
+		}
+		return inherited, nil
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if listenBacklog > 0 {
+		if err := applyListenBacklog(ln); err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+	return []net.Listener{ln}, nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memShedLimit, when positive, is the memory in use (bytes of heap and
+// stacks) at which serve starts closing new connections, so an overload
+// ends in refused connections rather than an OOM kill.
+var memShedLimit uint64
+
+// memShedding is set while serve is shedding new connections for lack of
+// memory.
+var memShedding atomic.Bool
+
+// memShedClosed counts tunnels closed by -mem-shed-close-idle.
+var memShedClosed = expvar.NewInt("mem_shed_closed")
+
+// Tunnels -mem-shed-close-idle may close: at most memShedBatch per check,
+// idlest first, of those idle for at least memShedMinIdle so live traffic
+// is left alone.
+const (
+	memShedBatch   = 16
+	memShedMinIdle = 10 * time.Second
+)
+
+// errMemoryShed is the cancel cause of tunnels closed to recover memory.
+var errMemoryShed = errors.New("closed to recover memory")
+
+// shedTunnels holds the open tunnels for -mem-shed-close-idle. nil (the
+// default) tracks nothing.
+var shedTunnels *tunnelSet
+
+// memInUse returns the bytes of heap and goroutine stacks in use, nearly
+// all of what tailgate allocates for tunnels.
+var memInUse = func() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse + ms.StackInuse
+}
+
+func init() {
+	expvar.Publish("memory", expvar.Func(func() any {
+		return map[string]any{"limit": memShedLimit, "shedding": memShedding.Load()}
+	}))
+}
+
+// tunnelSet tracks open tunnels so the idlest can be closed.
+type tunnelSet struct {
+	mu      sync.Mutex
+	tunnels map[*shedTunnel]struct{}
+}
+
+type shedTunnel struct {
+	client, target *idleTimeoutConn
+	cancel         context.CancelCauseFunc
+}
+
+func newTunnelSet() *tunnelSet {
+	return &tunnelSet{tunnels: make(map[*shedTunnel]struct{})}
+}
+
+// add tracks a tunnel until the returned func is called; cancel ends it.
+// A nil set tracks nothing.
+func (s *tunnelSet) add(client, target *idleTimeoutConn, cancel context.CancelCauseFunc) (remove func()) {
+	if s == nil {
+		return func() {}
+	}
+	t := &shedTunnel{client: client, target: target, cancel: cancel}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels[t] = struct{}{}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.tunnels, t)
+	}
+}
+
+// closeIdlest closes up to n tunnels that have been idle for at least
+// minIdle, idlest first, and returns how many it closed.
+func (s *tunnelSet) closeIdlest(n int, minIdle time.Duration, now time.Time) int {
+	if s == nil {
+		return 0
+	}
+	type candidate struct {
+		t    *shedTunnel
+		last time.Time
+	}
+	var idle []candidate
+	s.mu.Lock()
+	for t := range s.tunnels {
+		last := t.client.lastActive()
+		if l := t.target.lastActive(); l.After(last) {
+			last = l
+		}
+		if now.Sub(last) >= minIdle {
+			idle = append(idle, candidate{t, last})
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(idle, func(a, b candidate) int { return a.last.Compare(b.last) })
+	idle = idle[:min(len(idle), n)]
+	for _, c := range idle {
+		c.t.cancel(errMemoryShed)
+	}
+	return len(idle)
+}
+
+// watchMemory checks memory in use every interval until ctx is done,
+// setting memShedding while it is at or above limit.
+func watchMemory(ctx context.Context, limit uint64, interval time.Duration, logger *slog.Logger) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		checkMemory(limit, logger)
+	}
+}
+
+// checkMemory takes one memory sample for watchMemory. While over limit it
+// also closes the idlest tunnels in shedTunnels.
+func checkMemory(limit uint64, logger *slog.Logger) {
+	inUse := memInUse()
+	shed := inUse >= limit
+	if memShedding.Swap(shed) != shed {
+		if shed {
+			logger.Warn("memory limit reached; closing new connections", "in_use_bytes", inUse, "limit_bytes", limit)
+		} else {
+			logger.Info("memory use recovered; accepting connections", "in_use_bytes", inUse, "limit_bytes", limit)
+		}
+	}
+	if !shed {
+		return
+	}
+	if n := shedTunnels.closeIdlest(memShedBatch, memShedMinIdle, time.Now()); n > 0 {
+		memShedClosed.Add(int64(n))
+		logger.Warn("closed idle tunnels to recover memory", "tunnels", n, "in_use_bytes", inUse, "limit_bytes", limit)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelSetCloseIdlest(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	s := newTunnelSet()
+	causes := make(map[string]error)
+	open := func(name string, idle time.Duration) func() {
+		client, target := &idleTimeoutConn{}, &idleTimeoutConn{}
+		client.lastReset.Store(now.Add(-idle).UnixNano())
+		target.lastReset.Store(now.Add(-idle).UnixNano())
+		return s.add(client, target, func(err error) { causes[name] = err })
+	}
+	open("busy", time.Second)
+	open("idle", time.Minute)
+	open("idlest", time.Hour)
+	remove := open("gone", 2*time.Hour)
+	remove()
+
+	if n := s.closeIdlest(1, 10*time.Second, now); n != 1 {
+		t.Fatalf("closeIdlest(1) closed %d, want 1", n)
+	}
+	if causes["idlest"] != errMemoryShed || len(causes) != 1 {
+		t.Fatalf("closed %v, want only the idlest tunnel", causes)
+	}
+	if n := s.closeIdlest(16, 10*time.Second, now); n != 2 {
+		t.Fatalf("closeIdlest(16) closed %d, want the 2 idle tunnels again", n)
+	}
+	if _, ok := causes["busy"]; ok {
+		t.Fatal("closed a tunnel active within the minimum idle time")
+	}
+
+	var nilSet *tunnelSet
+	nilSet.add(nil, nil, nil)()
+	if n := nilSet.closeIdlest(1, 0, now); n != 0 {
+		t.Fatalf("nil set closed %d tunnels", n)
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	// Not parallel: mutates the package-level memInUse, memShedding, and
+	// shedTunnels.
+	origInUse, origTunnels := memInUse, shedTunnels
+	defer func() {
+		memInUse, shedTunnels = origInUse, origTunnels
+		memShedding.Store(false)
+	}()
+	shedTunnels = newTunnelSet()
+	idle := &idleTimeoutConn{}
+	idle.lastReset.Store(time.Now().Add(-time.Hour).UnixNano())
+	var cause error
+	shedTunnels.add(idle, idle, func(err error) { cause = err })
+
+	var buf syncBuffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	memInUse = func() uint64 { return 2 << 20 }
+	checkMemory(1<<20, logger)
+	if !memShedding.Load() || cause != errMemoryShed {
+		t.Fatalf("over the limit: shedding %v, idle tunnel cause %v; want shedding and the tunnel closed", memShedding.Load(), cause)
+	}
+	if !strings.Contains(buf.String(), "memory limit reached") {
+		t.Fatalf("log = %q, want a warning when shedding starts", buf.String())
+	}
+
+	memInUse = func() uint64 { return 512 << 10 }
+	checkMemory(1<<20, logger)
+	if memShedding.Load() {
+		t.Fatal("still shedding under the limit")
+	}
+	if !strings.Contains(buf.String(), "memory use recovered") {
+		t.Fatalf("log = %q, want a message when shedding stops", buf.String())
+	}
+}
+
+func TestRelayMemoryShedReason(t *testing.T) {
+	// Not parallel: mutates the package-level shedTunnels.
+	orig := shedTunnels
+	shedTunnels = newTunnelSet()
+	defer func() { shedTunnels = orig }()
+
+	clientConn, clientPeer := net.Pipe()
+	targetConn, targetPeer := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer targetConn.Close() //nolint:errcheck // test cleanup
+
+	var logs syncBuffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(context.Background(), clientPeer, targetPeer, slog.New(slog.NewTextHandler(&logs, nil)), "http-connect", "100.64.0.1:5000", "example.com:443")
+	}()
+
+	// Wait for the relay to register, then close it as idle.
+	for deadline := time.Now().Add(3 * time.Second); shedTunnels.closeIdlest(1, 0, time.Now()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("relay never registered its tunnel")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay did not end after being shed")
+	}
+	if !strings.Contains(logs.String(), "reason=memory-shed") {
+		t.Fatalf("access log = %q, want reason=memory-shed", logs.String())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Counters are published through expvar and served at /debug/vars on the
+// admin listener; updating them is cheap enough for the relay hot path.
+var (
+	connectionsTotal   = expvar.NewInt("connections_total")
+	connectionsActive  = expvar.NewInt("connections_active")
+	bytesProxied       = expvar.NewMap("bytes_proxied") // keyed by direction
+	errorsByType       = expvar.NewMap("errors")
+	tunnelResets       = expvar.NewInt("tunnel_resets")
+	tunnelIdleTimeouts = expvar.NewInt("tunnel_idle_timeouts")
+	tunnelCloseReasons = expvar.NewMap("tunnel_close_reasons")
+	tunnelsByLabel     = expvar.NewMap("tunnels_by_label") // only -allowed-labels
+
+	immediateCloseTargets = expvar.NewInt("immediate_close_targets")
+	accessLogDropped      = expvar.NewInt("access_log_dropped")
+	accessLogSampledOut   = expvar.NewInt("access_log_sampled_out")
+	flowExportErrors      = expvar.NewInt("flow_export_errors")
+	prewarmConns          = expvar.NewMap("prewarm") // only -prewarm
+	healthChecks          = expvar.NewInt("health_checks")
+	peekExtended          = expvar.NewInt("peek_extended")
+)
+
+// Keys for bytesProxied.
+const (
+	bytesClientToTarget = "client_to_target"
+	bytesTargetToClient = "target_to_client"
+)
+
+func countError(kind string) {
+	errorsByType.Add(kind, 1)
+}
+
+// errorKindForStatus names the error counter for a failed CONNECT read.
+func errorKindForStatus(status int) string {
+	if status == http.StatusRequestHeaderFieldsTooLarge {
+		return "request_too_large"
+	}
+	return "malformed_request"
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// flows, when non-nil, exports a flow record for each direction of every
+// tunnel. main sets it from -netflow-collector.
+var flows *flowExporter
+
+// flowBatchSize is how many records are queued before a message is sent
+// early; with IPv6 records it keeps each message under a typical MTU.
+const flowBatchSize = 20
+
+// flowFlushInterval is how often queued records are sent regardless of
+// batch size.
+const flowFlushInterval = time.Second
+
+// IPFIX (RFC 7011) constants. Each message repeats the templates, so a
+// collector that restarts or drops a packet can decode the next one.
+const (
+	ipfixVersion      = 10
+	ipfixTemplateSet  = 2
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+	ipfixProtocolTCP  = 6
+	ipfixProtocolUDP  = 17
+)
+
+// ipfixField is an information element identifier and its length.
+type ipfixField struct{ id, length uint16 }
+
+var (
+	ipfixFieldsIPv4 = []ipfixField{
+		{8, 4},   // sourceIPv4Address
+		{12, 4},  // destinationIPv4Address
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{1, 8},   // octetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+	}
+	ipfixFieldsIPv6 = []ipfixField{
+		{27, 16}, // sourceIPv6Address
+		{28, 16}, // destinationIPv6Address
+		{7, 2},
+		{11, 2},
+		{4, 1},
+		{1, 8},
+		{152, 8},
+		{153, 8},
+	}
+)
+
+// flowRecord is one direction of a tunnel.
+type flowRecord struct {
+	src, dst   netip.AddrPort
+	bytes      uint64
+	start, end time.Time
+	udp        bool // a CONNECT-UDP tunnel; the rest are TCP
+}
+
+// tunnelFlows returns the two flow records for a tunnel: client to target
+// and target to client. It returns nil when either address isn't an
+// IP:port, such as a pipe in tests.
+func tunnelFlows(client, target net.Addr, up, down int64, start, end time.Time) []flowRecord {
+	c, t := flowAddr(client), flowAddr(target)
+	if !c.IsValid() || !t.IsValid() {
+		return nil
+	}
+	_, udp := target.(*net.UDPAddr)
+	return []flowRecord{
+		{src: c, dst: t, bytes: uint64(max(up, 0)), start: start, end: end, udp: udp},
+		{src: t, dst: c, bytes: uint64(max(down, 0)), start: start, end: end, udp: udp},
+	}
+}
+
+func flowAddr(a net.Addr) netip.AddrPort {
+	if a == nil {
+		return netip.AddrPort{}
+	}
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port())
+}
+
+// flowExporter batches flow records and sends them to a collector as
+// IPFIX messages over UDP.
+type flowExporter struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	pending []flowRecord
+	seq     uint32 // data records sent so far, per RFC 7011
+	closed  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newFlowExporter starts exporting to the UDP collector address.
+func newFlowExporter(collector string) (*flowExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	e := &flowExporter{conn: conn, stop: make(chan struct{}), done: make(chan struct{})}
+	go e.run()
+	return e, nil
+}
+
+func (e *flowExporter) run() {
+	defer close(e.done)
+	t := time.NewTicker(flowFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-t.C:
+			e.mu.Lock()
+			e.flushLocked()
+			e.mu.Unlock()
+		}
+	}
+}
+
+// add queues records, sending a message once flowBatchSize are pending.
+// It does nothing on a nil exporter.
+func (e *flowExporter) add(recs ...flowRecord) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.pending = append(e.pending, recs...)
+	if len(e.pending) >= flowBatchSize {
+		e.flushLocked()
+	}
+}
+
+func (e *flowExporter) flushLocked() {
+	for len(e.pending) > 0 {
+		n := min(len(e.pending), flowBatchSize)
+		msg := encodeIPFIX(e.pending[:n], e.seq, time.Now())
+		if _, err := e.conn.Write(msg); err != nil {
+			flowExportErrors.Add(1)
+		}
+		e.seq += uint32(n)
+		e.pending = e.pending[n:]
+	}
+	e.pending = nil
+}
+
+// Close sends any queued records and stops the exporter.
+func (e *flowExporter) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.flushLocked()
+	e.mu.Unlock()
+	close(e.stop)
+	<-e.done
+	_ = e.conn.Close()
+}
+
+// encodeIPFIX builds one IPFIX message carrying both templates and a data
+// set per address family, in observation domain 0. Records whose
+// endpoints differ in family are sent as IPv6 with IPv4-mapped addresses.
+func encodeIPFIX(recs []flowRecord, seq uint32, now time.Time) []byte {
+	var v4, v6 []flowRecord
+	for _, r := range recs {
+		if r.src.Addr().Is4() && r.dst.Addr().Is4() {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+
+	msg := make([]byte, 16, 1500)
+	binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], seq)
+
+	msg = appendSet(msg, ipfixTemplateSet, func(b []byte) []byte {
+		b = appendTemplate(b, ipfixTemplateIPv4, ipfixFieldsIPv4)
+		return appendTemplate(b, ipfixTemplateIPv6, ipfixFieldsIPv6)
+	})
+	if len(v4) > 0 {
+		msg = appendSet(msg, ipfixTemplateIPv4, func(b []byte) []byte {
+			for _, r := range v4 {
+				b = appendFlow(b, r, 4)
+			}
+			return b
+		})
+	}
+	if len(v6) > 0 {
+		msg = appendSet(msg, ipfixTemplateIPv6, func(b []byte) []byte {
+			for _, r := range v6 {
+				b = appendFlow(b, r, 16)
+			}
+			return b
+		})
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	return msg
+}
+
+// appendSet appends a set header for id, the body written by fill, and the
+// set's length.
+func appendSet(b []byte, id uint16, fill func([]byte) []byte) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b, 0, 0) // length, filled in below
+	b = fill(b)
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+func appendTemplate(b []byte, id uint16, fields []ipfixField) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint16(b, f.id)
+		b = binary.BigEndian.AppendUint16(b, f.length)
+	}
+	return b
+}
+
+// appendFlow appends r in the field order of the templates, with addresses
+// of addrLen bytes.
+func appendFlow(b []byte, r flowRecord, addrLen int) []byte {
+	for _, a := range []netip.Addr{r.src.Addr(), r.dst.Addr()} {
+		if addrLen == 4 {
+			ip := a.As4()
+			b = append(b, ip[:]...)
+		} else {
+			ip := a.As16()
+			b = append(b, ip[:]...)
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, r.src.Port())
+	b = binary.BigEndian.AppendUint16(b, r.dst.Port())
+	proto := byte(ipfixProtocolTCP)
+	if r.udp {
+		proto = ipfixProtocolUDP
+	}
+	b = append(b, proto)
+	b = binary.BigEndian.AppendUint64(b, r.bytes)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	return binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// ipfixIPv4RecordLen is the size of one record in the IPv4 template.
+const ipfixIPv4RecordLen = 4 + 4 + 2 + 2 + 1 + 8 + 8 + 8
+
+// ipfixSets splits an IPFIX message into its sets, keyed by set ID.
+func ipfixSets(t *testing.T, msg []byte) map[uint16][]byte {
+	t.Helper()
+	if len(msg) < 16 {
+		t.Fatalf("message too short: %d bytes", len(msg))
+	}
+	if v := binary.BigEndian.Uint16(msg); v != ipfixVersion {
+		t.Fatalf("version = %d, want %d", v, ipfixVersion)
+	}
+	if n := binary.BigEndian.Uint16(msg[2:]); int(n) != len(msg) {
+		t.Fatalf("header length = %d, message is %d bytes", n, len(msg))
+	}
+	sets := make(map[uint16][]byte)
+	for rest := msg[16:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			t.Fatalf("truncated set header: %x", rest)
+		}
+		id, n := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		if n < 4 || n > len(rest) {
+			t.Fatalf("set %d length %d out of range", id, n)
+		}
+		sets[id] = rest[4:n]
+		rest = rest[n:]
+	}
+	return sets
+}
+
+func TestEncodeIPFIX(t *testing.T) {
+	t.Parallel()
+
+	start := time.UnixMilli(1_700_000_000_000)
+	end := start.Add(1500 * time.Millisecond)
+	recs := []flowRecord{
+		{src: netip.MustParseAddrPort("100.64.0.2:51000"), dst: netip.MustParseAddrPort("93.184.216.34:443"), bytes: 1234, start: start, end: end},
+		{src: netip.MustParseAddrPort("100.64.0.2:51000"), dst: netip.MustParseAddrPort("[2001:db8::1]:443"), bytes: 5, start: start, end: end},
+	}
+	msg := encodeIPFIX(recs, 42, end)
+	if seq := binary.BigEndian.Uint32(msg[8:]); seq != 42 {
+		t.Fatalf("sequence = %d, want 42", seq)
+	}
+	sets := ipfixSets(t, msg)
+
+	// Two templates of 8 fields each: 4 bytes of header plus 4 per field.
+	if n := len(sets[ipfixTemplateSet]); n != 2*(4+4*8) {
+		t.Fatalf("template set is %d bytes", n)
+	}
+	v4 := sets[ipfixTemplateIPv4]
+	if len(v4) != ipfixIPv4RecordLen {
+		t.Fatalf("IPv4 data set is %d bytes, want one record", len(v4))
+	}
+	if src := netip.AddrFrom4([4]byte(v4[0:4])); src != recs[0].src.Addr() {
+		t.Errorf("source address = %v", src)
+	}
+	if sp, dp := binary.BigEndian.Uint16(v4[8:]), binary.BigEndian.Uint16(v4[10:]); sp != 51000 || dp != 443 {
+		t.Errorf("ports = %d -> %d", sp, dp)
+	}
+	if proto, bytes := v4[12], binary.BigEndian.Uint64(v4[13:]); proto != ipfixProtocolTCP || bytes != 1234 {
+		t.Errorf("protocol %d, bytes %d", proto, bytes)
+	}
+	if s, e := binary.BigEndian.Uint64(v4[21:]), binary.BigEndian.Uint64(v4[29:]); s != uint64(start.UnixMilli()) || e != uint64(end.UnixMilli()) {
+		t.Errorf("times = %d..%d", s, e)
+	}
+
+	// The mixed-family record goes out as IPv6 with a mapped client.
+	v6 := sets[ipfixTemplateIPv6]
+	if len(v6) != 16+16+2+2+1+8+8+8 {
+		t.Fatalf("IPv6 data set is %d bytes, want one record", len(v6))
+	}
+	if src := netip.AddrFrom16([16]byte(v6[0:16])); src.Unmap() != recs[1].src.Addr() {
+		t.Errorf("mapped source address = %v", src)
+	}
+}
+
+func TestTunnelFlows(t *testing.T) {
+	t.Parallel()
+
+	client := &net.TCPAddr{IP: net.ParseIP("100.64.0.2"), Port: 51000}
+	target := &net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 22}
+	now := time.Now()
+	recs := tunnelFlows(client, target, 10, 20, now, now)
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	if recs[0].src.String() != "100.64.0.2:51000" || recs[0].dst.String() != "10.0.0.1:22" || recs[0].bytes != 10 {
+		t.Errorf("forward record = %+v", recs[0])
+	}
+	if recs[1].src != recs[0].dst || recs[1].dst != recs[0].src || recs[1].bytes != 20 {
+		t.Errorf("reverse record = %+v", recs[1])
+	}
+
+	if recs := tunnelFlows(pipeAddr{}, target, 1, 1, now, now); recs != nil {
+		t.Fatalf("records for a non-IP address: %+v", recs)
+	}
+}
+
+func TestFlowExporterSendsBatches(t *testing.T) {
+	t.Parallel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close() //nolint:errcheck // test cleanup
+	_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	e, err := newFlowExporter(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("newFlowExporter: %v", err)
+	}
+	now := time.Now()
+	rec := flowRecord{src: netip.MustParseAddrPort("100.64.0.2:1"), dst: netip.MustParseAddrPort("10.0.0.1:80"), bytes: 1, start: now, end: now}
+
+	// A full batch is sent right away; the remainder waits for Close.
+	for range flowBatchSize + 1 {
+		e.add(rec)
+	}
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read first message: %v", err)
+	}
+	if got := len(ipfixSets(t, buf[:n])[ipfixTemplateIPv4]) / ipfixIPv4RecordLen; got != flowBatchSize {
+		t.Fatalf("first message has %d records, want %d", got, flowBatchSize)
+	}
+
+	e.Close()
+	n, _, err = pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read message flushed by Close: %v", err)
+	}
+	if seq := binary.BigEndian.Uint32(buf[8:]); seq != flowBatchSize {
+		t.Fatalf("second message sequence = %d, want %d", seq, flowBatchSize)
+	}
+	if got := len(ipfixSets(t, buf[:n])[ipfixTemplateIPv4]) / ipfixIPv4RecordLen; got != 1 {
+		t.Fatalf("second message has %d records, want 1", got)
+	}
+
+	// Records after Close are dropped.
+	e.add(rec)
+	var nilExporter *flowExporter
+	nilExporter.add(rec)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+)
+
+// tunnelNoDelay is passed to SetNoDelay on both TCP sides of every tunnel.
+// Go disables Nagle's algorithm by default, which suits interactive
+// tunnels such as SSH; turning it back on lets bulk transfers send fewer,
+// fuller segments.
+var tunnelNoDelay = true
+
+// applyNoDelay sets tunnelNoDelay on conn when it sits on a *net.TCPConn.
+// Tailnet connections from tsnet are userspace TCP and have no such
+// option, so they are left alone.
+func applyNoDelay(conn net.Conn, side string, logger *slog.Logger) {
+	tc := tcpConnOf(conn)
+	if tc == nil {
+		return
+	}
+	if err := tc.SetNoDelay(tunnelNoDelay); err != nil {
+		logger.Debug("failed to set TCP_NODELAY", "remote", remoteAddr(conn), "side", side, "error", err)
+		return
+	}
+	logger.Debug("set TCP_NODELAY", "remote", remoteAddr(conn), "side", side, "nodelay", tunnelNoDelay)
+}
+
+// tcpConnOf returns the *net.TCPConn under tailgate's own connection
+// wrappers, or nil if there isn't one.
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *peekedConn:
+			conn = c.Conn
+		case *prefixedConn:
+			conn = c.Conn
+		case *proxiedConn:
+			conn = c.Conn
+		case *sniConn:
+			conn = c.Conn
+		case *capsuleConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
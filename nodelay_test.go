@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestTCPConnOfUnwraps(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // test cleanup
+
+	var wrapped net.Conn = &proxiedConn{Conn: conn}
+	wrapped = &peekedConn{Reader: bufio.NewReader(wrapped), Conn: wrapped}
+	wrapped = &prefixedConn{Conn: wrapped, prefix: []byte("x")}
+	if got := tcpConnOf(wrapped); got != conn {
+		t.Fatalf("tcpConnOf = %v, want the underlying *net.TCPConn", got)
+	}
+
+	pipe, other := net.Pipe()
+	defer pipe.Close()  //nolint:errcheck // test cleanup
+	defer other.Close() //nolint:errcheck // test cleanup
+	if got := tcpConnOf(&prefixedConn{Conn: pipe}); got != nil {
+		t.Fatalf("tcpConnOf(pipe) = %v, want nil", got)
+	}
+}
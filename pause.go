@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// acceptPaused, while set, makes serve close every new connection as soon
+// as it is accepted. Listeners stay open and established tunnels are left
+// alone, so maintenance can be started and ended without a restart.
+var acceptPaused atomic.Bool
+
+func init() {
+	expvar.Publish("accept_paused", expvar.Func(func() any { return acceptPaused.Load() }))
+}
+
+// adminUsers holds the tailnet login names allowed to POST /pause and
+// /resume, from -admin-users. With none, every such request is refused:
+// reaching the admin listener isn't enough to stop the proxy.
+var adminUsers map[string]bool
+
+// parseAdminUsers parses the comma-separated -admin-users list.
+func parseAdminUsers(s string) map[string]bool {
+	var users map[string]bool
+	for field := range strings.SplitSeq(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if users == nil {
+			users = make(map[string]bool)
+		}
+		users[field] = true
+	}
+	return users
+}
+
+// authorizeAdmin returns the tailnet login of the peer making r, or an
+// error unless it is one of adminUsers.
+func authorizeAdmin(r *http.Request) (string, error) {
+	if len(adminUsers) == 0 {
+		return "", errors.New("no -admin-users configured")
+	}
+	if whoIsLogin == nil {
+		return "", errors.New("peer identity unavailable")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), whoIsTimeout)
+	defer cancel()
+	user, err := whoIsLogin(ctx, r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	if !adminUsers[user] {
+		return user, errors.New("not in -admin-users")
+	}
+	return user, nil
+}
+
+// newPauseHandler returns the admin handler for POST /pause (paused) or
+// POST /resume, for adminUsers only. /healthz answers 503 while paused, so
+// load balancers drain the node.
+func newPauseHandler(paused bool, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		user, err := authorizeAdmin(r)
+		if err != nil {
+			countError("admin_denied")
+			logger.Warn("refusing unauthorized admin request", "remote", r.RemoteAddr, "path", r.URL.Path, "user", user, "error", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if acceptPaused.Swap(paused) != paused {
+			if paused {
+				logger.Warn("pausing new connections by admin request", "remote", r.RemoteAddr, "user", user)
+			} else {
+				logger.Info("resuming new connections by admin request", "remote", r.RemoteAddr, "user", user)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, pauseState()+"\n")
+	}
+}
+
+func pauseState() string {
+	if acceptPaused.Load() {
+		return "paused"
+	}
+	return "accepting"
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	// Not parallel: mutates the package-level acceptPaused, adminUsers, and
+	// whoIsLogin.
+	origUsers, origWhoIs := adminUsers, whoIsLogin
+	defer func() {
+		adminUsers, whoIsLogin = origUsers, origWhoIs
+		acceptPaused.Store(false)
+	}()
+	adminUsers = parseAdminUsers("ops@example.com")
+	whoIsLogin = fakeWhoIs("ops@example.com")
+
+	mux := newAdminMux()
+	mux.Handle("/pause", newPauseHandler(true, slog.New(slog.DiscardHandler)))
+	mux.Handle("/resume", newPauseHandler(false, slog.New(slog.DiscardHandler)))
+	admin := func(method, path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(context.Background(), ln, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+	defer func() { _ = ln.Close(); <-served }()
+	request := func() string {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		defer conn.Close() //nolint:errcheck // test cleanup
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+
+	if code, _ := admin(http.MethodGet, "/pause"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /pause = %d, want 405", code)
+	}
+	if acceptPaused.Load() {
+		t.Fatal("GET /pause changed the pause state")
+	}
+
+	if code, body := admin(http.MethodPost, "/pause"); code != http.StatusOK || body != "paused\n" {
+		t.Fatalf("POST /pause = %d %q", code, body)
+	}
+	if code, body := admin(http.MethodGet, "/healthz"); code != http.StatusServiceUnavailable || body != "paused\n" {
+		t.Fatalf("/healthz while paused = %d %q, want 503", code, body)
+	}
+	if resp := request(); resp != "" {
+		t.Fatalf("connection while paused got %q, want it closed unanswered", resp)
+	}
+
+	if code, body := admin(http.MethodPost, "/resume"); code != http.StatusOK || body != "accepting\n" {
+		t.Fatalf("POST /resume = %d %q", code, body)
+	}
+	if code, _ := admin(http.MethodGet, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz after resume = %d, want 200", code)
+	}
+	if resp := request(); !strings.HasPrefix(resp, "HTTP/1.1 400") {
+		t.Fatalf("connection after resume got %q, want the proxy's 400", resp)
+	}
+}
+
+func TestPauseRequiresAdminUser(t *testing.T) {
+	// Not parallel: mutates the package-level adminUsers and whoIsLogin.
+	origUsers, origWhoIs := adminUsers, whoIsLogin
+	defer func() {
+		adminUsers, whoIsLogin = origUsers, origWhoIs
+		acceptPaused.Store(false)
+	}()
+
+	pause := newPauseHandler(true, slog.New(slog.DiscardHandler))
+	for _, tc := range []struct {
+		name  string
+		users string
+		whoIs func(context.Context, string) (string, error)
+	}{
+		{"no -admin-users", "", fakeWhoIs("ops@example.com")},
+		{"no identity lookup", "ops@example.com", nil},
+		{"unidentified peer", "ops@example.com", fakeWhoIs("")},
+		{"other user", "ops@example.com", fakeWhoIs("mallory@example.com")},
+	} {
+		adminUsers, whoIsLogin = parseAdminUsers(tc.users), tc.whoIs
+		rec := httptest.NewRecorder()
+		pause.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pause", nil))
+		if rec.Code != http.StatusForbidden || acceptPaused.Load() {
+			t.Errorf("%s: POST /pause = %d, paused %v; want 403 and still accepting", tc.name, rec.Code, acceptPaused.Load())
+		}
+	}
+}
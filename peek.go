@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// peekTimeout is the longest a new connection may take to send its first
+// byte before it is closed and counted as peek_timeout. With
+// silentConnTimeout set, most connections get only that, and peekTimeout
+// is for those showing signs of an active client.
+var peekTimeout = 10 * time.Second
+
+// recentClients remembers the sources whose connections recently got past
+// protocol detection.
+var recentClients = newSourceSet(recentClientTTL, maxRecentClients)
+
+// A source stays in recentClients for recentClientTTL after its last
+// detected connection. The set holds at most maxRecentClients sources, so
+// a flood of sources costs bounded memory; beyond that, new sources just
+// aren't remembered.
+const (
+	recentClientTTL  = 10 * time.Minute
+	maxRecentClients = 4096
+)
+
+// sourceSet is a bounded set of client IPs that expire ttl after they
+// were last added.
+type sourceSet struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	expires map[netip.Addr]time.Time
+}
+
+func newSourceSet(ttl time.Duration, max int) *sourceSet {
+	return &sourceSet{ttl: ttl, max: max, expires: make(map[netip.Addr]time.Time)}
+}
+
+// add records the source of conn at now. When the set is full it first
+// drops expired sources, then gives up if none were.
+func (s *sourceSet) add(conn net.Conn, now time.Time) {
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.expires[ip]; !ok && len(s.expires) >= s.max {
+		for src, exp := range s.expires {
+			if !now.Before(exp) {
+				delete(s.expires, src)
+			}
+		}
+		if len(s.expires) >= s.max {
+			return
+		}
+	}
+	s.expires[ip] = now.Add(s.ttl)
+}
+
+// contains reports whether the source of conn was added within ttl of now.
+func (s *sourceSet) contains(conn net.Conn, now time.Time) bool {
+	ip, ok := addrIP(conn.RemoteAddr())
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.expires[ip]
+	return ok && now.Before(exp)
+}
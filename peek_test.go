@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSourceSet(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	peer := func(ip string) net.Conn {
+		return remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+	}
+	s := newSourceSet(time.Minute, 2)
+	s.add(peer("100.64.0.1"), now)
+	if !s.contains(peer("100.64.0.1"), now.Add(30*time.Second)) {
+		t.Fatal("source not remembered within its ttl")
+	}
+	if s.contains(peer("100.64.0.1"), now.Add(time.Minute)) {
+		t.Fatal("source still remembered after its ttl")
+	}
+	if s.contains(peer("100.64.0.2"), now) {
+		t.Fatal("contains = true for a source never added")
+	}
+
+	// Full: a new source is dropped until an old one expires.
+	s.add(peer("100.64.0.2"), now)
+	s.add(peer("100.64.0.3"), now)
+	if s.contains(peer("100.64.0.3"), now) {
+		t.Fatal("source added past max")
+	}
+	s.add(peer("100.64.0.3"), now.Add(2*time.Minute))
+	if !s.contains(peer("100.64.0.3"), now.Add(2*time.Minute)) {
+		t.Fatal("source not added after the expired ones were dropped")
+	}
+
+	s.add(remoteAddrConn{remote: pipeAddr{}}, now)
+	if s.contains(remoteAddrConn{remote: pipeAddr{}}, now) {
+		t.Fatal("contains = true for an address without an IP")
+	}
+}
+
+func TestHandleConnExtendsPeekForRecentClient(t *testing.T) {
+	// Not parallel: mutates the package-level silentConnTimeout,
+	// peekTimeout, and recentClients.
+	origSilent, origPeek, origRecent := silentConnTimeout, peekTimeout, recentClients
+	defer func() { silentConnTimeout, peekTimeout, recentClients = origSilent, origPeek, origRecent }()
+	silentConnTimeout, peekTimeout = 50*time.Millisecond, 300*time.Millisecond
+	recentClients = newSourceSet(time.Minute, 16)
+
+	start := func() (net.Conn, chan struct{}) {
+		clientConn, serverConn := net.Pipe()
+		peer := remoteAddrConn{Conn: serverConn, remote: &net.TCPAddr{IP: net.ParseIP("100.64.0.7"), Port: 40000}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleConn(context.Background(), peer, listenerOptions{}, slog.New(slog.DiscardHandler))
+		}()
+		return clientConn, done
+	}
+
+	// A source seen before may stay silent past -silent-conn-timeout.
+	recentClients.add(remoteAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("100.64.0.7")}}, time.Now())
+	extended := peekExtended.Value()
+	clientConn, done := start()
+	time.Sleep(150 * time.Millisecond)
+	_ = clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := clientConn.Write([]byte{0x00}); err != nil {
+		t.Fatalf("first byte after the silent window: %v; want the peek extended", err)
+	}
+	<-done
+	_ = clientConn.Close()
+	if got := peekExtended.Value() - extended; got != 1 {
+		t.Fatalf("peek_extended grew by %d, want 1", got)
+	}
+
+	// Even so, it is closed once -peek-timeout runs out.
+	before := errorCount("peek_timeout")
+	began := time.Now()
+	clientConn, done = start()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler held a silent connection past -peek-timeout")
+	}
+	if elapsed := time.Since(began); elapsed < peekTimeout {
+		t.Fatalf("closed after %v, before -peek-timeout %v", elapsed, peekTimeout)
+	}
+	if got := errorCount("peek_timeout") - before; got != 1 {
+		t.Fatalf("peek_timeout grew by %d, want 1", got)
+	}
+}
+
+// errorCount returns the errors counter for kind.
+func errorCount(kind string) int64 {
+	if n, ok := errorsByType.Get(kind).(*expvar.Int); ok {
+		return n.Value()
+	}
+	return 0
+}
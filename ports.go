@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// allowedPorts, when non-nil, is the set of destination ports tunnels may
+// reach; everything else is refused (403 for HTTP CONNECT, "not allowed by
+// ruleset" for SOCKS5). nil allows every port.
+var allowedPorts map[int]bool
+
+// webPorts are always allowed under -web-only.
+var webPorts = []int{80, 443}
+
+// webOnlyPorts returns the -web-only allowlist: the web ports plus extra.
+func webOnlyPorts(extra []int) map[int]bool {
+	ports := make(map[int]bool, len(webPorts)+len(extra))
+	for _, p := range webPorts {
+		ports[p] = true
+	}
+	for _, p := range extra {
+		ports[p] = true
+	}
+	return ports
+}
+
+// parsePortList parses a comma-separated list of TCP ports.
+func parsePortList(s string) ([]int, error) {
+	var ports []int
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		p, err := strconv.ParseUint(field, 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		ports = append(ports, int(p))
+	}
+	return ports, nil
+}
+
+// portAllowed reports whether a tunnel may be opened to port.
+func portAllowed(port int) bool {
+	return allowedPorts == nil || allowedPorts[port]
+}
+
+// targetPortAllowed is portAllowed for a "host:port" target.
+func targetPortAllowed(targetAddr string) bool {
+	_, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	return err == nil && portAllowed(port)
+}
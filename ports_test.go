@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestParsePortList(t *testing.T) {
+	t.Parallel()
+
+	got, err := parsePortList(" 8443, 8080 ,,")
+	if err != nil {
+		t.Fatalf("parsePortList: %v", err)
+	}
+	if len(got) != 2 || got[0] != 8443 || got[1] != 8080 {
+		t.Fatalf("parsePortList = %v, want [8443 8080]", got)
+	}
+	for _, bad := range []string{"0", "65536", "http", "-1"} {
+		if _, err := parsePortList(bad); err == nil {
+			t.Fatalf("parsePortList(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestWebOnlyPorts(t *testing.T) {
+	// Not parallel: mutates the package-level allowedPorts.
+	origPorts := allowedPorts
+	defer func() { allowedPorts = origPorts }()
+
+	allowedPorts = nil
+	if !portAllowed(25) {
+		t.Fatal("port 25 blocked with no allowlist")
+	}
+
+	allowedPorts = webOnlyPorts([]int{8443})
+	for _, port := range []int{80, 443, 8443} {
+		if !portAllowed(port) {
+			t.Fatalf("port %d blocked under -web-only with 8443 extra", port)
+		}
+	}
+	for _, port := range []int{22, 25, 8080} {
+		if portAllowed(port) {
+			t.Fatalf("port %d allowed under -web-only", port)
+		}
+	}
+
+	for _, target := range []string{"mail.example.com:25", "127.0.0.1:22"} {
+		statusLine, _ := executeProxyRequest(t, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		if !strings.Contains(statusLine, "403") {
+			t.Fatalf("CONNECT %s under -web-only: got %q, want 403", target, statusLine)
+		}
+	}
+
+	conn, stop := startSOCKSConn(t)
+	defer stop()
+	if rep := socksConnect(t, conn, "127.0.0.1:25"); rep != statute.RepRuleFailure {
+		t.Fatalf("SOCKS CONNECT to port 25 under -web-only: reply %d, want rule failure", rep)
+	}
+
+	builtin, stopBuiltin := startBuiltinSOCKSConn(t)
+	defer stopBuiltin()
+	if rep := socksConnect(t, builtin, "127.0.0.1:25"); rep != socks5RepRuleFailure {
+		t.Fatalf("built-in SOCKS CONNECT to port 25 under -web-only: reply %d, want rule failure", rep)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// newPprofMux returns a mux serving the net/http/pprof handlers. It is
+// separate from http.DefaultServeMux so profiling endpoints only appear on
+// the listener they are explicitly mounted on.
+func newPprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serveHTTPUntilDone serves handler on ln until ctx is done, then shuts the
+// server down. It blocks until the server has stopped.
+func serveHTTPUntilDone(ctx context.Context, ln net.Listener, handler http.Handler, logger *slog.Logger) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: connectReadTimeout,
+		// Requests see ctx, so streams like /events end at shutdown
+		// instead of holding it up.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("http server failed", "addr", ln.Addr().String(), "error", err)
+	}
+	<-stopped
+}
+
+// samePort reports whether two listen addresses use the same port.
+func samePort(a, b string) bool {
+	_, pa, errA := net.SplitHostPort(a)
+	_, pb, errB := net.SplitHostPort(b)
+	return errA == nil && errB == nil && pa == pb
+}
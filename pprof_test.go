@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofMux(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(newPprofMux())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("get pprof index: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // test cleanup
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from pprof index, got %q", resp.Status)
+	}
+}
+
+func TestSamePort(t *testing.T) {
+	t.Parallel()
+
+	if !samePort(":1080", "127.0.0.1:1080") {
+		t.Fatal("expected :1080 and 127.0.0.1:1080 to share a port")
+	}
+	if samePort(":1080", ":6060") {
+		t.Fatal("expected :1080 and :6060 to differ")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmPools, when non-nil, holds pre-established connections to the
+// -prewarm targets, keyed by targetKey. dialTarget hands one out instead
+// of dialing when it can.
+var warmPools map[string]*warmPool
+
+// maxWarmPoolSize bounds the connections kept open for one -prewarm target.
+const maxWarmPoolSize = 16
+
+// warmMaxAge is how long a pooled connection may sit idle before it is
+// closed rather than handed out, since targets and middleboxes drop idle
+// connections.
+var warmMaxAge = 30 * time.Second
+
+// warmCheckInterval is how often each pool health-checks its idle
+// connections and tops itself up.
+var warmCheckInterval = 5 * time.Second
+
+// warmKeepAlive is the TCP keepalive period for pooled connections.
+const warmKeepAlive = 15 * time.Second
+
+// warmAliveWait is how long a health check waits on a pooled connection's
+// read side: long enough to see a pending close or banner, short enough to
+// run on every take.
+const warmAliveWait = time.Millisecond
+
+// maxWarmEarly bounds the unprompted target bytes held for a pooled
+// connection; once it is reached the connection is no longer read.
+const maxWarmEarly = 4 << 10
+
+// warmPool keeps up to size idle connections open to addr.
+type warmPool struct {
+	addr string
+	size int
+
+	refill chan struct{}
+
+	mu     sync.Mutex
+	idle   []warmConn
+	closed bool
+}
+
+type warmConn struct {
+	conn  net.Conn
+	since time.Time
+	early []byte // sent by the target before any client bytes
+}
+
+func newWarmPool(addr string, size int) *warmPool {
+	return &warmPool{addr: addr, size: size, refill: make(chan struct{}, 1)}
+}
+
+// parseWarmPools parses a -prewarm value such as "db.internal:5432=4,api:443=2"
+// into one pool per target; the port defaults to 443 as it does for CONNECT.
+func parseWarmPools(s string) (map[string]*warmPool, error) {
+	var out map[string]*warmPool
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		hostport, sizeStr, ok := strings.Cut(field, "=")
+		size, err := strconv.Atoi(strings.TrimSpace(sizeStr))
+		if !ok || err != nil || size < 1 || size > maxWarmPoolSize {
+			return nil, fmt.Errorf("invalid entry %q: want host:port=N with N from 1 to %d", field, maxWarmPoolSize)
+		}
+		targetAddr, err := connectTarget(hostport)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", field, err)
+		}
+		if out == nil {
+			out = make(map[string]*warmPool)
+		}
+		key := targetKey(targetAddr)
+		out[key] = newWarmPool(key, size)
+	}
+	return out, nil
+}
+
+// takeWarm returns a pooled connection to addr, or nil when addr isn't a
+// -prewarm target or its pool is empty. Dials bound to an egress source
+// never use the pool, whose connections come from the default source.
+func takeWarm(ctx context.Context, addr string) net.Conn {
+	p := warmPools[targetKey(addr)]
+	if p == nil {
+		return nil
+	}
+	if _, bound := egressSource(ctx); bound {
+		return nil
+	}
+	conn := p.take()
+	if conn == nil {
+		prewarmConns.Add("misses", 1)
+		return nil
+	}
+	prewarmConns.Add("hits", 1)
+	return conn
+}
+
+// take removes the newest healthy idle connection, closing any stale or
+// dead ones it passes, and asks run to replace it.
+func (p *warmPool) take() net.Conn {
+	defer p.wake()
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		wc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if !wc.check() {
+			continue
+		}
+		if len(wc.early) > 0 {
+			return &prefixedConn{Conn: wc.conn, prefix: wc.early}
+		}
+		return wc.conn
+	}
+}
+
+func (p *warmPool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps the pool topped up until ctx is done, then closes what it
+// holds.
+func (p *warmPool) run(ctx context.Context, logger *slog.Logger) {
+	defer p.close()
+	ticker := time.NewTicker(warmCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.prune()
+		p.fill(ctx, logger)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.refill:
+		}
+	}
+}
+
+// prune health-checks the idle connections, closing stale and dead ones.
+// Connections are checked outside the lock; a take meanwhile finds the
+// pool empty and dials.
+func (p *warmPool) prune() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	kept := idle[:0]
+	for _, wc := range idle {
+		if wc.check() {
+			kept = append(kept, wc)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		closeWarmConns(kept)
+		return
+	}
+	p.idle = append(kept, p.idle...)
+}
+
+// fill dials until the pool holds size connections. A failed dial is
+// retried on the next check rather than straight away, as are dials while
+// file descriptors are being shed.
+func (p *warmPool) fill(ctx context.Context, logger *slog.Logger) {
+	for !fdShedding.Load() {
+		p.mu.Lock()
+		need := !p.closed && len(p.idle) < p.size
+		p.mu.Unlock()
+		if !need {
+			return
+		}
+		conn, err := dialNetwork(ctx, "tcp", p.addr)
+		if err != nil {
+			if ctx.Err() == nil {
+				prewarmConns.Add("dial_errors", 1)
+				logger.Debug("failed to pre-warm connection", "target", p.addr, "error", err)
+			}
+			return
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: warmKeepAlive, Interval: warmKeepAlive, Count: -1})
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		p.idle = append(p.idle, warmConn{conn: conn, since: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+func (p *warmPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	closeWarmConns(p.idle)
+	p.idle = nil
+}
+
+func closeWarmConns(conns []warmConn) {
+	for _, wc := range conns {
+		_ = wc.conn.Close()
+	}
+}
+
+// check reports whether wc is still fit to hand out, closing it if not. A
+// connection is fit while it is younger than warmMaxAge and the target
+// hasn't closed or reset it; bytes the target sent unprompted, such as an
+// SSH banner, are kept in early for the client.
+func (wc *warmConn) check() bool {
+	if time.Since(wc.since) > warmMaxAge {
+		prewarmConns.Add("expired", 1)
+		_ = wc.conn.Close()
+		return false
+	}
+	if len(wc.early) >= maxWarmEarly {
+		return true
+	}
+	_ = wc.conn.SetReadDeadline(time.Now().Add(warmAliveWait))
+	buf := make([]byte, maxWarmEarly-len(wc.early))
+	n, err := wc.conn.Read(buf)
+	_ = wc.conn.SetReadDeadline(time.Time{})
+	wc.early = append(wc.early, buf[:n]...)
+	var ne net.Error
+	if err == nil || errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	prewarmConns.Add("dead", 1)
+	_ = wc.conn.Close()
+	return false
+}
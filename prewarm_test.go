@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestParseWarmPools(t *testing.T) {
+	t.Parallel()
+
+	pools, err := parseWarmPools(" DB.internal:5432=4, api.example.com=2,")
+	if err != nil {
+		t.Fatalf("parseWarmPools: %v", err)
+	}
+	if len(pools) != 2 || pools["db.internal:5432"].size != 4 || pools["api.example.com:443"].size != 2 {
+		t.Fatalf("pools = %v, want db.internal:5432 of 4 and api.example.com:443 of 2", pools)
+	}
+	if pools, err := parseWarmPools(""); err != nil || pools != nil {
+		t.Fatalf("parseWarmPools(\"\") = %v, %v, want nil", pools, err)
+	}
+	for _, bad := range []string{"db:5432", "db:5432=0", "db:5432=17", "db:5432=x", "db:0=1", "=1"} {
+		if _, err := parseWarmPools(bad); err == nil {
+			t.Errorf("parseWarmPools(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestWarmPool(t *testing.T) {
+	t.Parallel()
+
+	addr, stop := startEchoServer(t)
+	defer stop()
+	logger := slog.New(slog.DiscardHandler)
+
+	p := newWarmPool(addr, 2)
+	p.fill(context.Background(), logger)
+	defer p.close()
+	if len(p.idle) != 2 {
+		t.Fatalf("pool holds %d connections, want 2", len(p.idle))
+	}
+
+	conn := p.take()
+	if conn == nil {
+		t.Fatal("take returned nil from a full pool")
+	}
+	defer conn.Close() //nolint:errcheck // test cleanup
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v, want ping", buf, err)
+	}
+	select {
+	case <-p.refill:
+	default:
+		t.Fatal("take didn't ask for a refill")
+	}
+}
+
+func TestWarmPoolDiscardsDead(t *testing.T) {
+	t.Parallel()
+
+	// The target sends a banner and hangs up on every connection.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+	closed := make(chan struct{}, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(c, "SSH-2.0-test\r\n")
+			_ = c.Close()
+			closed <- struct{}{}
+		}
+	}()
+
+	p := newWarmPool(ln.Addr().String(), 2)
+	p.fill(context.Background(), slog.New(slog.DiscardHandler))
+	defer p.close()
+	<-closed
+	<-closed
+
+	// The banner arrives ahead of the close; give both time to land.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		p.prune()
+		if len(p.idle) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool still holds %d closed connections", len(p.idle))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn := p.take(); conn != nil {
+		t.Fatal("take handed out a closed connection")
+	}
+}
+
+func TestWarmConnKeepsBanner(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer server.Close() //nolint:errcheck // test cleanup
+	go func() { _, _ = io.WriteString(server, "SSH-2.0-test\r\n") }()
+
+	p := newWarmPool("pipe", 1)
+	p.idle = []warmConn{{conn: client, since: time.Now()}}
+	defer p.close()
+
+	conn := p.take()
+	if conn == nil {
+		t.Fatal("take returned nil for a live connection")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+		t.Fatalf("read = %q, %v, want the banner replayed", buf, err)
+	}
+}
+
+func TestWarmConnExpires(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer server.Close() //nolint:errcheck // test cleanup
+
+	p := newWarmPool("pipe", 1)
+	p.idle = []warmConn{{conn: client, since: time.Now().Add(-warmMaxAge - time.Second)}}
+	defer p.close()
+
+	if conn := p.take(); conn != nil {
+		t.Fatal("take handed out a connection older than warmMaxAge")
+	}
+}
+
+func TestSOCKSUsesPrewarmForName(t *testing.T) {
+	// Not parallel: mutates the package-level warmPools and lookupNetIP.
+	echoAddr, stop := startEchoServer(t)
+	defer stop()
+	_, port, _ := net.SplitHostPort(echoAddr)
+	targetAddr := net.JoinHostPort("warm.test", port)
+
+	origPools, origLookup := warmPools, lookupNetIP
+	defer func() { warmPools, lookupNetIP = origPools, origLookup }()
+	lookupNetIP = func(context.Context, string, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}
+	p := newWarmPool(targetKey(targetAddr), 1)
+	p.fill(context.Background(), slog.New(slog.DiscardHandler))
+	defer p.close()
+	warmPools = map[string]*warmPool{p.addr: p}
+
+	// The pool is keyed by the configured name, so a SOCKS5 request naming
+	// it must be looked up by that name, not the address it resolves to.
+	hits := prewarmCount("hits")
+	conn, stopConn := startSOCKSConn(t)
+	defer stopConn()
+	if rep := socksConnect(t, conn, targetAddr); rep != statute.RepSuccess {
+		t.Fatalf("SOCKS connect: reply %d, want success", rep)
+	}
+	if got := prewarmCount("hits") - hits; got != 1 {
+		t.Fatalf("prewarm hits grew by %d, want 1", got)
+	}
+}
+
+// prewarmCount returns the prewarm counter for key.
+func prewarmCount(key string) int64 {
+	if n, ok := prewarmConns.Get(key).(*expvar.Int); ok {
+		return n.Value()
+	}
+	return 0
+}
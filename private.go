@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// errPrivateTarget is returned when -deny-private refuses a target address.
+var errPrivateTarget = errors.New("private destination not allowed")
+
+// denyPrivate, when set, refuses tunnels to loopback, private, link-local
+// (including the 169.254.169.254 cloud metadata service), unspecified and
+// multicast addresses.
+var denyPrivate bool
+
+// isPrivateTarget reports whether ip is in a range denyPrivate refuses.
+// IPv4-mapped IPv6 addresses such as ::ffff:127.0.0.1 reach the IPv4
+// address they embed, so they are unmapped before the checks.
+func isPrivateTarget(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// checkDialAddr returns the error dialTarget fails with before connecting
+// to ap, or nil if the address may be dialed.
+func checkDialAddr(ap netip.AddrPort) error {
+	if isSelfEndpoint(ap) {
+		return errSelfTarget
+	}
+	if denyPrivate && isPrivateTarget(ap.Addr()) {
+		return errPrivateTarget
+	}
+	return nil
+}
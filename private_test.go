@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIsPrivateTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:7f00:1", true}, // hex spelling of the same mapped address
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:192.168.1.1", true},
+		{"::ffff:172.16.0.1", true},
+		{"169.254.169.254", true},
+		{"::ffff:169.254.169.254", true},
+		{"fe80::1%eth0", true},
+		{"fd00:ec2::254", true},
+		{"0.0.0.0", true},
+		{"::ffff:0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.251", true},
+		{"8.8.8.8", false},
+		{"::ffff:8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"100.64.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateTarget(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPrivateTarget(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDialTargetDenyPrivate(t *testing.T) {
+	// Not parallel: mutates the package-level denyPrivate and lookupNetIP.
+	origDeny, origLookup := denyPrivate, lookupNetIP
+	defer func() { denyPrivate, lookupNetIP = origDeny, origLookup }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	port := netip.MustParseAddrPort(targetAddr).Port()
+
+	denyPrivate = false
+	conn, err := dialTarget(context.Background(), targetAddr)
+	if err != nil {
+		t.Fatalf("dialTarget without -deny-private: %v", err)
+	}
+	_ = conn.Close()
+
+	denyPrivate = true
+	lookupNetIP = func(context.Context, string, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("::ffff:127.0.0.1")}, nil
+	}
+	for _, addr := range []string{
+		targetAddr,
+		netip.AddrPortFrom(netip.MustParseAddr("::ffff:127.0.0.1"), port).String(),
+		"rebind.test:443",
+	} {
+		if conn, err := dialTarget(context.Background(), addr); !errors.Is(err, errPrivateTarget) {
+			if conn != nil {
+				_ = conn.Close()
+			}
+			t.Errorf("dialTarget(%q) err = %v, want errPrivateTarget", addr, err)
+		}
+	}
+
+	status, _ := executeProxyRequest(t, "CONNECT [::ffff:169.254.169.254]:80 HTTP/1.1\r\nHost: [::ffff:169.254.169.254]:80\r\n\r\n")
+	if !strings.Contains(status, "403") {
+		t.Fatalf("CONNECT to mapped metadata address status = %q, want 403", status)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// probeResult is the JSON body of a /probe response.
+type probeResult struct {
+	Target     string   `json:"target"`
+	OK         bool     `json:"ok"`
+	Resolved   []string `json:"resolved,omitempty"`
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	LocalAddr  string   `json:"local_addr,omitempty"`
+	Latency    string   `json:"latency"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// probeRateLimit and probeBurst bound how often /probe dials, so the admin
+// endpoint can't be turned into a port scanner.
+const (
+	probeRateLimit = time.Second
+	probeBurst     = 3
+)
+
+// newProbeHandler returns the /probe?target=host:port handler for the
+// admin listener. It dials target the way an HTTP CONNECT from the caller
+// would (port policy, grants, per-host and egress selection, then the
+// dialer with its resolver, private and self-target checks) and
+// reports the outcome without relaying anything. It is not part of
+// inlineAdminPaths, so the proxy port never serves it.
+func newProbeHandler(limiter *rate.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "GET required", http.StatusMethodNotAllowed)
+			return
+		}
+		targetAddr, err := connectTarget(r.URL.Query().Get("target"))
+		if err != nil {
+			http.Error(w, "target must be host[:port]: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !targetPortAllowed(targetAddr) {
+			http.Error(w, "destination port not allowed", http.StatusForbidden)
+			return
+		}
+		if err := checkGrant(r.Context(), r.RemoteAddr, targetAddr); err != nil {
+			http.Error(w, "not granted access to this destination", http.StatusForbidden)
+			return
+		}
+		host, _, _ := net.SplitHostPort(targetAddr)
+		dialCtx := r.Context()
+		if len(egressProfiles) > 0 {
+			src, ok := selectEgress(r.Header.Get(egressHeader), host)
+			if !ok {
+				http.Error(w, "unknown egress profile", http.StatusBadRequest)
+				return
+			}
+			if src.IsValid() {
+				dialCtx = withEgressSource(dialCtx, src)
+			}
+		}
+		if !limiter.Allow() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(probeRateLimit/time.Second)))
+			http.Error(w, "probe rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		release, ok := perHostLimiter.acquire(hostKey(host))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(dialRetryAfterSeconds))
+			http.Error(w, "too many connections to target", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+
+		res := probeResult{Target: targetAddr}
+		if ip, err := netip.ParseAddr(host); err == nil {
+			res.Resolved = []string{ip.String()}
+		} else if ips, err := resolveHost(r.Context(), host); err == nil {
+			for _, ip := range ips {
+				res.Resolved = append(res.Resolved, ip.String())
+			}
+		}
+
+		// Dial for real even for -prewarm targets, which a probe would
+		// otherwise measure by using up a pooled connection.
+		start := time.Now()
+		conn, err := dialNetwork(dialCtx, "tcp", targetAddr)
+		res.Latency = time.Since(start).Round(time.Microsecond).String()
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.OK = true
+			res.RemoteAddr = addrString(conn.RemoteAddr())
+			res.LocalAddr = addrString(conn.LocalAddr())
+			_ = conn.Close()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
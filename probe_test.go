@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/tailcfg"
+)
+
+func probe(t *testing.T, h http.Handler, target string) (*httptest.ResponseRecorder, probeResult) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape(target), nil))
+	var res probeResult
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("decode probe result %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec, res
+}
+
+func TestProbeHandler(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	// A listener closed right away leaves a port that refuses connections.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	h := newProbeHandler(rate.NewLimiter(rate.Inf, 0))
+
+	rec, res := probe(t, h, targetAddr)
+	if rec.Code != http.StatusOK || !res.OK || res.Target != targetAddr || res.LocalAddr == "" || res.Latency == "" {
+		t.Fatalf("probe of reachable target = %d %+v", rec.Code, res)
+	}
+	if len(res.Resolved) != 1 || res.Resolved[0] != "127.0.0.1" {
+		t.Fatalf("resolved = %v, want [127.0.0.1]", res.Resolved)
+	}
+
+	rec, res = probe(t, h, closedAddr)
+	if rec.Code != http.StatusOK || res.OK || res.Error == "" {
+		t.Fatalf("probe of closed port = %d %+v, want ok=false with an error", rec.Code, res)
+	}
+
+	if rec, _ := probe(t, h, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("probe with no target = %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/probe?target="+targetAddr, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /probe = %d, want 405", rec.Code)
+	}
+}
+
+func TestProbeHandlerRateLimit(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	h := newProbeHandler(rate.NewLimiter(rate.Every(time.Hour), 1))
+	if rec, _ := probe(t, h, targetAddr); rec.Code != http.StatusOK {
+		t.Fatalf("first probe = %d, want 200", rec.Code)
+	}
+	rec, _ := probe(t, h, targetAddr)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("second probe = %d (Retry-After %q), want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestProbeHandlerRespectsPortPolicy(t *testing.T) {
+	// Not parallel: mutates the package-level allowedPorts.
+	orig := allowedPorts
+	defer func() { allowedPorts = orig }()
+	allowedPorts = webOnlyPorts(nil)
+
+	h := newProbeHandler(rate.NewLimiter(rate.Inf, 0))
+	if rec, _ := probe(t, h, "127.0.0.1:22"); rec.Code != http.StatusForbidden {
+		t.Fatalf("probe of disallowed port = %d, want 403", rec.Code)
+	}
+}
+
+func TestProbeHandlerRespectsGrants(t *testing.T) {
+	// Not parallel: mutates the package-level grantCapability, whoIsCaps
+	// and egressProfiles.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	h := newProbeHandler(rate.NewLimiter(rate.Inf, 0))
+	grantCaps(t, tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"hosts":["other.example"]}`}}, nil)
+	if rec, _ := probe(t, h, targetAddr); rec.Code != http.StatusForbidden {
+		t.Fatalf("probe of ungranted target = %d, want 403", rec.Code)
+	}
+
+	var peer string
+	whoIsCaps = func(_ context.Context, remote string) (tailcfg.PeerCapMap, error) {
+		peer = remote
+		return tailcfg.PeerCapMap{"example.com/cap/tailgate": {`{"hosts":["127.0.0.1"]}`}}, nil
+	}
+	if rec, res := probe(t, h, targetAddr); rec.Code != http.StatusOK || !res.OK {
+		t.Fatalf("probe of granted target = %d %+v, want ok", rec.Code, res)
+	}
+	if want := httptest.NewRequest(http.MethodGet, "/", nil).RemoteAddr; peer != want {
+		t.Fatalf("grant looked up for %q, want the caller %q", peer, want)
+	}
+
+	origProfiles := egressProfiles
+	defer func() { egressProfiles = origProfiles }()
+	egressProfiles = map[string]netip.Addr{"lo": netip.MustParseAddr("127.0.0.1")}
+	req := httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape(targetAddr), nil)
+	req.Header.Set(egressHeader, "missing")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("probe with unknown egress profile = %d, want 400", rec.Code)
+	}
+}
+
+func TestProbeLeavesPrewarmPool(t *testing.T) {
+	// Not parallel: mutates the package-level warmPools.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	origPools := warmPools
+	defer func() { warmPools = origPools }()
+	p := newWarmPool(targetKey(targetAddr), 2)
+	p.fill(context.Background(), slog.New(slog.DiscardHandler))
+	defer p.close()
+	warmPools = map[string]*warmPool{p.addr: p}
+
+	idle := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.idle)
+	}
+	before, hits := idle(), prewarmCount("hits")
+	h := newProbeHandler(rate.NewLimiter(rate.Inf, 0))
+	rec, res := probe(t, h, targetAddr)
+	if rec.Code != http.StatusOK || !res.OK || res.RemoteAddr != targetAddr {
+		t.Fatalf("probe of prewarmed target = %d %+v, want ok with remote_addr %s", rec.Code, res, targetAddr)
+	}
+	if got := idle(); got != before || before != 2 {
+		t.Fatalf("pool holds %d connections after the probe, want %d (of 2)", got, before)
+	}
+	if got := prewarmCount("hits") - hits; got != 0 {
+		t.Fatalf("prewarm hits grew by %d, want 0", got)
+	}
+}
+
+func TestProbeNotServedInline(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "/probe?target=example.com:443", nil)
+	req.RequestURI = "/probe?target=example.com:443"
+	if isInlineAdminRequest(req) {
+		t.Fatal("/probe must only be served on the admin listener")
+	}
+}
@@ -7,28 +7,78 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/things-go/go-socks5"
 )
 
-const protocolPeekTimeout = 10 * time.Second
 const maxAcceptRetryDelay = 1 * time.Second
-const shutdownDrainTimeout = 10 * time.Second
 
-func serve(ctx context.Context, ln net.Listener, logger *slog.Logger) {
-	socksServer := socks5.NewServer(
-		socks5.WithLogger(&slogSocks5Logger{logger}),
-	)
+// silentConnTimeout, when set, is how long a new connection may send
+// nothing at all before it is closed and counted as silent_conn, typically
+// a port scanner that connects and waits. Set shorter than peekTimeout, it
+// keeps such connections from holding a slot for the whole peek;
+// connections from recentClients or behind a PROXY header wait out
+// peekTimeout anyway. It is off (0) by default, leaving every connection
+// to peekTimeout.
+var silentConnTimeout time.Duration
+
+// shutdownDrainTimeout is how long serve waits for open connections after
+// its listener closes before closing them itself.
+var shutdownDrainTimeout = 10 * time.Second
+
+// Shutdown modes: what serve does with open connections once its listener
+// closes.
+const (
+	shutdownDrain     = "drain"     // wait up to shutdownDrainTimeout, then close
+	shutdownImmediate = "immediate" // close them right away
+)
+
+// shutdownMode is the shutdown* constant for what serve does with open
+// connections once its listener closes.
+var shutdownMode = shutdownDrain
+
+func validShutdownMode(s string) bool {
+	return s == shutdownDrain || s == shutdownImmediate
+}
+
+// shutdownCloseWait is how long serve waits, after the drain timeout, for
+// the connections it closed to finish logging.
+const shutdownCloseWait = time.Second
+
+// serve accepts connections on ln and handles each one until ln is closed,
+// then waits up to shutdownDrainTimeout for open connections to finish.
+// Connections still open after that, or at once under shutdownImmediate,
+// are closed: in-flight dials are canceled and tunnels end with reason
+// "shutdown".
+// It uses nothing beyond the net.Listener interface, so protocol detection
+// and both handlers behave the same on a tsnet listener, an OS socket, or a
+// listener an embedding program already owns. Closing ln is the caller's
+// job; ctx only interrupts accept-error backoff.
+func serve(ctx context.Context, ln net.Listener, opts listenerOptions, logger *slog.Logger) {
 	var retryDelay time.Duration
 	var active sync.WaitGroup
 
+	// Connections outlive ctx until the drain timeout, so they get their
+	// own context that is only canceled once draining gives up.
+	connCtx, closeConns := context.WithCancel(context.WithoutCancel(ctx))
 	defer func() {
+		if shutdownMode == shutdownImmediate {
+			logger.Info("closing open connections immediately")
+			closeConns()
+			waitForWaitGroup(&active, shutdownCloseWait)
+			return
+		}
 		if !waitForWaitGroup(&active, shutdownDrainTimeout) {
-			logger.Warn("graceful shutdown timeout reached", "timeout", shutdownDrainTimeout)
+			logger.Warn("graceful shutdown timeout reached; closing remaining connections", "timeout", shutdownDrainTimeout)
+			closeConns()
+			waitForWaitGroup(&active, shutdownCloseWait)
 		}
+		closeConns()
 	}()
 
 	for {
@@ -39,6 +89,9 @@ func serve(ctx context.Context, ln net.Listener, logger *slog.Logger) {
 				return
 			}
 			if isTemporaryAcceptError(err) {
+				if isFDExhausted(err) {
+					countError("fd_exhausted")
+				}
 				retryDelay = nextRetryDelay(retryDelay)
 				logger.Warn("temporary accept error; retrying", "error", err, "backoff", retryDelay)
 				select {
@@ -52,23 +105,146 @@ func serve(ctx context.Context, ln net.Listener, logger *slog.Logger) {
 			return
 		}
 		retryDelay = 0
+		connectionsTotal.Add(1)
+		if acceptPaused.Load() {
+			countError("paused")
+			logger.Debug("accepting paused; closing connection", "remote", remoteAddr(conn))
+			_ = conn.Close()
+			continue
+		}
+		if fdShedding.Load() {
+			countError("fd_shed")
+			logger.Debug("shedding load for lack of file descriptors; closing connection", "remote", remoteAddr(conn))
+			_ = conn.Close()
+			continue
+		}
+		if memShedding.Load() {
+			countError("mem_shed")
+			logger.Debug("shedding load over the memory limit; closing connection", "remote", remoteAddr(conn))
+			_ = conn.Close()
+			continue
+		}
+		delay, ok := admitDelay(acceptLimiter)
+		if !ok {
+			countError("accept_rate")
+			logger.Debug("accept rate exceeded; closing connection", "remote", remoteAddr(conn))
+			_ = conn.Close()
+			continue
+		}
+		connectionsActive.Add(1)
 		active.Go(func() {
-			handleConn(conn, socksServer, logger)
+			defer connectionsActive.Add(-1)
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			handleConn(connCtx, conn, opts, logger)
 		})
 	}
 }
 
-func handleConn(conn net.Conn, socksServer *socks5.Server, logger *slog.Logger) {
+// listenerOptions holds behavior that differs between listeners.
+type listenerOptions struct {
+	// admin, when set, answers plain GET and HEAD requests for its
+	// inlineAdminPaths on the proxy port itself.
+	admin http.Handler
+
+	// proxyProtocolFrom lists the upstreams allowed to prefix connections
+	// with a PROXY protocol header carrying the real client address.
+	proxyProtocolFrom []netip.Prefix
+}
+
+// connIDs numbers accepted connections. Each tunnel's access log record
+// carries its connection's number as conn_id, telling apart tunnels from
+// the same peer and target.
+var connIDs atomic.Uint64
+
+type connIDKey struct{}
+
+// withConnID returns a context for the connection numbered id.
+func withConnID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// connIDFrom returns the number set by withConnID.
+func connIDFrom(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+// handleConn detects the protocol on conn and serves it. Canceling ctx
+// closes conn, aborting the handshake or tunnel.
+func handleConn(ctx context.Context, conn net.Conn, opts listenerOptions, logger *slog.Logger) {
 	defer conn.Close() //nolint:errcheck // best-effort cleanup
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
 
-	_ = conn.SetReadDeadline(time.Now().Add(protocolPeekTimeout))
+	// Health checks connect every few seconds; they are kept out of the
+	// events, logs, and error counters.
+	if isHealthCheck(conn) {
+		answerHealthCheck(conn)
+		return
+	}
+
+	ctx = withConnID(ctx, connIDs.Add(1))
+	start := time.Now()
+	event := connEvent{Remote: remoteAddr(conn), Local: addrString(conn.LocalAddr())}
+	recordEvent(connEvent{Time: start, Type: eventOpen, Remote: event.Remote, Local: event.Local})
+	defer func() {
+		event.Time = time.Now()
+		event.Type = eventClose
+		event.Duration = event.Time.Sub(start).Round(time.Millisecond).String()
+		recordEvent(event)
+	}()
+
+	hs := newHandshake(ctx, conn, handshakeTimeout)
+	defer hs.release()
+
+	// Connections get silentConnTimeout to send their first byte; those
+	// from a recently active source, or forwarded with a PROXY header,
+	// then get the rest of peekTimeout.
+	window := peekTimeout
+	if silentConnTimeout > 0 {
+		window = min(window, silentConnTimeout)
+	}
+	_ = conn.SetReadDeadline(start.Add(window))
 	br := bufio.NewReader(conn)
+	var forwarded bool
+	if trustsProxyHeader(conn, opts) {
+		client, err := readProxyHeader(br)
+		if err != nil {
+			countError("proxy_protocol")
+			logger.Debug("closing connection with malformed PROXY header", "remote", remoteAddr(conn), "error", err)
+			return
+		}
+		if client != nil {
+			conn = &proxiedConn{Conn: conn, remote: client}
+			event.Remote = remoteAddr(conn)
+			forwarded = true
+		}
+	}
 	first, err := br.Peek(1)
+	if errors.Is(err, os.ErrDeadlineExceeded) && window < peekTimeout {
+		if !forwarded && !recentClients.contains(conn, time.Now()) {
+			countError("silent_conn")
+			logger.Debug("closing connection that sent nothing", "remote", remoteAddr(conn), "timeout", window)
+			return
+		}
+		peekExtended.Add(1)
+		_ = conn.SetReadDeadline(start.Add(peekTimeout))
+		first, err = br.Peek(1)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		countError("peek_timeout")
+		logger.Debug("closing connection that sent nothing within -peek-timeout", "remote", remoteAddr(conn), "timeout", peekTimeout)
+		return
+	}
 	if err != nil {
+		countError("peek_failed")
 		slog.Debug("peek failed", "remote", remoteAddr(conn), "error", err)
 		return
 	}
 	_ = conn.SetReadDeadline(time.Time{})
+	recentClients.add(conn, time.Now())
 
 	peekConn := &peekedConn{
 		Reader: br,
@@ -76,19 +252,83 @@ func handleConn(conn net.Conn, socksServer *socks5.Server, logger *slog.Logger)
 	}
 
 	if isSOCKS5(first[0]) {
+		event.Protocol = "socks5"
+		release, ok := connSlots.acquire("socks5")
+		if !ok {
+			// SOCKS5 has no reply before the greeting is read, so the
+			// connection is just closed.
+			countError("max_conns")
+			logger.Debug("closing connection over -max-conns", "remote", remoteAddr(conn), "protocol", "socks5")
+			return
+		}
+		defer release()
 		logger.Debug("routing connection", "remote", remoteAddr(conn), "protocol", "socks5")
-		_ = socksServer.ServeConn(peekConn)
+		if useBuiltinSOCKS {
+			handleSOCKS5Builtin(ctx, hs, peekConn, peekConn.Reader, logger)
+			return
+		}
+		serveSOCKS(ctx, hs, peekConn, logger)
+		return
+	}
+
+	if first[0] == tlsRecordTypeHandshake {
+		// Most likely an https:// proxy URL: the client is starting TLS
+		// with the proxy itself, which tailgate doesn't terminate.
+		event.Protocol = "tls"
+		countError("tls_to_proxy")
+		logger.Warn("closing connection that started TLS with the proxy; the client should use an http:// or socks5:// proxy URL, not https://", "remote", remoteAddr(conn))
+		rejectTLSToProxy(conn)
+		return
+	}
+
+	if isUnknownBinary(first[0]) {
+		event.Protocol = "unknown"
+		countError("unknown_protocol")
+		logger.Debug("closing connection with unrecognized first byte", "remote", remoteAddr(conn), "first_byte", fmt.Sprintf("%#02x", first[0]))
 		return
 	}
 
+	event.Protocol = "http"
+	release, ok := connSlots.acquire("http")
+	if !ok {
+		countError("max_conns")
+		logger.Debug("rejecting connection over -max-conns", "remote", remoteAddr(conn), "protocol", "http")
+		writeHTTPError(conn, http.StatusServiceUnavailable, "too many connections\n", nil)
+		return
+	}
+	defer release()
 	logger.Debug("routing connection", "remote", remoteAddr(conn), "protocol", "http")
-	handleHTTPConnect(peekConn, peekConn.Reader, logger)
+	handleHTTPConnect(ctx, hs, peekConn, peekConn.Reader, opts, logger)
 }
 
 func isSOCKS5(firstByte byte) bool {
 	return firstByte == 0x05
 }
 
+// isUnknownBinary reports whether firstByte can't start an HTTP request
+// line and isn't a protocol tailgate recognizes. SOCKS4 (0x04) is left to
+// the HTTP path, which answers it with a 400 the client may at least log;
+// handleConn turns TLS (0x16) away before this is asked.
+func isUnknownBinary(firstByte byte) bool {
+	switch firstByte {
+	case 0x04, 0x05, 0x16:
+		return false
+	}
+	return firstByte < 0x20 || firstByte >= 0x7f
+}
+
+// tlsAlertHandshakeFailure is a fatal handshake_failure alert record
+// (RFC 8446 section 6), for TLS versions 1.0 and up.
+var tlsAlertHandshakeFailure = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}
+
+// rejectTLSToProxy answers a client that opened TLS with the proxy port
+// with a TLS alert, so it reports a handshake failure instead of trying to
+// parse an HTTP 400 as a TLS record.
+func rejectTLSToProxy(conn net.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	_, _ = conn.Write(tlsAlertHandshakeFailure)
+}
+
 type peekedConn struct {
 	Reader *bufio.Reader
 	net.Conn
@@ -98,11 +338,27 @@ func (c *peekedConn) Read(p []byte) (int, error) {
 	return c.Reader.Read(p)
 }
 
+// prefixedConn returns prefix from Read before reading from Conn. It is used
+// for client bytes that were buffered while parsing a request.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
 func remoteAddr(conn net.Conn) string {
-	if conn == nil || conn.RemoteAddr() == nil {
+	if conn == nil {
 		return ""
 	}
-	return conn.RemoteAddr().String()
+	return addrString(conn.RemoteAddr())
 }
 
 // slogSocks5Logger adapts slog.Logger to the socks5.Logger interface.
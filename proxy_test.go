@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -20,6 +27,131 @@ func TestIsSOCKS5(t *testing.T) {
 	}
 }
 
+func TestIsUnknownBinary(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range []byte{0x00, 0x01, 0x1b, 0x7f, 0x80, 0xff} {
+		if !isUnknownBinary(b) {
+			t.Fatalf("expected %#02x to be unknown binary", b)
+		}
+	}
+	for _, b := range []byte{0x04, 0x05, 0x16, 'C', 'G', ' '} {
+		if isUnknownBinary(b) {
+			t.Fatalf("expected %#02x not to be unknown binary", b)
+		}
+	}
+}
+
+func TestHandleConnClosesUnknownBinary(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	go func() { _, _ = clientConn.Write([]byte{0x00, 0xde, 0xad, 0xbe, 0xef}) }()
+
+	// The connection is closed without an HTTP response.
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := clientConn.Read(make([]byte, 64)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF with no response, got %d bytes, err %v", n, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not exit")
+	}
+}
+
+func TestHandleConnRejectsTLSToProxy(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+
+	// A client configured with an https:// proxy URL starts with a
+	// ClientHello, and should see a TLS alert rather than an HTTP 400.
+	_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	err := tls.Client(clientConn, &tls.Config{ServerName: "proxy.example"}).Handshake()
+	if err == nil || !strings.Contains(err.Error(), "handshake failure") {
+		t.Fatalf("handshake error = %v, want a remote handshake failure alert", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not exit")
+	}
+}
+
+func TestHandleConnClosesSilentConn(t *testing.T) {
+	// Not parallel: mutates the package-level silentConnTimeout.
+	orig := silentConnTimeout
+	silentConnTimeout = 50 * time.Millisecond
+	defer func() { silentConnTimeout = orig }()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+
+	// A client that never sends is closed long before peekTimeout.
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler held a silent connection")
+	}
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := clientConn.Read(make([]byte, 64)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF with no response, got %d bytes, err %v", n, err)
+	}
+}
+
+func TestHandleConnWaitsPeekTimeoutByDefault(t *testing.T) {
+	// Not parallel: mutates the package-level peekTimeout.
+	if silentConnTimeout != 0 {
+		t.Fatalf("silentConnTimeout defaults to %v, want 0 (off)", silentConnTimeout)
+	}
+	orig := peekTimeout
+	peekTimeout = 300 * time.Millisecond
+	defer func() { peekTimeout = orig }()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.DiscardHandler))
+	}()
+
+	// Without -silent-conn-timeout, a silent client from an unknown
+	// source still gets the whole of peekTimeout.
+	began := time.Now()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler held a silent connection past peekTimeout")
+	}
+	if elapsed := time.Since(began); elapsed < peekTimeout {
+		t.Fatalf("closed after %v, before peekTimeout %v", elapsed, peekTimeout)
+	}
+}
+
 func TestConnectTarget(t *testing.T) {
 	t.Parallel()
 
@@ -33,6 +165,13 @@ func TestConnectTarget(t *testing.T) {
 		{name: "host_no_port", in: "example.com", want: "example.com:443", ok: true},
 		{name: "ipv4_no_port", in: "127.0.0.1", want: "127.0.0.1:443", ok: true},
 		{name: "ipv6_no_port", in: "::1", want: "[::1]:443", ok: true},
+		{name: "ipv6_bracketed_with_port", in: "[::1]:8443", want: "[::1]:8443", ok: true},
+		{name: "ipv6_bracketed_no_port", in: "[::1]", want: "[::1]:443", ok: true},
+		{name: "ipv6_bracketed_zone_no_port", in: "[fe80::1%eth0]", want: "[fe80::1%eth0]:443", ok: true},
+		{name: "ipv6_bracketed_zone_with_port", in: "[fe80::1%eth0]:8443", want: "[fe80::1%eth0]:8443", ok: true},
+		{name: "bracketed_hostname", in: "[example.com]", ok: false},
+		{name: "bracketed_ipv4", in: "[127.0.0.1]", ok: false},
+		{name: "empty_brackets", in: "[]", ok: false},
 		{name: "empty", in: "", ok: false},
 		{name: "invalid_port", in: "example.com:abc", ok: false},
 		{name: "contains_path", in: "example.com/path", ok: false},
@@ -55,6 +194,183 @@ func TestConnectTarget(t *testing.T) {
 	}
 }
 
+// TestServeOnTCPListener runs serve on a plain TCP listener, as an embedder
+// with its own listener would, and checks that both protocols tunnel.
+func TestServeOnTCPListener(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(context.Background(), ln, listenerOptions{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	echo := func(t *testing.T, conn net.Conn, r io.Reader) {
+		t.Helper()
+		if _, err := io.WriteString(conn, "ping"); err != nil {
+			t.Fatalf("write through tunnel: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("read through tunnel: %v", err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("echo = %q, want %q", buf, "ping")
+		}
+	}
+
+	t.Run("http_connect", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		defer conn.Close() //nolint:errcheck // test cleanup
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+		if _, err := io.WriteString(conn, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n"); err != nil {
+			t.Fatalf("write CONNECT: %v", err)
+		}
+		br := bufio.NewReader(conn)
+		statusLine, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read status line: %v", err)
+		}
+		if !strings.Contains(statusLine, "200") {
+			t.Fatalf("expected 200 status line, got %q", statusLine)
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("read header terminator: %v", err)
+		}
+		echo(t, conn, br)
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		defer conn.Close() //nolint:errcheck // test cleanup
+
+		if rep := socksConnect(t, conn, targetAddr); rep != socks5RepSuccess {
+			t.Fatalf("SOCKS reply = %d, want success", rep)
+		}
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		echo(t, conn, conn)
+	})
+
+	_ = ln.Close()
+	select {
+	case <-served:
+	case <-time.After(shutdownDrainTimeout + 3*time.Second):
+		t.Fatal("serve did not return after listener close")
+	}
+}
+
+// serveIdleTunnel starts serve on a loopback listener and opens one idle
+// HTTP CONNECT tunnel through it. served is closed when serve returns.
+func serveIdleTunnel(t *testing.T) (ln net.Listener, conn net.Conn, served <-chan struct{}, logs *syncBuffer) {
+	t.Helper()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	t.Cleanup(stopTarget)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	logs = new(syncBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(context.Background(), ln, listenerOptions{}, slog.New(slog.NewTextHandler(logs, nil)))
+	}()
+
+	conn, err = net.DialTimeout("tcp", ln.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(conn, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %v, %v; want 200", resp, err)
+	}
+	return ln, conn, done, logs
+}
+
+func TestServeClosesTunnelsAfterDrainTimeout(t *testing.T) {
+	// Not parallel: mutates the package-level shutdownDrainTimeout.
+	orig := shutdownDrainTimeout
+	shutdownDrainTimeout = 100 * time.Millisecond
+	defer func() { shutdownDrainTimeout = orig }()
+
+	ln, conn, served, logs := serveIdleTunnel(t)
+
+	// The tunnel stays idle, so only the drain timeout can end it.
+	_ = ln.Close()
+	start := time.Now()
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not return after drain timeout")
+	}
+	if elapsed := time.Since(start); elapsed < shutdownDrainTimeout {
+		t.Fatalf("serve returned after %v, before the %v drain timeout", elapsed, shutdownDrainTimeout)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected tunnel closed by proxy, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "reason=shutdown") {
+		t.Fatalf("access log record missing shutdown reason: %s", logs.String())
+	}
+}
+
+func TestServeImmediateShutdownClosesTunnels(t *testing.T) {
+	// Not parallel: mutates the package-level shutdownMode.
+	orig := shutdownMode
+	shutdownMode = shutdownImmediate
+	defer func() { shutdownMode = orig }()
+
+	ln, conn, served, logs := serveIdleTunnel(t)
+
+	// The drain timeout is 10s; immediate mode must not wait for it.
+	_ = ln.Close()
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not close tunnels immediately")
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected tunnel closed by proxy, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "reason=shutdown") {
+		t.Fatalf("access log record missing shutdown reason: %s", logs.String())
+	}
+}
+
+func TestValidShutdownMode(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{shutdownDrain, shutdownImmediate} {
+		if !validShutdownMode(s) {
+			t.Errorf("validShutdownMode(%q) = false", s)
+		}
+	}
+	if validShutdownMode("") || validShutdownMode("fast") {
+		t.Error("validShutdownMode accepted an unknown mode")
+	}
+}
+
 func TestIsTemporaryAcceptError(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from the front
+// of br. It returns the client address the header carries, or nil if the
+// stream has no header or the header is a LOCAL one (e.g. a load balancer
+// health check) without an address. A header that is present but malformed
+// is an error.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	header, err := proxyproto.Read(br)
+	if errors.Is(err, proxyproto.ErrNoProxyProtocol) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header.Command.IsLocal() {
+		return nil, nil
+	}
+	return header.SourceAddr, nil
+}
+
+// proxiedConn reports the client address from a PROXY protocol header as
+// its RemoteAddr, so logs, limits and X-Forwarded-For see the real client
+// rather than the upstream load balancer.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+
+// trustsProxyHeader reports whether conn's peer may send a PROXY protocol
+// header under opts. Headers from anyone else are never parsed.
+func trustsProxyHeader(conn net.Conn, opts listenerOptions) bool {
+	if len(opts.proxyProtocolFrom) == 0 {
+		return false
+	}
+	ip, ok := addrIP(conn.RemoteAddr())
+	return ok && prefixesContain(opts.proxyProtocolFrom, ip)
+}
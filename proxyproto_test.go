@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func v2Header(t *testing.T, cmd proxyproto.ProtocolVersionAndCommand, src string) []byte {
+	t.Helper()
+	h := &proxyproto.Header{
+		Version:           2,
+		Command:           cmd,
+		TransportProtocol: proxyproto.TCPv4,
+		SourceAddr:        net.TCPAddrFromAddrPort(netip.MustParseAddrPort(src)),
+		DestinationAddr:   net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:1080")),
+	}
+	b, err := h.Format()
+	if err != nil {
+		t.Fatalf("format v2 header: %v", err)
+	}
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	const rest = "CONNECT example.com:443 HTTP/1.1\r\n\r\n"
+	tests := []struct {
+		name    string
+		in      []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "v1_tcp4", in: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 1080\r\n" + rest), want: "203.0.113.7:51000"},
+		{name: "v1_tcp6", in: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 1080\r\n" + rest), want: "[2001:db8::7]:51000"},
+		{name: "v1_unknown", in: []byte("PROXY UNKNOWN\r\n" + rest)},
+		{name: "v2_proxy", in: append(v2Header(t, proxyproto.PROXY, "203.0.113.7:51000"), rest...), want: "203.0.113.7:51000"},
+		{name: "v2_local", in: append(v2Header(t, proxyproto.LOCAL, "203.0.113.7:51000"), rest...)},
+		{name: "no_header", in: []byte(rest)},
+		{name: "post_request", in: []byte("POST / HTTP/1.1\r\n\r\n")},
+		{name: "v1_bad_address", in: []byte("PROXY TCP4 not-an-ip 192.0.2.1 51000 1080\r\n" + rest), wantErr: true},
+		{name: "v1_bad_port", in: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 99999 1080\r\n" + rest), wantErr: true},
+		{name: "v1_no_crlf", in: []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 1080" + strings.Repeat("x", 128)), wantErr: true},
+		{name: "v2_bad_version", in: append(append([]byte{}, proxyproto.SIGV2...), 0x31, 0x11, 0x00, 0x0c), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			br := bufio.NewReader(bytes.NewReader(tt.in))
+			got, err := readProxyHeader(br)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got addr %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("addr = %v, want none", got)
+				}
+			} else if got == nil || got.String() != tt.want {
+				t.Fatalf("addr = %v, want %s", got, tt.want)
+			}
+
+			// Whatever follows the header is left for protocol detection.
+			want := rest
+			if tt.name == "post_request" {
+				want = string(tt.in)
+			}
+			if left, _ := io.ReadAll(br); string(left) != want {
+				t.Fatalf("remaining stream = %q, want %q", left, want)
+			}
+		})
+	}
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestTrustsProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	opts := listenerOptions{proxyProtocolFrom: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	tests := []struct {
+		name   string
+		remote net.Addr
+		opts   listenerOptions
+		want   bool
+	}{
+		{name: "trusted", remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, opts: opts, want: true},
+		{name: "untrusted", remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.9"), Port: 1}, opts: opts},
+		{name: "not_configured", remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}},
+		{name: "no_ip", remote: pipeAddr{}, opts: opts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := trustsProxyHeader(remoteAddrConn{remote: tt.remote}, tt.opts); got != tt.want {
+				t.Fatalf("trustsProxyHeader = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// syncBuffer is a bytes.Buffer safe for a logger writing from the handler
+// goroutine while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runProxiedConn serves one loopback connection through handleConn with
+// trusted allowed to send PROXY headers, writes in, and returns
+// everything the client read back plus the handler's debug log.
+func runProxiedConn(t *testing.T, trusted string, in string) (resp, log string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // test cleanup
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	opts := listenerOptions{proxyProtocolFrom: []netip.Prefix{netip.MustParsePrefix(trusted)}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		handleConn(context.Background(), conn, opts, logger)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close() //nolint:errcheck // test cleanup
+
+	if _, err := client.Write([]byte(in)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	out, err := io.ReadAll(client)
+	if err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("read: %v (got %q)", err, out)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not exit")
+	}
+	return string(out), logs.String()
+}
+
+func TestHandleConnProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	const req = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	t.Run("valid_v1", func(t *testing.T) {
+		t.Parallel()
+		resp, log := runProxiedConn(t, "127.0.0.0/8", "PROXY TCP4 203.0.113.7 192.0.2.1 51000 1080\r\n"+req)
+		if !strings.HasPrefix(resp, "HTTP/1.1 ") {
+			t.Fatalf("expected an HTTP response after the header, got %q", resp)
+		}
+		if !strings.Contains(log, "remote=203.0.113.7:51000") {
+			t.Fatalf("expected client address from header in logs, got:\n%s", log)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		t.Parallel()
+		resp, log := runProxiedConn(t, "127.0.0.0/8", "PROXY TCP4 bogus\r\n"+req)
+		if resp != "" {
+			t.Fatalf("expected close with no response, got %q", resp)
+		}
+		if !strings.Contains(log, "malformed PROXY header") {
+			t.Fatalf("expected malformed header log, got:\n%s", log)
+		}
+	})
+
+	t.Run("untrusted_peer", func(t *testing.T) {
+		t.Parallel()
+		// The header is not parsed, so it reaches the HTTP parser as an
+		// invalid request line.
+		resp, log := runProxiedConn(t, "192.0.2.0/24", "PROXY TCP4 203.0.113.7 192.0.2.1 51000 1080\r\n"+req)
+		if !strings.HasPrefix(resp, "HTTP/1.1 400") {
+			t.Fatalf("expected 400 for unparsed header, got %q", resp)
+		}
+		if strings.Contains(log, "remote=203.0.113.7") || !strings.Contains(log, "remote=127.0.0.1:") {
+			t.Fatalf("untrusted header address leaked into logs:\n%s", log)
+		}
+	})
+}
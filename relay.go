@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Tunnel close reasons, reported in the "tunnel closed" access log record
+// and counted in tunnel_close_reasons. The reason comes from whichever
+// relay direction finished first.
+const (
+	closeNormalEOF    = "normal-eof"    // a side closed its end cleanly
+	closeIdleTimeout  = "idle-timeout"  // no data for tunnelIdleTimeout
+	closeWriteTimeout = "write-timeout" // a side accepted no bytes for tunnelWriteTimeout
+	closeClientReset  = "client-rst"    // the client reset the connection
+	closeTargetReset  = "target-rst"    // the target reset the connection
+	closePolicyClosed = "policy-closed" // tailgate closed the connection itself
+	closeShutdown     = "shutdown"      // tailgate stopped draining and closed it
+	closeMemoryShed   = "memory-shed"   // closed while idle to recover memory
+	closeError        = "error"
+)
+
+// Sides of a tunnel, reported as closed_by.
+const (
+	sideClient = "client"
+	sideTarget = "target"
+	sideProxy  = "proxy"
+)
+
+// relayBufferSize matches io.Copy's default buffer.
+const relayBufferSize = 32 * 1024
+
+// relay copies bytes between an established client connection and its
+// target until either side closes or the tunnel goes idle, then writes
+// the tunnel's access log record. Canceling ctx closes both sides.
+// protocol, client, and targetAddr are used for logging only.
+func relay(ctx context.Context, conn, target net.Conn, logger *slog.Logger, protocol, client, targetAddr string) {
+	start := time.Now()
+	targetCounts.record(targetAddr)
+	applyNoDelay(conn, sideClient, logger)
+	applyNoDelay(target, sideTarget, logger)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+		_ = target.Close()
+	})
+	defer stop()
+	meter := tunnelRates.open(protocol, client, targetAddr)
+	defer meter.close()
+
+	// Wrap both sides with an idle timeout so tunnels with no traffic
+	// in either direction are cleaned up after tunnelIdleTimeout.
+	idleConn := &idleTimeoutConn{Conn: conn, timeout: tunnelIdleTimeout, writeTimeout: tunnelWriteTimeout}
+	idleTarget := &idleTimeoutConn{Conn: target, timeout: tunnelIdleTimeout, writeTimeout: tunnelWriteTimeout}
+	defer shedTunnels.add(idleConn, idleTarget, cancel)()
+
+	// Relay bytes bidirectionally. Each goroutine closes the destination
+	// when its copy finishes, which unblocks the other goroutine's read.
+	// Callers' deferred closes are safety nets for the redundant close.
+	capture := openCapture(client, targetAddr, logger)
+	defer capture.Close()
+	fromClient := capture.tee(idleConn, "client->target")
+	fromTarget := capture.tee(idleTarget, "target->client")
+
+	results := make(chan halfResult, 2)
+	go func() {
+		r := copyHalf(idleTarget, fromClient, sideClient, sideTarget, meter)
+		logRelayEnd(logger, client, targetAddr, "client->target", r.err())
+		_ = target.Close()
+		results <- r
+	}()
+	go func() {
+		r := copyHalf(idleConn, fromTarget, sideTarget, sideClient, meter)
+		logRelayEnd(logger, client, targetAddr, "target->client", r.err())
+		_ = conn.Close()
+		results <- r
+	}()
+	first, second := <-results, <-results
+
+	if idleConn.idleExpired() || idleTarget.idleExpired() {
+		last := idleConn.lastActive()
+		if t := idleTarget.lastActive(); t.After(last) {
+			last = t
+		}
+		tunnelIdleTimeouts.Add(1)
+		logger.Warn(
+			"tunnel closed by idle timeout",
+			"remote", client,
+			"target", targetAddr,
+			"idle", time.Since(last).Round(time.Millisecond),
+			"idle_timeout", tunnelIdleTimeout,
+		)
+	}
+
+	if errors.Is(first.writeErr, errWriteStalled) {
+		logger.Warn(
+			"tunnel closed by write timeout",
+			"remote", client,
+			"target", targetAddr,
+			"stalled", first.dst,
+			"write_timeout", tunnelWriteTimeout,
+		)
+	}
+
+	reason, closedBy := first.closeReason()
+	if ctx.Err() != nil {
+		reason, closedBy = closeShutdown, sideProxy
+		if context.Cause(ctx) == errMemoryShed {
+			reason = closeMemoryShed
+		}
+	}
+	up, down := first.n, second.n
+	if first.src == sideTarget {
+		up, down = down, up
+	}
+	logTunnelClosed(ctx, logger, protocol, client, targetAddr, target, reason, closedBy, start, up, down)
+	flows.add(tunnelFlows(conn.RemoteAddr(), target.RemoteAddr(), up, down, start, time.Now())...)
+}
+
+// logTunnelClosed counts reason in tunnel_close_reasons and writes the
+// tunnel's "tunnel closed" access log record. relay calls it once the
+// tunnel's relay ends, and the CONNECT handlers when a policy check closes
+// an established tunnel before relaying starts.
+func logTunnelClosed(ctx context.Context, logger *slog.Logger, protocol, client, targetAddr string, target net.Conn, reason, closedBy string, start time.Time, up, down int64) {
+	tunnelCloseReasons.Add(reason, 1)
+	attrs := []any{
+		"protocol", protocol,
+		"remote", client,
+		"target", targetAddr,
+		"reason", reason,
+		"closed_by", closedBy,
+		"duration", time.Since(start).Round(time.Millisecond),
+		"bytes_client_to_target", up,
+		"bytes_target_to_client", down,
+	}
+	if logResolvedIP {
+		if ip := resolvedIP(targetAddr, target); ip != "" {
+			attrs = append(attrs, "resolved_ip", ip)
+		}
+	}
+	if id, ok := connIDFrom(ctx); ok {
+		attrs = append(attrs, "conn_id", id)
+	}
+	if user := tunnelUserFrom(ctx); user != "" {
+		attrs = append(attrs, "user", user)
+	}
+	if label := tunnelLabelFrom(ctx); label != "" {
+		attrs = append(attrs, "label", label)
+	}
+	if sampleAccessLog(reason) {
+		accessLogFor(logger).Info("tunnel closed", attrs...)
+	}
+}
+
+// halfResult is how one relay direction, src to dst, ended.
+type halfResult struct {
+	src, dst string
+	n        int64
+	readErr  error // from src; io.EOF for a clean close
+	writeErr error // from dst
+}
+
+// copyHalf is io.Copy that also reports which side the error came from,
+// counting what it writes in meter and, as it goes, in bytes_proxied, so
+// long-lived tunnels show up before they close.
+func copyHalf(dst io.Writer, src io.Reader, srcSide, dstSide string, meter *tunnelMeter) halfResult {
+	r := halfResult{src: srcSide, dst: dstSide}
+	direction := bytesClientToTarget
+	if srcSide == sideTarget {
+		direction = bytesTargetToClient
+	}
+	buf := make([]byte, relayBufferSize)
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			r.n += int64(nw)
+			meter.add(srcSide == sideClient, int64(nw))
+			bytesProxied.Add(direction, int64(nw))
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				r.writeErr = werr
+				return r
+			}
+		}
+		if err != nil {
+			r.readErr = err
+			return r
+		}
+	}
+}
+
+// err returns the error that ended the copy, with a clean EOF reported as
+// nil like io.Copy does.
+func (r halfResult) err() error {
+	if r.writeErr != nil {
+		return r.writeErr
+	}
+	if errors.Is(r.readErr, io.EOF) {
+		return nil
+	}
+	return r.readErr
+}
+
+// closeReason attributes the end of the tunnel to a side and a reason. It
+// is meaningful for the first direction to finish; the second one usually
+// just sees the close the first one caused.
+func (r halfResult) closeReason() (reason, closedBy string) {
+	side, err := r.src, r.readErr
+	if r.writeErr != nil {
+		side, err = r.dst, r.writeErr
+	}
+	switch classifyRelayError(err) {
+	case relayEOF:
+		return closeNormalEOF, side
+	case relayReset:
+		if side == sideClient {
+			return closeClientReset, side
+		}
+		return closeTargetReset, side
+	case relayTimeout:
+		return closeIdleTimeout, sideProxy
+	case relayWriteStall:
+		return closeWriteTimeout, sideProxy
+	case relayClosed:
+		return closePolicyClosed, sideProxy
+	default:
+		return closeError, side
+	}
+}
+
+// Relay end classifications returned by classifyRelayError.
+const (
+	relayEOF        = "eof"         // orderly close
+	relayClosed     = "closed"      // closed locally, usually by the other relay direction
+	relayReset      = "reset"       // peer sent RST or the pipe broke
+	relayTimeout    = "timeout"     // idle deadline fired
+	relayWriteStall = "write-stall" // tunnelWriteTimeout fired
+	relayError      = "error"
+)
+
+// classifyRelayError classifies the error returned by io.Copy in the relay.
+// io.Copy reports a clean EOF as a nil error.
+func classifyRelayError(err error) string {
+	var ne net.Error
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return relayEOF
+	case errors.Is(err, errWriteStalled):
+		return relayWriteStall
+	case errors.Is(err, net.ErrClosed), errors.Is(err, io.ErrClosedPipe):
+		return relayClosed
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return relayReset
+	case errors.As(err, &ne) && ne.Timeout():
+		return relayTimeout
+	default:
+		return relayError
+	}
+}
+
+func logRelayEnd(logger *slog.Logger, client, target, direction string, err error) {
+	switch classifyRelayError(err) {
+	case relayReset:
+		tunnelResets.Add(1)
+		logger.Debug("tunnel reset", "remote", client, "target", target, "direction", direction, "error", err)
+	case relayError:
+		logger.Debug("tunnel relay error", "remote", client, "target", target, "direction", direction, "error", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyRelayError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "clean_eof", err: nil, want: relayEOF},
+		{name: "local_close", err: &net.OpError{Op: "read", Err: net.ErrClosed}, want: relayClosed},
+		{name: "pipe_close", err: io.ErrClosedPipe, want: relayClosed},
+		{name: "conn_reset", err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, want: relayReset},
+		{name: "broken_pipe", err: &net.OpError{Op: "write", Err: syscall.EPIPE}, want: relayReset},
+		{name: "idle_timeout", err: &stubNetError{timeout: true}, want: relayTimeout},
+		{name: "write_stall", err: fmt.Errorf("%w: %w", errWriteStalled, &stubNetError{timeout: true}), want: relayWriteStall},
+		{name: "other", err: errors.New("boom"), want: relayError},
+	}
+
+	for _, tc := range tests {
+		if got := classifyRelayError(tc.err); got != tc.want {
+			t.Fatalf("%s: classifyRelayError(%v) = %q, want %q", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRelayLogsIdleTimeout(t *testing.T) {
+	// Not parallel: mutates the package-level tunnelIdleTimeout.
+	origTimeout := tunnelIdleTimeout
+	tunnelIdleTimeout = 50 * time.Millisecond
+	defer func() { tunnelIdleTimeout = origTimeout }()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	targetConn, targetPeer := net.Pipe()
+	defer targetPeer.Close() //nolint:errcheck // test cleanup
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	before := tunnelIdleTimeouts.Value()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(context.Background(), serverConn, targetConn, logger, "http", "client", "target:443")
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay did not exit after idle timeout")
+	}
+
+	if got := tunnelIdleTimeouts.Value() - before; got != 1 {
+		t.Fatalf("tunnel_idle_timeouts increased by %d, want 1", got)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "tunnel closed by idle timeout") || !strings.Contains(out, "target=target:443") {
+		t.Fatalf("missing idle timeout warning in logs: %s", out)
+	}
+	if !strings.Contains(out, "reason=idle-timeout closed_by=proxy") {
+		t.Fatalf("access log record missing idle-timeout reason: %s", out)
+	}
+}
+
+func TestRelayNormalCloseIsNotIdleTimeout(t *testing.T) {
+	// Not parallel: reads the package-level tunnel_idle_timeouts counter,
+	// which TestRelayLogsIdleTimeout also changes.
+	clientConn, serverConn := net.Pipe()
+	targetConn, targetPeer := net.Pipe()
+	defer targetPeer.Close() //nolint:errcheck // test cleanup
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	before := tunnelIdleTimeouts.Value()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(context.Background(), serverConn, targetConn, logger, "http", "client", "target:443")
+	}()
+	_ = clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay did not exit after client close")
+	}
+
+	if got := tunnelIdleTimeouts.Value() - before; got != 0 {
+		t.Fatalf("tunnel_idle_timeouts increased by %d on normal close", got)
+	}
+	if strings.Contains(logs.String(), "idle timeout") {
+		t.Fatalf("normal close logged as idle timeout: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "reason=normal-eof closed_by=client") {
+		t.Fatalf("access log record missing client EOF reason: %s", logs.String())
+	}
+}
+
+func TestRelayClosesOnContextCancel(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	targetConn, targetPeer := net.Pipe()
+	defer targetPeer.Close() //nolint:errcheck // test cleanup
+
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(ctx, serverConn, targetConn, logger, "http", "client", "target:443")
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay did not exit after context cancel")
+	}
+
+	if !strings.Contains(logs.String(), "reason=shutdown closed_by=proxy") {
+		t.Fatalf("access log record missing shutdown reason: %s", logs.String())
+	}
+}
+
+func TestRelayCountsBytesWhileOpen(t *testing.T) {
+	// Not parallel: reads the package-level bytesProxied counters, which
+	// parallel relays would also move.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	targetConn, targetPeer := net.Pipe()
+	defer targetPeer.Close() //nolint:errcheck // test cleanup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(ctx, serverConn, targetConn, slog.New(slog.DiscardHandler), "http", "client", "target:443")
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	count := func(key string) int64 {
+		if n, ok := bytesProxied.Get(key).(*expvar.Int); ok {
+			return n.Value()
+		}
+		return 0
+	}
+	up, down := count(bytesClientToTarget), count(bytesTargetToClient)
+
+	_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	_ = targetPeer.SetDeadline(time.Now().Add(3 * time.Second))
+	go func() { _, _ = clientConn.Write([]byte("ping")) }()
+	if _, err := io.ReadFull(targetPeer, make([]byte, 4)); err != nil {
+		t.Fatalf("read at target: %v", err)
+	}
+	go func() { _, _ = targetPeer.Write([]byte("pong!")) }()
+	if _, err := io.ReadFull(clientConn, make([]byte, 5)); err != nil {
+		t.Fatalf("read at client: %v", err)
+	}
+
+	// The tunnel is still open, yet the counters include its bytes. The
+	// relay counts a write just after the peer has read it, so wait.
+	deadline := time.Now().Add(3 * time.Second)
+	for count(bytesClientToTarget)-up != 4 || count(bytesTargetToClient)-down != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bytes_proxied grew by %d client_to_target and %d target_to_client while open, want 4 and 5",
+				count(bytesClientToTarget)-up, count(bytesTargetToClient)-down)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHalfResultCloseReason(t *testing.T) {
+	t.Parallel()
+
+	reset := &net.OpError{Op: "read", Err: syscall.ECONNRESET}
+	tests := []struct {
+		name     string
+		r        halfResult
+		reason   string
+		closedBy string
+	}{
+		{name: "client_eof", r: halfResult{src: sideClient, dst: sideTarget, readErr: io.EOF}, reason: closeNormalEOF, closedBy: sideClient},
+		{name: "target_eof", r: halfResult{src: sideTarget, dst: sideClient, readErr: io.EOF}, reason: closeNormalEOF, closedBy: sideTarget},
+		{name: "client_rst", r: halfResult{src: sideClient, dst: sideTarget, readErr: reset}, reason: closeClientReset, closedBy: sideClient},
+		{name: "target_rst_on_read", r: halfResult{src: sideTarget, dst: sideClient, readErr: reset}, reason: closeTargetReset, closedBy: sideTarget},
+		{name: "target_rst_on_write", r: halfResult{src: sideClient, dst: sideTarget, writeErr: &net.OpError{Op: "write", Err: syscall.EPIPE}}, reason: closeTargetReset, closedBy: sideTarget},
+		{name: "idle", r: halfResult{src: sideClient, dst: sideTarget, readErr: &stubNetError{timeout: true}}, reason: closeIdleTimeout, closedBy: sideProxy},
+		{name: "write_stall", r: halfResult{src: sideTarget, dst: sideClient, writeErr: fmt.Errorf("%w: %w", errWriteStalled, &stubNetError{timeout: true})}, reason: closeWriteTimeout, closedBy: sideProxy},
+		{name: "local_close", r: halfResult{src: sideTarget, dst: sideClient, readErr: net.ErrClosed}, reason: closePolicyClosed, closedBy: sideProxy},
+		{name: "other", r: halfResult{src: sideClient, dst: sideTarget, readErr: errors.New("boom")}, reason: closeError, closedBy: sideClient},
+	}
+	for _, tc := range tests {
+		reason, closedBy := tc.r.closeReason()
+		if reason != tc.reason || closedBy != tc.closedBy {
+			t.Fatalf("%s: closeReason() = %q, %q; want %q, %q", tc.name, reason, closedBy, tc.reason, tc.closedBy)
+		}
+	}
+}
+
+func TestCopyHalfSeparatesReadAndWriteErrors(t *testing.T) {
+	t.Parallel()
+
+	r := copyHalf(io.Discard, strings.NewReader("hello"), sideClient, sideTarget, nil)
+	if r.n != 5 || !errors.Is(r.readErr, io.EOF) || r.writeErr != nil || r.err() != nil {
+		t.Fatalf("clean copy = %+v", r)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	_ = serverConn.Close()
+	r = copyHalf(clientConn, strings.NewReader("hello"), sideClient, sideTarget, nil)
+	if r.writeErr == nil || r.readErr != nil {
+		t.Fatalf("copy to closed pipe = %+v, want a write error", r)
+	}
+}
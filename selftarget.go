@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// errSelfTarget is returned when a tunnel would connect to one of
+// tailgate's own admin or pprof listeners.
+var errSelfTarget = errors.New("target is one of tailgate's own admin endpoints")
+
+// selfEndpoints holds the addresses tailgate's admin, pprof and inline
+// admin listeners are reachable on; dialTarget refuses them so a client
+// can't use the proxy to reach its control plane.
+var selfEndpoints map[netip.AddrPort]bool
+
+// isSelfEndpoint reports whether ap is in selfEndpoints.
+func isSelfEndpoint(ap netip.AddrPort) bool {
+	if len(selfEndpoints) == 0 {
+		return false
+	}
+	return selfEndpoints[netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port())]
+}
+
+// listenEndpoints expands the listen address addr ("host:port" or
+// ":port") to the addresses a dial could reach it on: its own host, or,
+// when that is empty or unspecified, every address in localIPs.
+func listenEndpoints(addr string, localIPs []netip.Addr) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host != "" {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		if !ip.IsUnspecified() {
+			return []netip.AddrPort{netip.AddrPortFrom(ip.Unmap().WithZone(""), uint16(port))}, nil
+		}
+	}
+	eps := make([]netip.AddrPort, 0, len(localIPs))
+	for _, ip := range localIPs {
+		eps = append(eps, netip.AddrPortFrom(ip.Unmap().WithZone(""), uint16(port)))
+	}
+	return eps, nil
+}
+
+// hostIPs returns the addresses of this host's network interfaces, which
+// an OS listener on an unspecified address accepts connections on.
+func hostIPs() []netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []netip.Addr
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+			ips = append(ips, prefix.Addr())
+		}
+	}
+	return ips
+}
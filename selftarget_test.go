@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenEndpoints(t *testing.T) {
+	t.Parallel()
+
+	ips := []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")}
+	tests := []struct {
+		addr string
+		want []string
+	}{
+		{":8080", []string{"100.64.0.1:8080", "[fd7a:115c:a1e0::1]:8080"}},
+		{"[::]:8080", []string{"100.64.0.1:8080", "[fd7a:115c:a1e0::1]:8080"}},
+		{"0.0.0.0:8080", []string{"100.64.0.1:8080", "[fd7a:115c:a1e0::1]:8080"}},
+		{"127.0.0.1:9090", []string{"127.0.0.1:9090"}},
+		{"[::ffff:127.0.0.1]:9090", []string{"127.0.0.1:9090"}},
+	}
+	for _, tt := range tests {
+		eps, err := listenEndpoints(tt.addr, ips)
+		if err != nil {
+			t.Errorf("listenEndpoints(%q): %v", tt.addr, err)
+			continue
+		}
+		var got []string
+		for _, ep := range eps {
+			got = append(got, ep.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("listenEndpoints(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, addr := range []string{"8080", "localhost:8080", ":http"} {
+		if _, err := listenEndpoints(addr, ips); err == nil {
+			t.Errorf("listenEndpoints(%q) succeeded, want error", addr)
+		}
+	}
+}
+
+func TestDialTargetRefusesSelfEndpoint(t *testing.T) {
+	// Not parallel: mutates the package-level selfEndpoints and lookupNetIP.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	ap := netip.MustParseAddrPort(targetAddr)
+
+	origSelf, origLookup := selfEndpoints, lookupNetIP
+	defer func() { selfEndpoints, lookupNetIP = origSelf, origLookup }()
+	selfEndpoints = map[netip.AddrPort]bool{ap: true}
+	lookupNetIP = func(context.Context, string, string) ([]netip.Addr, error) {
+		return []netip.Addr{ap.Addr()}, nil
+	}
+
+	for _, addr := range []string{targetAddr, "admin.test:" + strconv.Itoa(int(ap.Port()))} {
+		if conn, err := dialTarget(context.Background(), addr); !errors.Is(err, errSelfTarget) {
+			if conn != nil {
+				_ = conn.Close()
+			}
+			t.Fatalf("dialTarget(%q) err = %v, want errSelfTarget", addr, err)
+		}
+	}
+	if got := dialErrorKind(errSelfTarget); got != "self_target" {
+		t.Fatalf("dialErrorKind = %q, want self_target", got)
+	}
+
+	status, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n")
+	if !strings.Contains(status, "403") {
+		t.Fatalf("CONNECT to admin endpoint status = %q, want 403", status)
+	}
+
+	// Other ports on the same host are still reachable.
+	selfEndpoints = map[netip.AddrPort]bool{netip.AddrPortFrom(ap.Addr(), ap.Port()+1): true}
+	conn, err := dialTarget(context.Background(), targetAddr)
+	if err != nil {
+		t.Fatalf("dialTarget to non-admin port: %v", err)
+	}
+	_ = conn.Close()
+}
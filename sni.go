@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// logSNI enables logging the TLS server name clients send inside CONNECT
+// tunnels.
+var logSNI bool
+
+const (
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 16384
+	tlsRecordTypeHandshake  = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtServerName        = 0x0000
+	tlsServerNameHostName   = 0x00
+)
+
+// sniConn passes reads through unchanged while copying the first client
+// record aside until it can tell whether it is a ClientHello. onSNI is
+// called once with the server name, or with "" if the stream isn't TLS or
+// carries no SNI. Nothing is read ahead of the relay, so the stream is
+// untouched and no latency is added.
+type sniConn struct {
+	net.Conn
+	onSNI func(sni string)
+
+	buf  []byte
+	done bool
+}
+
+func newSNIConn(conn net.Conn, onSNI func(sni string)) *sniConn {
+	return &sniConn{Conn: conn, onSNI: onSNI}
+}
+
+// Read is only called from the client->target relay goroutine, so buf
+// needs no locking.
+func (c *sniConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, p[:n]...)
+		if sni, complete := parseClientHelloSNI(c.buf); complete {
+			c.done = true
+			c.buf = nil
+			c.onSNI(sni)
+		}
+	}
+	return n, err
+}
+
+// parseClientHelloSNI extracts the server_name extension from the first TLS
+// record in data. complete is false while more bytes are needed; once it is
+// true, sni is the host name or "" for non-TLS data, other handshake
+// messages, malformed hellos, and hellos without SNI.
+func parseClientHelloSNI(data []byte) (sni string, complete bool) {
+	if len(data) < tlsRecordHeaderLen {
+		return "", len(data) > 0 && data[0] != tlsRecordTypeHandshake
+	}
+	if data[0] != tlsRecordTypeHandshake {
+		return "", true
+	}
+	recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if recordLen > tlsMaxRecordLen {
+		return "", true
+	}
+	if len(data) < tlsRecordHeaderLen+recordLen {
+		return "", false
+	}
+	return clientHelloSNI(data[tlsRecordHeaderLen : tlsRecordHeaderLen+recordLen]), true
+}
+
+// clientHelloSNI parses a handshake message and returns the ClientHello's
+// host_name, or "" if there is none. Hellos split across records are not
+// reassembled and yield "".
+func clientHelloSNI(msg []byte) string {
+	r := tlsReader(msg)
+	typ, ok := r.u8()
+	if !ok || typ != tlsHandshakeClientHello {
+		return ""
+	}
+	body, ok := r.vec(3)
+	if !ok {
+		return ""
+	}
+
+	r = tlsReader(body)
+	if !r.skip(2 + 32) { // legacy_version, random
+		return ""
+	}
+	if _, ok := r.vec(1); !ok { // legacy_session_id
+		return ""
+	}
+	if _, ok := r.vec(2); !ok { // cipher_suites
+		return ""
+	}
+	if _, ok := r.vec(1); !ok { // legacy_compression_methods
+		return ""
+	}
+	exts, ok := r.vec(2)
+	if !ok {
+		return ""
+	}
+
+	r = tlsReader(exts)
+	for len(r) > 0 {
+		typ, ok1 := r.u16()
+		data, ok2 := r.vec(2)
+		if !ok1 || !ok2 {
+			return ""
+		}
+		if typ != tlsExtServerName {
+			continue
+		}
+		names := tlsReader(data)
+		list, ok := names.vec(2)
+		if !ok {
+			return ""
+		}
+		lr := tlsReader(list)
+		for len(lr) > 0 {
+			nameType, ok1 := lr.u8()
+			name, ok2 := lr.vec(2)
+			if !ok1 || !ok2 {
+				return ""
+			}
+			if nameType == tlsServerNameHostName {
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// tlsReader consumes big-endian TLS wire encodings from the front of a
+// byte slice.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) u8() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vec reads a vector with an lenBytes-byte length prefix.
+func (r *tlsReader) vec(lenBytes int) ([]byte, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	var n int
+	for _, b := range (*r)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	*r = (*r)[lenBytes:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first flight a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+
+	go func() {
+		c := tls.Client(clientConn, &tls.Config{ServerName: serverName})
+		_ = c.Handshake()
+	}()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+
+	_ = serverConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(serverConn, body); err != nil {
+		t.Fatalf("read record body: %v", err)
+	}
+	return append(header, body...)
+}
+
+func TestParseClientHelloSNI(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "inner.example.com")
+
+	for i := range len(hello) {
+		if _, complete := parseClientHelloSNI(hello[:i]); complete {
+			t.Fatalf("parse of %d/%d bytes reported complete", i, len(hello))
+		}
+	}
+	sni, complete := parseClientHelloSNI(hello)
+	if !complete || sni != "inner.example.com" {
+		t.Fatalf("parseClientHelloSNI = %q, %v; want inner.example.com, true", sni, complete)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "plaintext", data: []byte("SSH-2.0-OpenSSH_9.6\r\n")},
+		{name: "short_plaintext", data: []byte("G")},
+		{name: "oversized_record", data: []byte{tlsRecordTypeHandshake, 3, 1, 0xff, 0xff}},
+		{name: "not_client_hello", data: []byte{tlsRecordTypeHandshake, 3, 1, 0, 4, 2, 0, 0, 0}},
+		{name: "truncated_hello", data: []byte{tlsRecordTypeHandshake, 3, 1, 0, 4, 1, 0, 0, 9}},
+	}
+	for _, tc := range tests {
+		sni, complete := parseClientHelloSNI(tc.data)
+		if !complete || sni != "" {
+			t.Fatalf("%s: parseClientHelloSNI = %q, %v; want \"\", true", tc.name, sni, complete)
+		}
+	}
+}
+
+func TestSNIConnPassesBytesThrough(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "inner.example.com")
+	payload := append(append([]byte{}, hello...), "trailing application data"...)
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+	go func() {
+		defer clientConn.Close() //nolint:errcheck // test cleanup
+		// Dribble the hello out in small writes to exercise reassembly.
+		for rest := payload; len(rest) > 0; {
+			n := min(7, len(rest))
+			if _, err := clientConn.Write(rest[:n]); err != nil {
+				return
+			}
+			rest = rest[n:]
+		}
+	}()
+
+	var calls []string
+	conn := newSNIConn(serverConn, func(sni string) { calls = append(calls, sni) })
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read through sniConn: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("sniConn altered the stream")
+	}
+	if len(calls) != 1 || calls[0] != "inner.example.com" {
+		t.Fatalf("onSNI calls = %q, want one call with inner.example.com", calls)
+	}
+}
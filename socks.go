@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/bufferpool"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// socksBindIP, when valid, is reported as BND.ADDR in successful CONNECT
+// replies in place of the host-local address used to reach the target,
+// which clients on the tailnet can't reach. socksBindIP6 is its IPv6
+// counterpart, used when socksBindFamily asks for IPv6. They are vars so
+// main can set them to the node's tailnet addresses and tests can override
+// them.
+var socksBindIP, socksBindIP6 netip.Addr
+
+// socksBindFamily picks the address family of BND.ADDR, for clients that
+// insist on one: "4" or "6" for that family, "client" for the family of
+// the client's own connection, or "auto" for socksBindIP (the node's
+// tailnet IPv4 address) whatever the target's family.
+var socksBindFamily = bindFamilyAuto
+
+// -socks-bind-family values.
+const (
+	bindFamilyAuto   = "auto"
+	bindFamily4      = "4"
+	bindFamily6      = "6"
+	bindFamilyClient = "client"
+)
+
+// validSOCKSBindFamily reports whether s is a -socks-bind-family value.
+func validSOCKSBindFamily(s string) bool {
+	switch s {
+	case bindFamilyAuto, bindFamily4, bindFamily6, bindFamilyClient:
+		return true
+	}
+	return false
+}
+
+// socksBoundAddr returns the BND.ADDR and BND.PORT to report for a tunnel
+// whose outbound connection has local address local, for a client
+// connected from client.
+func socksBoundAddr(local, client net.Addr) net.Addr {
+	var port uint16
+	var localIP netip.Addr
+	if tcp, ok := local.(*net.TCPAddr); ok {
+		port = uint16(tcp.Port)
+		localIP = tcp.AddrPort().Addr().Unmap()
+	}
+
+	var want4 bool
+	switch socksBindFamily {
+	case bindFamily4:
+		want4 = true
+	case bindFamily6:
+	case bindFamilyClient:
+		tcp, ok := client.(*net.TCPAddr)
+		if !ok {
+			return socksBoundAddrAuto(local, port)
+		}
+		want4 = tcp.AddrPort().Addr().Unmap().Is4()
+	default:
+		return socksBoundAddrAuto(local, port)
+	}
+
+	// The node's tailnet address of that family, else the local address
+	// if it has it, else that family's unspecified address.
+	ip := netip.IPv6Unspecified()
+	if want4 {
+		ip = netip.IPv4Unspecified()
+	}
+	for _, candidate := range []netip.Addr{socksBindIP, socksBindIP6, localIP} {
+		if candidate.IsValid() && candidate.Is4() == want4 {
+			ip = candidate
+			break
+		}
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+}
+
+func socksBoundAddrAuto(local net.Addr, port uint16) net.Addr {
+	if !socksBindIP.IsValid() {
+		return local
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(socksBindIP, port))
+}
+
+// socksNegotiationTimeout bounds the SOCKS5 greeting and request, like
+// connectReadTimeout does for HTTP CONNECT, so it applies even with
+// -handshake-timeout=0.
+var socksNegotiationTimeout = 15 * time.Second
+
+// socksBufferPool is shared by the per-connection SOCKS5 servers.
+var socksBufferPool = bufferpool.NewPool(32 * 1024)
+
+// serveSOCKS serves one SOCKS5 connection. A socks5.Server is built per
+// connection so its hooks can carry per-connection state such as the
+// handshake deadline; go-socks5 does not pass one through otherwise.
+func serveSOCKS(ctx context.Context, hs *handshake, conn net.Conn, logger *slog.Logger) {
+	hooks := &socksHooks{ctx: ctx, logger: logger, hs: hs, conn: conn}
+	applyNoDelay(conn, sideClient, logger)
+	_ = conn.SetReadDeadline(time.Now().Add(socksNegotiationTimeout))
+	srv := socks5.NewServer(
+		socks5.WithLogger(&slogSocks5Logger{logger}),
+		socks5.WithBufferPool(socksBufferPool),
+		socks5.WithResolver(socksResolver{}),
+		socks5.WithRule(hooks),
+		socks5.WithConnectHandle(hooks.connect),
+	)
+	_ = srv.ServeConn(conn)
+	if hs.expired() && !hooks.connecting {
+		countError("handshake_timeout")
+		logger.Debug("handshake timeout", "remote", remoteAddr(conn), "protocol", "socks5", "timeout", handshakeTimeout)
+	}
+}
+
+// socksHooks applies tailgate's connection policy to one SOCKS5 connection.
+// Allow runs before the CONNECT dial and may reserve resources whose
+// release connect holds until the tunnel closes.
+type socksHooks struct {
+	ctx    context.Context
+	logger *slog.Logger
+	hs     *handshake
+	conn   net.Conn
+
+	release func()
+	// connecting is set once connect runs; from then on connect reports a
+	// handshake timeout itself.
+	connecting bool
+}
+
+func (h *socksHooks) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	// go-socks5 calls Allow once the request has been read, which ends
+	// negotiation.
+	_ = h.conn.SetReadDeadline(time.Time{})
+
+	// serveSOCKS only replaces the CONNECT handler. go-socks5's own BIND
+	// and UDP ASSOCIATE would dial outside grants, port policy and
+	// dialTarget's checks, so they are refused with a rule failure.
+	if req.Command != statute.CommandConnect {
+		countError("socks_request")
+		h.logger.Debug("unsupported socks5 command", "remote", addrString(req.RemoteAddr), "command", req.Command, "protocol", "socks5")
+		return ctx, false
+	}
+
+	host := socksTargetHost(req)
+	if req.DestAddr != nil && !portAllowed(req.DestAddr.Port) {
+		countError("port_denied")
+		h.logger.Debug("destination port not allowed", "remote", addrString(req.RemoteAddr), "host", host, "port", req.DestAddr.Port, "protocol", "socks5")
+		return ctx, false
+	}
+	targetAddr := socksTargetAddr(req)
+	if err := checkGrant(h.hs.ctx, whoIsAddr(h.conn), targetAddr); err != nil {
+		countError("no_grant")
+		h.logger.Debug("peer not granted access to target", "remote", addrString(req.RemoteAddr), "target", targetAddr, "protocol", "socks5", "error", err)
+		return ctx, false
+	}
+	releaseUser, user, ok := acquireUserSlot(h.hs.ctx, h.conn, h.logger)
+	if !ok {
+		countError("user_limit")
+		h.logger.Debug("per-user connection limit reached", "remote", addrString(req.RemoteAddr), "user", user, "protocol", "socks5")
+		return ctx, false
+	}
+	releaseHost, ok := perHostLimiter.acquire(hostKey(host))
+	if !ok {
+		releaseUser()
+		countError("host_limit")
+		h.logger.Debug("per-host connection limit reached", "remote", addrString(req.RemoteAddr), "host", host, "protocol", "socks5")
+		return ctx, false
+	}
+	h.release = func() {
+		releaseHost()
+		releaseUser()
+	}
+	// go-socks5 hands this context to connect, which relays under it.
+	return withTunnelUser(h.ctx, user), true
+}
+
+// connect replaces go-socks5's CONNECT handler, so the tunnel runs through
+// socksTunnel and tailgate's relay like the built-in handler's, rather than
+// through go-socks5's own relay. ctx is the connection's context as Allow
+// returned it, carrying the tunnel's access log metadata.
+func (h *socksHooks) connect(ctx context.Context, w io.Writer, req *socks5.Request) error {
+	h.connecting = true
+	if h.release != nil {
+		defer h.release()
+	}
+
+	addr := socksTargetAddr(req)
+	target, err := dialTarget(withRuleEgress(h.hs.ctx, addr), addr)
+	if err != nil {
+		if h.hs.expired() {
+			countError("handshake_timeout")
+			h.logger.Debug("handshake timeout", "remote", remoteAddr(h.conn), "target", addr, "protocol", "socks5", "timeout", handshakeTimeout)
+			return err
+		}
+		countError(dialErrorKind(err))
+		h.logger.Debug("failed to dial target", "target", addr, "protocol", "socks5", "error", err)
+		_ = socks5.SendReply(w, socks5DialFailureReply(err), nil)
+		return err
+	}
+	defer target.Close() //nolint:errcheck // best-effort cleanup
+
+	// go-socks5 read the request through its own buffered reader, which
+	// may hold client bytes sent right after it.
+	client := &peekedConn{Reader: bufio.NewReader(req.Reader), Conn: h.conn}
+	socksTunnel(ctx, h.hs, client, target, addr, func(rep byte, bnd net.Addr) { _ = socks5.SendReply(w, rep, bnd) }, h.logger)
+	return nil
+}
+
+// socksTunnel completes a SOCKS5 CONNECT for either handler once target is
+// dialed: it applies -target-close-probe, sends the reply through reply,
+// checks the port's required protocol, and relays until the tunnel closes.
+// conn must return any client bytes already buffered past the request.
+func socksTunnel(ctx context.Context, hs *handshake, conn, target net.Conn, targetAddr string, reply func(rep byte, bnd net.Addr), logger *slog.Logger) {
+	client := remoteAddr(conn)
+
+	var early []byte
+	if targetCloseProbe > 0 {
+		var err error
+		if early, err = probeTarget(target, targetCloseProbe); err != nil {
+			countError("target_closed")
+			logger.Debug("target closed during probe", "remote", client, "target", targetAddr, "protocol", "socks5", "error", err)
+			reply(socks5RepConnectionRefused, nil)
+			return
+		}
+	}
+
+	if !hs.done() {
+		countError("handshake_timeout")
+		logger.Debug("handshake timeout", "remote", client, "target", targetAddr, "protocol", "socks5", "timeout", handshakeTimeout)
+		return
+	}
+	reply(socks5RepSuccess, socksBoundAddr(target.LocalAddr(), conn.RemoteAddr()))
+	established := time.Now()
+	clientConn := conn
+	if proto := requiredProtocol(targetAddr); proto != "" {
+		first, err := checkClientProtocol(conn, nil, proto, tlsFirstByteTimeout)
+		if err != nil {
+			countError("protocol_mismatch")
+			logTunnelClosed(ctx, logger, "socks5", client, targetAddr, target, closePolicyClosed, sideProxy, established, 0, 0)
+			logger.Warn("policy violation: closing tunnel that doesn't carry the port's required protocol", "remote", client, "target", targetAddr, "protocol", "socks5", "required", proto, "error", err)
+			return
+		}
+		clientConn = &prefixedConn{Conn: conn, prefix: first}
+	}
+	if len(early) > 0 {
+		_, _ = conn.Write(early)
+	}
+
+	relay(ctx, clientConn, target, logger, "socks5", client, targetAddr)
+}
+
+// socksTargetAddr returns the host:port the client asked for, keeping the
+// name of an FQDN request rather than the address it resolved to, so
+// egress rules, -prewarm pools, and the access log all see the name.
+func socksTargetAddr(req *socks5.Request) string {
+	var port int
+	if req.DestAddr != nil {
+		port = req.DestAddr.Port
+	}
+	return net.JoinHostPort(socksTargetHost(req), strconv.Itoa(port))
+}
+
+// socksTargetHost returns the host the client asked for: the FQDN when the
+// request named one, otherwise the IP literal.
+func socksTargetHost(req *socks5.Request) string {
+	if req.RawDestAddr != nil && req.RawDestAddr.FQDN != "" {
+		return req.RawDestAddr.FQDN
+	}
+	if req.DestAddr != nil {
+		return req.DestAddr.IP.String()
+	}
+	return ""
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// socksResolver leaves FQDN targets unresolved. connect dials the name with
+// dialTarget, which resolves it through resolveHost and fails over between
+// its addresses, as HTTP CONNECT does.
+type socksResolver struct{}
+
+func (socksResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// useBuiltinSOCKS selects the built-in SOCKS5 handler instead of go-socks5.
+var useBuiltinSOCKS = false
+
+// socksCredentials maps usernames to passwords. When it is non-empty the
+// built-in handler requires RFC 1929 username/password authentication
+// instead of offering no-auth.
+var socksCredentials map[string]string
+
+// SOCKS5 protocol constants (RFC 1928).
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSuccess              = 0x00
+	socks5RepGeneralFailure       = 0x01
+	socks5RepRuleFailure          = 0x02
+	socks5RepNetworkUnreachable   = 0x03
+	socks5RepHostUnreachable      = 0x04
+	socks5RepConnectionRefused    = 0x05
+	socks5RepCommandNotSupported  = 0x07
+	socks5RepAddrTypeNotSupported = 0x08
+)
+
+// handleSOCKS5Builtin is a small, dependency-free SOCKS5 server covering
+// the common case: the greeting, optional username/password auth and the
+// CONNECT command. BIND and UDP ASSOCIATE are rejected, as they are by the
+// default go-socks5 handler.
+func handleSOCKS5Builtin(ctx context.Context, hs *handshake, conn net.Conn, r io.Reader, logger *slog.Logger) {
+	client := remoteAddr(conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(socksNegotiationTimeout))
+	method, err := socks5Greeting(conn, r)
+	if err != nil {
+		countError("socks_greeting")
+		logger.Debug("socks5 greeting failed", "remote", client, "error", err)
+		return
+	}
+	if method == socks5MethodUserPass {
+		if err := socks5UserPassAuth(conn, r); err != nil {
+			countError("socks_auth")
+			logger.Debug("socks5 authentication failed", "remote", client, "error", err)
+			return
+		}
+	}
+
+	targetAddr, rep, err := readSOCKS5Request(r)
+	if err != nil {
+		countError("socks_request")
+		logger.Debug("invalid socks5 request", "remote", client, "error", err)
+		if rep != socks5RepSuccess {
+			writeSOCKS5Reply(conn, rep, nil)
+		}
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if !targetPortAllowed(targetAddr) {
+		countError("port_denied")
+		logger.Debug("destination port not allowed", "remote", client, "target", targetAddr, "protocol", "socks5")
+		writeSOCKS5Reply(conn, socks5RepRuleFailure, nil)
+		return
+	}
+	if err := checkGrant(hs.ctx, whoIsAddr(conn), targetAddr); err != nil {
+		countError("no_grant")
+		logger.Debug("peer not granted access to target", "remote", client, "target", targetAddr, "protocol", "socks5", "error", err)
+		writeSOCKS5Reply(conn, socks5RepRuleFailure, nil)
+		return
+	}
+
+	releaseUser, user, ok := acquireUserSlot(hs.ctx, conn, logger)
+	if !ok {
+		countError("user_limit")
+		logger.Debug("per-user connection limit reached", "remote", client, "user", user, "protocol", "socks5")
+		writeSOCKS5Reply(conn, socks5RepRuleFailure, nil)
+		return
+	}
+	defer releaseUser()
+	ctx = withTunnelUser(ctx, user)
+
+	targetHost, _, _ := net.SplitHostPort(targetAddr)
+	release, ok := perHostLimiter.acquire(hostKey(targetHost))
+	if !ok {
+		countError("host_limit")
+		logger.Debug("per-host connection limit reached", "remote", client, "host", targetHost, "protocol", "socks5")
+		writeSOCKS5Reply(conn, socks5RepRuleFailure, nil)
+		return
+	}
+	defer release()
+
+	target, err := dialTarget(withRuleEgress(hs.ctx, targetAddr), targetAddr)
+	if err != nil {
+		if hs.expired() {
+			countError("handshake_timeout")
+			logger.Debug("handshake timeout", "remote", client, "target", targetAddr, "protocol", "socks5", "timeout", handshakeTimeout)
+			return
+		}
+		countError(dialErrorKind(err))
+		logger.Debug("failed to dial target", "target", targetAddr, "protocol", "socks5", "error", err)
+		writeSOCKS5Reply(conn, socks5DialFailureReply(err), nil)
+		return
+	}
+	defer target.Close() //nolint:errcheck // best-effort cleanup
+
+	socksTunnel(ctx, hs, conn, target, targetAddr, func(rep byte, bnd net.Addr) { writeSOCKS5Reply(conn, rep, bnd) }, logger)
+}
+
+// socks5Greeting reads the client's method selection and answers with the
+// method it picked: username/password when socksCredentials is set, and
+// no-auth otherwise.
+func socks5Greeting(conn net.Conn, r io.Reader) (method byte, err error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, err
+	}
+	if hdr[0] != socks5Version {
+		return 0, errors.New("unsupported SOCKS version " + strconv.Itoa(int(hdr[0])))
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return 0, err
+	}
+	want := byte(socks5MethodNoAuth)
+	if len(socksCredentials) > 0 {
+		want = socks5MethodUserPass
+	}
+	for _, m := range methods {
+		if m == want {
+			_, err := conn.Write([]byte{socks5Version, want})
+			return want, err
+		}
+	}
+	_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+	return 0, errors.New("no acceptable authentication method")
+}
+
+// socks5UserPassAuth runs the RFC 1929 subnegotiation and answers with
+// success only for a username and password in socksCredentials.
+func socks5UserPassAuth(conn net.Conn, r io.Reader) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != socks5UserPassVersion {
+		return errors.New("unsupported username/password version " + strconv.Itoa(int(hdr[0])))
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return err
+	}
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return err
+	}
+	pass := make([]byte, n[0])
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return err
+	}
+
+	want, ok := socksCredentials[string(user)]
+	if !ok || subtle.ConstantTimeCompare(pass, []byte(want)) != 1 {
+		_, _ = conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return errors.New("invalid credentials for user " + strconv.Quote(string(user)))
+	}
+	_, err := conn.Write([]byte{socks5UserPassVersion, socks5UserPassSuccess})
+	return err
+}
+
+// loadSOCKSCredentials reads a -socks-users-file: one "user:password" per
+// line, with blank lines and lines starting with # ignored. Passwords may
+// contain colons. RFC 1929 limits both fields to 255 bytes.
+func loadSOCKSCredentials(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck // best-effort cleanup
+
+	creds := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(text, ":")
+		if !ok || user == "" || pass == "" || len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("%s:%d: want user:password, each 1-255 bytes", path, line)
+		}
+		creds[user] = pass
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("%s: no users", path)
+	}
+	return creds, nil
+}
+
+// readSOCKS5Request parses a SOCKS5 request and returns the CONNECT target
+// as host:port. On failure, rep is the reply code to send the client, or
+// socks5RepSuccess if the connection should just be closed.
+func readSOCKS5Request(r io.Reader) (targetAddr string, rep byte, err error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", socks5RepSuccess, err
+	}
+	if hdr[0] != socks5Version {
+		return "", socks5RepSuccess, errors.New("unsupported SOCKS version " + strconv.Itoa(int(hdr[0])))
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", socks5RepSuccess, err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", socks5RepSuccess, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", socks5RepSuccess, err
+		}
+		host = string(name)
+	default:
+		return "", socks5RepAddrTypeNotSupported, errors.New("unsupported address type " + strconv.Itoa(int(hdr[3])))
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", socks5RepSuccess, err
+	}
+
+	if hdr[1] != socks5CmdConnect {
+		return "", socks5RepCommandNotSupported, errors.New("unsupported command " + strconv.Itoa(int(hdr[1])))
+	}
+	if host == "" {
+		return "", socks5RepHostUnreachable, errors.New("empty host")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), socks5RepSuccess, nil
+}
+
+// writeSOCKS5Reply sends a reply with bound address bnd, or 0.0.0.0:0 when
+// bnd is not a TCP address.
+func writeSOCKS5Reply(conn net.Conn, rep byte, bnd net.Addr) {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcp, ok := bnd.(*net.TCPAddr); ok && tcp != nil {
+		if v4 := tcp.IP.To4(); v4 != nil {
+			ip = v4
+		} else if tcp.IP.To16() != nil {
+			ip = tcp.IP.To16()
+		}
+		port = tcp.Port
+	}
+
+	atyp := byte(socks5AtypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = socks5AtypIPv6
+	}
+	reply := append([]byte{socks5Version, rep, 0x00, atyp}, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, _ = conn.Write(reply)
+}
+
+func socks5DialFailureReply(err error) byte {
+	switch {
+	case errors.Is(err, errSelfTarget), errors.Is(err, errPrivateTarget):
+		return socks5RepRuleFailure
+	case errors.Is(err, errDialBusy), errors.Is(err, errDNSBusy):
+		return socks5RepGeneralFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetworkUnreachable
+	default:
+		return socks5RepHostUnreachable
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSOCKS5BuiltinConnect(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	clientConn, stop := startBuiltinSOCKSConn(t)
+	defer stop()
+
+	if rep := socksConnect(t, clientConn, targetAddr); rep != socks5RepSuccess {
+		t.Fatalf("expected success reply, got %d", rep)
+	}
+
+	payload := "ping-through-builtin-socks"
+	_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(clientConn, payload); err != nil {
+		t.Fatalf("write payload: %v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatalf("read echoed payload: %v", err)
+	}
+	if got := string(buf); got != payload {
+		t.Fatalf("unexpected echoed payload: got %q want %q", got, payload)
+	}
+}
+
+func TestHandleSOCKS5BuiltinReportsTailnetBindAddr(t *testing.T) {
+	// Not parallel: mutates the package-level socksBindIP.
+	origBindIP := socksBindIP
+	socksBindIP = netip.MustParseAddr("100.64.0.1")
+	defer func() { socksBindIP = origBindIP }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	conn, stop := startBuiltinSOCKSConn(t)
+	defer stop()
+	assertSOCKSBindAddr(t, socksConnectReply(t, conn, targetAddr), socksBindIP)
+}
+
+func TestHandleSOCKS5BuiltinBindFamily6(t *testing.T) {
+	// Not parallel: mutates the package-level socksBindIP6 and
+	// socksBindFamily.
+	origIP6, origFamily := socksBindIP6, socksBindFamily
+	socksBindIP6, socksBindFamily = netip.MustParseAddr("fd7a:115c:a1e0::1"), bindFamily6
+	defer func() { socksBindIP6, socksBindFamily = origIP6, origFamily }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	conn, stop := startBuiltinSOCKSConn(t)
+	defer stop()
+	assertSOCKSBindAddr6(t, socksConnectReply(t, conn, targetAddr), socksBindIP6)
+}
+
+func TestHandleSOCKS5BuiltinUnsupportedCommand(t *testing.T) {
+	t.Parallel()
+
+	clientConn, stop := startBuiltinSOCKSConn(t)
+	defer stop()
+
+	_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = clientConn.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+	if _, err := io.ReadFull(clientConn, make([]byte, 2)); err != nil {
+		t.Fatalf("read method selection: %v", err)
+	}
+	// BIND to 127.0.0.1:80.
+	_, _ = clientConn.Write([]byte{socks5Version, 0x02, 0x00, socks5AtypIPv4, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(clientConn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != socks5RepCommandNotSupported {
+		t.Fatalf("expected command not supported, got %d", reply[1])
+	}
+}
+
+func TestHandleSOCKS5BuiltinNoAcceptableMethod(t *testing.T) {
+	t.Parallel()
+
+	clientConn, stop := startBuiltinSOCKSConn(t)
+	defer stop()
+
+	_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+	// Offer only username/password.
+	_, _ = clientConn.Write([]byte{socks5Version, 1, socks5MethodUserPass})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, method); err != nil {
+		t.Fatalf("read method selection: %v", err)
+	}
+	if method[1] != socks5MethodNoAcceptable {
+		t.Fatalf("expected no acceptable methods, got %d", method[1])
+	}
+}
+
+func TestHandleSOCKS5BuiltinUserPassAuth(t *testing.T) {
+	// Not parallel: mutates the package-level socksCredentials.
+	orig := socksCredentials
+	defer func() { socksCredentials = orig }()
+	socksCredentials = map[string]string{"alice": "s3cret:pw"}
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	// auth greets offering methods, then, if the server picks
+	// username/password, sends user and pass and returns the status.
+	auth := func(clientConn net.Conn, methods []byte, user, pass string) (method, status byte) {
+		t.Helper()
+		_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, _ = clientConn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+		sel := make([]byte, 2)
+		if _, err := io.ReadFull(clientConn, sel); err != nil {
+			t.Fatalf("read method selection: %v", err)
+		}
+		if sel[1] != socks5MethodUserPass {
+			return sel[1], 0
+		}
+		req := append([]byte{socks5UserPassVersion, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		_, _ = clientConn.Write(req)
+		resp := make([]byte, 2)
+		if _, err := io.ReadFull(clientConn, resp); err != nil {
+			t.Fatalf("read auth status: %v", err)
+		}
+		if resp[0] != socks5UserPassVersion {
+			t.Fatalf("auth status version = %d, want %d", resp[0], socks5UserPassVersion)
+		}
+		return sel[1], resp[1]
+	}
+
+	clientConn, stop := startBuiltinSOCKSConn(t)
+	if method, status := auth(clientConn, []byte{socks5MethodNoAuth, socks5MethodUserPass}, "alice", "s3cret:pw"); method != socks5MethodUserPass || status != socks5UserPassSuccess {
+		t.Fatalf("valid credentials: method %d status %d, want username/password and success", method, status)
+	}
+	_, _ = clientConn.Write(socksConnectRequest(t, targetAddr))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(clientConn, reply); err != nil {
+		t.Fatalf("read CONNECT reply: %v", err)
+	}
+	if reply[1] != socks5RepSuccess {
+		t.Fatalf("CONNECT after auth = %d, want success", reply[1])
+	}
+	stop()
+
+	before := errorCount("socks_auth")
+	for _, tc := range []struct{ user, pass string }{{"alice", "wrong"}, {"bob", "s3cret:pw"}} {
+		clientConn, stop := startBuiltinSOCKSConn(t)
+		if _, status := auth(clientConn, []byte{socks5MethodUserPass}, tc.user, tc.pass); status != socks5UserPassFailure {
+			t.Fatalf("credentials %s:%s: status %d, want failure", tc.user, tc.pass, status)
+		}
+		if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("credentials %s:%s: connection left open after failed auth", tc.user, tc.pass)
+		}
+		stop()
+	}
+	if got := errorCount("socks_auth") - before; got != 2 {
+		t.Fatalf("socks_auth grew by %d, want 2", got)
+	}
+
+	// With credentials configured, no-auth is no longer offered.
+	clientConn, stop = startBuiltinSOCKSConn(t)
+	defer stop()
+	if method, _ := auth(clientConn, []byte{socks5MethodNoAuth}, "", ""); method != socks5MethodNoAcceptable {
+		t.Fatalf("no-auth client got method %d, want no acceptable methods", method)
+	}
+}
+
+func TestLoadSOCKSCredentials(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+
+	creds, err := loadSOCKSCredentials(write("users", "# proxy users\nalice:s3cret\n\nbob:pa:ss\n"))
+	if err != nil {
+		t.Fatalf("loadSOCKSCredentials: %v", err)
+	}
+	if len(creds) != 2 || creds["alice"] != "s3cret" || creds["bob"] != "pa:ss" {
+		t.Fatalf("credentials = %v", creds)
+	}
+
+	for name, content := range map[string]string{
+		"no_colon":   "alice\n",
+		"empty_pass": "alice:\n",
+		"long_user":  strings.Repeat("a", 256) + ":pw\n",
+		"empty":      "# nobody\n",
+	} {
+		if _, err := loadSOCKSCredentials(write(name, content)); err == nil {
+			t.Errorf("%s: loadSOCKSCredentials succeeded, want an error", name)
+		}
+	}
+	if _, err := loadSOCKSCredentials(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: loadSOCKSCredentials succeeded, want an error")
+	}
+}
+
+func TestReadSOCKS5RequestDomain(t *testing.T) {
+	t.Parallel()
+
+	name := "example.com"
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, 0x01, 0xbb)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close() //nolint:errcheck // test cleanup
+	defer serverConn.Close() //nolint:errcheck // test cleanup
+	go func() { _, _ = clientConn.Write(req) }()
+
+	got, _, err := readSOCKS5Request(serverConn)
+	if err != nil {
+		t.Fatalf("readSOCKS5Request unexpected err: %v", err)
+	}
+	if got != "example.com:443" {
+		t.Fatalf("readSOCKS5Request = %q, want example.com:443", got)
+	}
+}
+
+func startBuiltinSOCKSConn(t *testing.T) (clientConn net.Conn, stop func()) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverConn.Close() //nolint:errcheck // test cleanup
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		handleSOCKS5Builtin(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, serverConn, logger)
+	}()
+
+	return clientConn, func() {
+		_ = clientConn.Close()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("built-in SOCKS handler did not exit after client close")
+		}
+	}
+}
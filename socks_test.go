@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestSOCKSPerHostLimit(t *testing.T) {
+	// Not parallel: mutates the package-level perHostLimiter.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	origLimiter := perHostLimiter
+	perHostLimiter = newConnLimiter(1)
+	defer func() { perHostLimiter = origLimiter }()
+
+	first, stopFirst := startSOCKSConn(t)
+	defer stopFirst()
+	if rep := socksConnect(t, first, targetAddr); rep != statute.RepSuccess {
+		t.Fatalf("expected first SOCKS connect to succeed, got reply %d", rep)
+	}
+
+	second, stopSecond := startSOCKSConn(t)
+	defer stopSecond()
+	if rep := socksConnect(t, second, targetAddr); rep != statute.RepRuleFailure {
+		t.Fatalf("expected rule failure for SOCKS connect over per-host limit, got reply %d", rep)
+	}
+}
+
+func TestSOCKSRefusesNonConnectCommands(t *testing.T) {
+	// Not parallel: mutates the package-level grantCapability and
+	// whoIsCaps.
+	grantCaps(t, nil, nil)
+
+	before := errorCount("socks_request")
+	for _, cmd := range []byte{statute.CommandAssociate, statute.CommandBind} {
+		conn, stop := startSOCKSConn(t)
+		if rep := socksRequestReply(t, conn, cmd, "127.0.0.1:53")[1]; rep != statute.RepRuleFailure {
+			t.Fatalf("command %d from a peer with no grant: reply %d, want rule failure", cmd, rep)
+		}
+		stop()
+	}
+	if got := errorCount("socks_request") - before; got != 2 {
+		t.Fatalf("socks_request grew by %d, want 2", got)
+	}
+}
+
+func TestSOCKSReplyReportsTailnetBindAddr(t *testing.T) {
+	// Not parallel: mutates the package-level socksBindIP.
+	origBindIP := socksBindIP
+	socksBindIP = netip.MustParseAddr("100.64.0.1")
+	defer func() { socksBindIP = origBindIP }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	conn, stop := startSOCKSConn(t)
+	defer stop()
+	assertSOCKSBindAddr(t, socksConnectReply(t, conn, targetAddr), socksBindIP)
+}
+
+// assertSOCKSBindAddr checks that a successful IPv4 CONNECT reply carries
+// want as BND.ADDR and a nonzero BND.PORT.
+func assertSOCKSBindAddr(t *testing.T, reply []byte, want netip.Addr) {
+	t.Helper()
+
+	if reply[1] != statute.RepSuccess {
+		t.Fatalf("SOCKS reply = %d, want success", reply[1])
+	}
+	if reply[3] != statute.ATYPIPv4 {
+		t.Fatalf("BND.ADDR type = %d, want IPv4", reply[3])
+	}
+	if got := netip.AddrFrom4([4]byte(reply[4:8])); got != want {
+		t.Fatalf("BND.ADDR = %v, want %v", got, want)
+	}
+	if port := int(reply[8])<<8 | int(reply[9]); port == 0 {
+		t.Fatal("BND.PORT = 0, want the outbound connection's port")
+	}
+}
+
+// assertSOCKSBindAddr6 is assertSOCKSBindAddr for an IPv6 BND.ADDR.
+func assertSOCKSBindAddr6(t *testing.T, reply []byte, want netip.Addr) {
+	t.Helper()
+
+	if reply[1] != statute.RepSuccess {
+		t.Fatalf("SOCKS reply = %d, want success", reply[1])
+	}
+	if reply[3] != statute.ATYPIPv6 {
+		t.Fatalf("BND.ADDR type = %d, want IPv6", reply[3])
+	}
+	if got := netip.AddrFrom16([16]byte(reply[4:20])); got != want {
+		t.Fatalf("BND.ADDR = %v, want %v", got, want)
+	}
+	if port := int(reply[20])<<8 | int(reply[21]); port == 0 {
+		t.Fatal("BND.PORT = 0, want the outbound connection's port")
+	}
+}
+
+func TestSOCKSBoundAddrFamily(t *testing.T) {
+	// Not parallel: mutates the package-level socksBindIP, socksBindIP6 and
+	// socksBindFamily.
+	origIP, origIP6, origFamily := socksBindIP, socksBindIP6, socksBindFamily
+	defer func() { socksBindIP, socksBindIP6, socksBindFamily = origIP, origIP6, origFamily }()
+
+	local4 := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.10:40000"))
+	local6 := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::10]:40000"))
+	client4 := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:100.64.0.9]:5000"))
+	client6 := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[fd7a:115c:a1e0::9]:5000"))
+	tailnet4, tailnet6 := netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")
+
+	for _, tc := range []struct {
+		name          string
+		family        string
+		ip4, ip6      netip.Addr
+		local, client net.Addr
+		want          string
+	}{
+		{"auto uses the tailnet IPv4", bindFamilyAuto, tailnet4, tailnet6, local6, client6, "100.64.0.1:40000"},
+		{"auto without tailnet IPs", bindFamilyAuto, netip.Addr{}, netip.Addr{}, local6, client6, "[2001:db8::10]:40000"},
+		{"4", bindFamily4, tailnet4, tailnet6, local6, client6, "100.64.0.1:40000"},
+		{"6", bindFamily6, tailnet4, tailnet6, local4, client4, "[fd7a:115c:a1e0::1]:40000"},
+		{"6 falls back to the local address", bindFamily6, tailnet4, netip.Addr{}, local6, client4, "[2001:db8::10]:40000"},
+		{"6 falls back to unspecified", bindFamily6, tailnet4, netip.Addr{}, local4, client4, "[::]:40000"},
+		{"4 falls back to unspecified", bindFamily4, netip.Addr{}, tailnet6, local6, client6, "0.0.0.0:40000"},
+		{"client IPv4, mapped", bindFamilyClient, tailnet4, tailnet6, local6, client4, "100.64.0.1:40000"},
+		{"client IPv6", bindFamilyClient, tailnet4, tailnet6, local4, client6, "[fd7a:115c:a1e0::1]:40000"},
+		{"client not TCP", bindFamilyClient, tailnet4, tailnet6, local6, pipeAddr{}, "100.64.0.1:40000"},
+	} {
+		socksBindFamily, socksBindIP, socksBindIP6 = tc.family, tc.ip4, tc.ip6
+		if got := socksBoundAddr(tc.local, tc.client).String(); got != tc.want {
+			t.Errorf("%s: socksBoundAddr = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSOCKSReplyBindFamily6(t *testing.T) {
+	// Not parallel: mutates the package-level socksBindIP6 and
+	// socksBindFamily.
+	origIP6, origFamily := socksBindIP6, socksBindFamily
+	socksBindIP6, socksBindFamily = netip.MustParseAddr("fd7a:115c:a1e0::1"), bindFamily6
+	defer func() { socksBindIP6, socksBindFamily = origIP6, origFamily }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	conn, stop := startSOCKSConn(t)
+	defer stop()
+	assertSOCKSBindAddr6(t, socksConnectReply(t, conn, targetAddr), socksBindIP6)
+}
+
+func TestSOCKSNegotiationTimeout(t *testing.T) {
+	// Not parallel: mutates the package-level handshakeTimeout,
+	// socksNegotiationTimeout, and useBuiltinSOCKS.
+
+	origHandshake, origNegotiation, origBuiltin := handshakeTimeout, socksNegotiationTimeout, useBuiltinSOCKS
+	defer func() {
+		handshakeTimeout, socksNegotiationTimeout, useBuiltinSOCKS = origHandshake, origNegotiation, origBuiltin
+	}()
+	// Disable the overall handshake deadline so only the negotiation
+	// deadline can end the connection.
+	handshakeTimeout = 0
+	socksNegotiationTimeout = 100 * time.Millisecond
+
+	for _, builtin := range []bool{false, true} {
+		useBuiltinSOCKS = builtin
+		t.Run("builtin="+strconv.FormatBool(builtin), func(t *testing.T) {
+			clientConn, stop := startSOCKSConn(t)
+			defer stop()
+
+			// Send the version byte so the connection is routed to SOCKS5,
+			// then stall before finishing the greeting.
+			if _, err := clientConn.Write([]byte{statute.VersionSocks5}); err != nil {
+				t.Fatalf("write version byte: %v", err)
+			}
+			_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, err := clientConn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("stalled greeting was not closed by the server: %v", err)
+			}
+		})
+
+		t.Run("tunnel_outlives_deadline/builtin="+strconv.FormatBool(builtin), func(t *testing.T) {
+			targetAddr, stopTarget := startEchoServer(t)
+			defer stopTarget()
+
+			clientConn, stop := startSOCKSConn(t)
+			defer stop()
+			if rep := socksConnect(t, clientConn, targetAddr); rep != statute.RepSuccess {
+				t.Fatalf("SOCKS reply = %d, want success", rep)
+			}
+			time.Sleep(3 * socksNegotiationTimeout)
+
+			_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+			if _, err := clientConn.Write([]byte("ping")); err != nil {
+				t.Fatalf("write through tunnel: %v", err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(clientConn, buf); err != nil {
+				t.Fatalf("tunnel closed after negotiation deadline: %v", err)
+			}
+		})
+	}
+}
+
+// startSOCKSConn runs handleConn on one end of a pipe and returns the
+// client end. stop closes the client and waits for the handler to exit.
+func TestSOCKSSingleWriteHandshake(t *testing.T) {
+	// Not parallel: mutates the package-level useBuiltinSOCKS.
+	orig := useBuiltinSOCKS
+	defer func() { useBuiltinSOCKS = orig }()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	for _, builtin := range []bool{false, true} {
+		useBuiltinSOCKS = builtin
+		conn, stop := startSOCKSConn(t)
+
+		// Greeting, CONNECT, and the first tunnel bytes in one write: all
+		// of it lands in handleConn's peek buffer, so the handler has to
+		// read through peekedConn to see any of it.
+		msg := []byte{statute.VersionSocks5, 1, statute.MethodNoAuth}
+		msg = append(msg, socksConnectRequest(t, targetAddr)...)
+		msg = append(msg, "ping"...)
+		go func() { _, _ = conn.Write(msg) }()
+
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		// Method selection (2), then VER REP RSV ATYP and an IPv4 BND (10),
+		// then the echoed bytes.
+		got := make([]byte, 2+10+4)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("builtin=%v: read replies and echo: %v (got %x)", builtin, err, got)
+		}
+		if got[1] != statute.MethodNoAuth || got[3] != statute.RepSuccess || string(got[12:]) != "ping" {
+			t.Fatalf("builtin=%v: got %x, want no-auth, success, then the echoed ping", builtin, got)
+		}
+		stop()
+	}
+}
+
+func TestSOCKSFQDNFailsOver(t *testing.T) {
+	// Not parallel: mutates the package-level lookupNetIP.
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	_, port, _ := net.SplitHostPort(targetAddr)
+
+	origLookup := lookupNetIP
+	defer func() { lookupNetIP = origLookup }()
+	var lookups atomic.Int32
+	lookupNetIP = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		lookups.Add(1)
+		// Nothing listens on 127.0.0.2, so the dial must fail over.
+		return []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}, nil
+	}
+
+	conn, stop := startSOCKSConn(t)
+	defer stop()
+	if rep := socksConnect(t, conn, net.JoinHostPort("echo.test", port)); rep != statute.RepSuccess {
+		t.Fatalf("SOCKS connect to a name whose first address refuses: reply %d, want success", rep)
+	}
+	// The name is resolved once, by the dial, not also by go-socks5.
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("resolved the target %d times, want 1", n)
+	}
+}
+
+func TestSOCKSTunnelAccessLog(t *testing.T) {
+	t.Parallel()
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	// The default go-socks5 handler: its tunnels go through relay too.
+	clientConn, serverConn := net.Pipe()
+	var logs syncBuffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.NewTextHandler(&logs, nil)))
+	}()
+
+	if rep := socksConnect(t, clientConn, targetAddr); rep != statute.RepSuccess {
+		t.Fatalf("SOCKS connect reply = %d, want success", rep)
+	}
+	go func() { _, _ = io.WriteString(clientConn, "ping") }()
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo = %q, %v, want ping", echo, err)
+	}
+	_ = clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("SOCKS handler did not exit after client close")
+	}
+
+	got := logs.String()
+	for _, want := range []string{`msg="tunnel closed" protocol=socks5`, "conn_id=", "target=" + targetAddr, "reason=", "duration=", "bytes_client_to_target=4", "bytes_target_to_client=4"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("access log = %q, want %s", got, want)
+		}
+	}
+}
+
+func TestSOCKSTunnelAccessLogIdentity(t *testing.T) {
+	// Not parallel: mutates the package-level perUserLimiter, whoIsLogin,
+	// and useBuiltinSOCKS.
+	origLimiter, origWhoIs, origBuiltin := perUserLimiter, whoIsLogin, useBuiltinSOCKS
+	defer func() { perUserLimiter, whoIsLogin, useBuiltinSOCKS = origLimiter, origWhoIs, origBuiltin }()
+	perUserLimiter = newConnLimiter(10)
+	whoIsLogin = fakeWhoIs("alice@example.com")
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+
+	for _, builtin := range []bool{false, true} {
+		useBuiltinSOCKS = builtin
+		clientConn, serverConn := net.Pipe()
+		var logs syncBuffer
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleConn(context.Background(), serverConn, listenerOptions{}, slog.New(slog.NewTextHandler(&logs, nil)))
+		}()
+		if rep := socksConnect(t, clientConn, targetAddr); rep != statute.RepSuccess {
+			t.Fatalf("builtin=%v: SOCKS connect reply = %d, want success", builtin, rep)
+		}
+		_ = clientConn.Close()
+		<-done
+
+		got := logs.String()
+		for _, want := range []string{`msg="tunnel closed"`, "conn_id=", "user=alice@example.com"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("builtin=%v: access log = %q, want %s", builtin, got, want)
+			}
+		}
+	}
+}
+
+func TestSOCKSAccessLogKeepsName(t *testing.T) {
+	// Not parallel: mutates the package-level lookupNetIP.
+	echoAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	_, port, _ := net.SplitHostPort(echoAddr)
+	targetAddr := net.JoinHostPort("echo.test", port)
+
+	origLookup := lookupNetIP
+	defer func() { lookupNetIP = origLookup }()
+	lookupNetIP = func(context.Context, string, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}
+
+	for _, builtin := range []bool{false, true} {
+		// startSOCKSConn discards logs, so run handleConn here.
+		clientConn, serverConn := net.Pipe()
+		var logs syncBuffer
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if builtin {
+				handleSOCKS5Builtin(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, serverConn, slog.New(slog.NewTextHandler(&logs, nil)))
+				return
+			}
+			serveSOCKS(context.Background(), newHandshake(context.Background(), serverConn, 0), serverConn, slog.New(slog.NewTextHandler(&logs, nil)))
+		}()
+		if rep := socksConnect(t, clientConn, targetAddr); rep != statute.RepSuccess {
+			t.Fatalf("builtin=%v: SOCKS connect reply = %d, want success", builtin, rep)
+		}
+		_ = clientConn.Close()
+		<-done
+
+		got := logs.String()
+		for _, want := range []string{"target=" + targetAddr, "resolved_ip=127.0.0.1"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("builtin=%v: access log = %q, want %s", builtin, got, want)
+			}
+		}
+	}
+}
+
+func startSOCKSConn(t *testing.T) (clientConn net.Conn, stop func()) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleConn(context.Background(), serverConn, listenerOptions{}, logger)
+	}()
+
+	return clientConn, func() {
+		_ = clientConn.Close()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("SOCKS handler did not exit after client close")
+		}
+	}
+}
+
+// socksConnect performs a no-auth SOCKS5 greeting and a CONNECT to
+// targetAddr, an IPv4 address or a host name, returning the server's reply
+// code.
+func socksConnect(t *testing.T, conn net.Conn, targetAddr string) byte {
+	t.Helper()
+	return socksConnectReply(t, conn, targetAddr)[1]
+}
+
+// socksConnectReply is socksConnect but returns the whole reply.
+func socksConnectReply(t *testing.T, conn net.Conn, targetAddr string) []byte {
+	t.Helper()
+	return socksRequestReply(t, conn, statute.CommandConnect, targetAddr)
+}
+
+// socksRequestReply is socksConnectReply for any SOCKS5 command.
+func socksRequestReply(t *testing.T, conn net.Conn, cmd byte, targetAddr string) []byte {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{}) //nolint:errcheck // test cleanup
+
+	if _, err := conn.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}); err != nil {
+		t.Fatalf("write SOCKS greeting: %v", err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatalf("read SOCKS method selection: %v", err)
+	}
+	if method[1] != statute.MethodNoAuth {
+		t.Fatalf("unexpected SOCKS method %d", method[1])
+	}
+
+	req := socksConnectRequest(t, targetAddr)
+	req[1] = cmd
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write SOCKS request: %v", err)
+	}
+	// VER REP RSV ATYP ADDR PORT(2), where ADDR is 4 bytes for IPv4 and
+	// 16 for IPv6.
+	reply := make([]byte, 4, 22)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read SOCKS reply: %v", err)
+	}
+	n := 4 + 2
+	if reply[3] == statute.ATYPIPv6 {
+		n = 16 + 2
+	}
+	reply = reply[:4+n]
+	if _, err := io.ReadFull(conn, reply[4:]); err != nil {
+		t.Fatalf("read SOCKS reply address: %v", err)
+	}
+	return reply
+}
+
+func socksConnectRequest(t *testing.T, targetAddr string) []byte {
+	t.Helper()
+
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		t.Fatalf("split target %q: %v", targetAddr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("parse port %q: %v", portStr, err)
+	}
+
+	var req []byte
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		req = []byte{statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPDomain, byte(len(host))}
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = []byte{statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPIPv4}
+		req = append(req, ip.To4()...)
+	default:
+		t.Fatalf("target %q is not IPv4 or a host name", targetAddr)
+	}
+	return append(req, byte(port>>8), byte(port))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// State directory failure reasons reported by checkStateDir.
+const (
+	stateDirPermission    = "permission_denied"
+	stateDirMissingParent = "missing_parent"
+	stateDirNotDirectory  = "not_a_directory"
+	stateDirReadOnly      = "read_only_filesystem"
+	stateDirOtherFailed   = "unusable"
+)
+
+// checkStateDir creates dir if needed, the same way tsnet would, and
+// proves it is writable by creating and removing a file in it. On failure
+// it returns a reason and an actionable hint alongside the error, so
+// problems surface before tsnet.Server.Up turns them into something
+// cryptic.
+func checkStateDir(dir string) (reason, hint string, err error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		reason, hint := classifyStateDirError(err)
+		return reason, hint, err
+	}
+	f, err := os.CreateTemp(dir, ".tailgate-write-check-*")
+	if err != nil {
+		reason, hint := classifyStateDirError(err)
+		return reason, hint, err
+	}
+	name := f.Name()
+	_ = f.Close()
+	_ = os.Remove(name)
+	return "", "", nil
+}
+
+func classifyStateDirError(err error) (reason, hint string) {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return stateDirPermission, "the user running tailgate can't write here; fix the ownership or mode, or choose another -state-dir"
+	case errors.Is(err, syscall.ENOTDIR):
+		return stateDirNotDirectory, "a component of the path is a regular file; choose another -state-dir"
+	case errors.Is(err, fs.ErrNotExist):
+		return stateDirMissingParent, "a parent directory disappeared or is a dangling symlink; create it or choose another -state-dir"
+	case errors.Is(err, syscall.EROFS):
+		return stateDirReadOnly, "the filesystem is mounted read-only; point -state-dir at persistent writable storage"
+	}
+	return stateDirOtherFailed, "check that the path exists and is writable by the user running tailgate"
+}
+
+// exitStateDirError logs a failed state directory check and exits with
+// status 1.
+func exitStateDirError(dir, reason, hint string, err error) {
+	slog.Error("tsnet state directory is not usable", "state_dir", dir, "reason", reason, "hint", hint, "error", err)
+	os.Exit(1)
+}
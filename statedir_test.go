@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCheckStateDirCreatesMissingDir(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "a", "b", "state")
+	if reason, _, err := checkStateDir(dir); err != nil {
+		t.Fatalf("checkStateDir = %q, %v; want success", reason, err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("state dir not created: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("write check left files behind: %v", entries)
+	}
+}
+
+func TestCheckStateDirUnwritable(t *testing.T) {
+	t.Parallel()
+	if os.Geteuid() == 0 {
+		t.Skip("root bypasses directory permissions")
+	}
+
+	parent := t.TempDir()
+	if err := os.Chmod(parent, 0o500); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	defer os.Chmod(parent, 0o700) //nolint:errcheck // test cleanup
+
+	for _, dir := range []string{parent, filepath.Join(parent, "state")} {
+		reason, hint, err := checkStateDir(dir)
+		if err == nil || reason != stateDirPermission || hint == "" {
+			t.Fatalf("checkStateDir(%q) = %q, %q, %v; want %q", dir, reason, hint, err, stateDirPermission)
+		}
+	}
+}
+
+func TestCheckStateDirUnderFile(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	reason, _, err := checkStateDir(filepath.Join(file, "state"))
+	if err == nil || reason != stateDirNotDirectory {
+		t.Fatalf("checkStateDir under a file = %q, %v; want %q", reason, err, stateDirNotDirectory)
+	}
+}
+
+func TestClassifyStateDirError(t *testing.T) {
+	t.Parallel()
+
+	pathErr := func(err error) error { return &fs.PathError{Op: "mkdir", Path: "/x", Err: err} }
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: pathErr(syscall.EACCES), want: stateDirPermission},
+		{err: pathErr(syscall.EPERM), want: stateDirPermission},
+		{err: pathErr(syscall.ENOENT), want: stateDirMissingParent},
+		{err: pathErr(syscall.ENOTDIR), want: stateDirNotDirectory},
+		{err: fmt.Errorf("wrapped: %w", pathErr(syscall.EROFS)), want: stateDirReadOnly},
+		{err: errors.New("boom"), want: stateDirOtherFailed},
+	}
+	for _, tc := range tests {
+		if got, hint := classifyStateDirError(tc.err); got != tc.want || hint == "" {
+			t.Errorf("classifyStateDirError(%v) = %q (hint %q), want %q", tc.err, got, hint, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START in sd-daemon.h).
+const listenFDsStart = 3
+
+// systemdListeners returns the listening sockets inherited via systemd socket
+// activation, or nil if the process was not socket activated. The LISTEN_*
+// variables are cleared so child processes don't mistake them for their own.
+func systemdListeners() ([]net.Listener, error) {
+	n, err := listenFDCount(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		// FileListener dups the descriptor, so the original is closed either way.
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// listenFDCount interprets the LISTEN_PID and LISTEN_FDS environment values.
+// It returns 0 when the variables are absent or addressed to another process.
+func listenFDCount(pidEnv, fdsEnv string, pid int) (int, error) {
+	if pidEnv == "" || fdsEnv == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(pidEnv)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LISTEN_PID %q", pidEnv)
+	}
+	if p != pid {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", fdsEnv)
+	}
+	return n, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestListenFDCount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+		want int
+		ok   bool
+	}{
+		{name: "not_activated", want: 0, ok: true},
+		{name: "one_fd", pid: "42", fds: "1", want: 1, ok: true},
+		{name: "multiple_fds", pid: "42", fds: "3", want: 3, ok: true},
+		{name: "other_process", pid: "7", fds: "2", want: 0, ok: true},
+		{name: "bad_pid", pid: "abc", fds: "1", ok: false},
+		{name: "bad_fds", pid: "42", fds: "-1", ok: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := listenFDCount(tc.pid, tc.fds, 42)
+			if tc.ok && err != nil {
+				t.Fatalf("listenFDCount(%q, %q) unexpected err: %v", tc.pid, tc.fds, err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatalf("listenFDCount(%q, %q) expected error", tc.pid, tc.fds)
+			}
+			if tc.ok && got != tc.want {
+				t.Fatalf("listenFDCount(%q, %q) = %d, want %d", tc.pid, tc.fds, got, tc.want)
+			}
+		})
+	}
+}
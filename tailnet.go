@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// tailnetStatus is published alongside the proxy counters when the admin
+// listener is enabled. Values are gauges overwritten on every sample.
+var tailnetStatus = expvar.NewMap("tailnet")
+
+// tailnetSummary is the subset of ipnstate.Status that tailgate reports.
+type tailnetSummary struct {
+	peers       int
+	online      int
+	active      int
+	direct      int // active peers reached over a direct UDP path
+	derp        int // active peers relayed through DERP
+	peerRelay   int // active peers relayed through another tailnet node
+	health      int
+	backendName string
+}
+
+func summarizeTailnet(st *ipnstate.Status) tailnetSummary {
+	s := tailnetSummary{
+		peers:       len(st.Peer),
+		health:      len(st.Health),
+		backendName: st.BackendState,
+	}
+	for _, ps := range st.Peer {
+		if ps.Online {
+			s.online++
+		}
+		if !ps.Active {
+			continue
+		}
+		s.active++
+		switch {
+		case ps.CurAddr != "":
+			s.direct++
+		case ps.PeerRelay != "":
+			s.peerRelay++
+		case ps.Relay != "":
+			s.derp++
+		}
+	}
+	return s
+}
+
+func (s tailnetSummary) publish() {
+	set := func(key string, v int) {
+		n := new(expvar.Int)
+		n.Set(int64(v))
+		tailnetStatus.Set(key, n)
+	}
+	set("peers", s.peers)
+	set("peers_online", s.online)
+	set("peers_active", s.active)
+	set("paths_direct", s.direct)
+	set("paths_derp", s.derp)
+	set("paths_peer_relay", s.peerRelay)
+	set("health_warnings", s.health)
+}
+
+// sampleTailnet polls status every interval until ctx is cancelled. It runs
+// in its own goroutine so a slow LocalAPI never holds up the accept loop;
+// each call is bounded by the interval.
+func sampleTailnet(ctx context.Context, interval time.Duration, status func(context.Context) (*ipnstate.Status, error), logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prevHealth := -1
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, interval)
+		st, err := status(callCtx)
+		cancel()
+		switch {
+		case err != nil && ctx.Err() == nil:
+			logger.Debug("tailnet status sample failed", "error", err)
+		case err == nil:
+			s := summarizeTailnet(st)
+			s.publish()
+			logger.Debug(
+				"tailnet status",
+				"backend_state", s.backendName,
+				"peers", s.peers,
+				"peers_online", s.online,
+				"peers_active", s.active,
+				"paths_direct", s.direct,
+				"paths_derp", s.derp,
+				"paths_peer_relay", s.peerRelay,
+			)
+			if s.health != prevHealth {
+				if s.health > 0 {
+					logger.Warn("tailnet health warnings", "warnings", st.Health)
+				} else if prevHealth > 0 {
+					logger.Info("tailnet health recovered")
+				}
+			}
+			prevHealth = s.health
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestSummarizeTailnet(t *testing.T) {
+	t.Parallel()
+
+	st := &ipnstate.Status{
+		BackendState: "Running",
+		Health:       []string{"dns unavailable"},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {Online: true, Active: true, CurAddr: "192.0.2.1:41641"},
+			key.NewNode().Public(): {Online: true, Active: true, Relay: "nyc"},
+			key.NewNode().Public(): {Online: true, Active: true, Relay: "nyc", PeerRelay: "192.0.2.9:7777:vni:1"},
+			key.NewNode().Public(): {Online: true},
+			key.NewNode().Public(): {},
+		},
+	}
+
+	got := summarizeTailnet(st)
+	want := tailnetSummary{
+		peers:       5,
+		online:      4,
+		active:      3,
+		direct:      1,
+		derp:        1,
+		peerRelay:   1,
+		health:      1,
+		backendName: "Running",
+	}
+	if got != want {
+		t.Fatalf("summarizeTailnet = %+v, want %+v", got, want)
+	}
+}
+
+func TestSampleTailnetStopsOnCancel(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	status := func(context.Context) (*ipnstate.Status, error) {
+		if calls.Add(1) == 2 {
+			cancel()
+		}
+		return &ipnstate.Status{}, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sampleTailnet(ctx, time.Millisecond, status, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sampleTailnet did not return after cancel")
+	}
+	if n := calls.Load(); n < 2 {
+		t.Fatalf("status called %d times, want at least 2", n)
+	}
+}
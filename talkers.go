@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// tunnelRates measures each open tunnel's throughput over a sliding
+// window, published as the top_talkers expvar and served at admin
+// /talkers. nil (the default) measures nothing.
+var tunnelRates *rateTracker
+
+func init() {
+	expvar.Publish("top_talkers", expvar.Func(func() any { return tunnelRates.top() }))
+}
+
+// rateSlots is how many buckets a tunnel's window is split into; bytes
+// age out one bucket at a time.
+const rateSlots = 10
+
+// rateTracker holds a tunnelMeter for every open tunnel.
+type rateTracker struct {
+	n      int
+	window time.Duration
+	slot   time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	tunnels map[*tunnelMeter]struct{}
+}
+
+// tunnelMeter counts one tunnel's bytes in rateSlots buckets. Only the
+// tunnel's two relay goroutines and readers of top take its lock, so it
+// is all but uncontended.
+type tunnelMeter struct {
+	t                        *rateTracker
+	protocol, client, target string
+	start                    time.Time
+
+	mu    sync.Mutex
+	slots [rateSlots]rateSlot
+}
+
+type rateSlot struct {
+	n    int64 // slot number: time since the epoch in slots
+	up   int64 // client to target
+	down int64 // target to client
+}
+
+// tunnelTalker is one entry of top_talkers. Rates are in bytes per second
+// over the window, or over the tunnel's life if it is younger.
+type tunnelTalker struct {
+	Protocol       string `json:"protocol"`
+	Remote         string `json:"remote"`
+	Target         string `json:"target"`
+	Duration       string `json:"duration"`
+	BytesPerSec    int64  `json:"bytes_per_sec"`
+	ClientToTarget int64  `json:"client_to_target"`
+	TargetToClient int64  `json:"target_to_client"`
+}
+
+// newRateTracker returns a tracker reporting the n busiest tunnels over
+// window, or nil when n or window is not positive.
+func newRateTracker(n int, window time.Duration) *rateTracker {
+	if n <= 0 || window <= 0 {
+		return nil
+	}
+	return &rateTracker{
+		n:       n,
+		window:  window,
+		slot:    max(window/rateSlots, 1),
+		now:     time.Now,
+		tunnels: make(map[*tunnelMeter]struct{}),
+	}
+}
+
+// open starts measuring a tunnel. The caller must close the meter when
+// the tunnel ends. A nil tracker returns a nil meter, which measures
+// nothing.
+func (t *rateTracker) open(protocol, client, target string) *tunnelMeter {
+	if t == nil {
+		return nil
+	}
+	m := &tunnelMeter{t: t, protocol: protocol, client: client, target: target, start: t.now()}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tunnels[m] = struct{}{}
+	return m
+}
+
+func (m *tunnelMeter) close() {
+	if m == nil {
+		return
+	}
+	m.t.mu.Lock()
+	defer m.t.mu.Unlock()
+	delete(m.t.tunnels, m)
+}
+
+// add counts n bytes relayed from the client (up) or from the target.
+func (m *tunnelMeter) add(up bool, n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	slot := m.t.now().UnixNano() / int64(m.t.slot)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &m.slots[slot%rateSlots]
+	if s.n != slot {
+		*s = rateSlot{n: slot}
+	}
+	if up {
+		s.up += n
+	} else {
+		s.down += n
+	}
+}
+
+// rate returns the tunnel's bytes per second in each direction.
+func (m *tunnelMeter) rate(now time.Time) (up, down int64) {
+	cur := now.UnixNano() / int64(m.t.slot)
+	m.mu.Lock()
+	for _, s := range m.slots {
+		if s.n > cur-rateSlots && s.n <= cur {
+			up += s.up
+			down += s.down
+		}
+	}
+	m.mu.Unlock()
+	span := min(m.t.window, now.Sub(m.start))
+	secs := max(span.Seconds(), m.t.slot.Seconds())
+	return int64(float64(up) / secs), int64(float64(down) / secs)
+}
+
+// top returns the n open tunnels relaying the most bytes per second,
+// busiest first.
+func (t *rateTracker) top() []tunnelTalker {
+	if t == nil {
+		return []tunnelTalker{}
+	}
+	t.mu.Lock()
+	meters := make([]*tunnelMeter, 0, len(t.tunnels))
+	for m := range t.tunnels {
+		meters = append(meters, m)
+	}
+	t.mu.Unlock()
+
+	now := t.now()
+	out := make([]tunnelTalker, 0, len(meters))
+	for _, m := range meters {
+		up, down := m.rate(now)
+		if up+down == 0 {
+			continue
+		}
+		out = append(out, tunnelTalker{
+			Protocol:       m.protocol,
+			Remote:         m.client,
+			Target:         m.target,
+			Duration:       now.Sub(m.start).Round(time.Second).String(),
+			BytesPerSec:    up + down,
+			ClientToTarget: up,
+			TargetToClient: down,
+		})
+	}
+	slices.SortFunc(out, func(a, b tunnelTalker) int {
+		return cmp.Or(cmp.Compare(b.BytesPerSec, a.BytesPerSec), cmp.Compare(a.Remote, b.Remote), cmp.Compare(a.Target, b.Target))
+	})
+	return out[:min(len(out), t.n)]
+}
+
+// serveTopTalkers serves top_talkers as a JSON array.
+func serveTopTalkers(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tunnelRates.top())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateTrackerTop(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1_000_000, 0)
+	tr := newRateTracker(2, 10*time.Second)
+	tr.now = func() time.Time { return now }
+
+	bulk := tr.open("http-connect", "100.64.0.1:5000", "example.com:443")
+	chatty := tr.open("socks5", "100.64.0.2:5000", "example.com:22")
+	idle := tr.open("socks5", "100.64.0.3:5000", "example.com:80")
+	defer idle.close()
+	gone := tr.open("socks5", "100.64.0.4:5000", "example.com:80")
+	gone.add(true, 1<<30)
+	gone.close()
+
+	now = now.Add(10 * time.Second)
+	bulk.add(false, 8_000_000)
+	bulk.add(true, 2_000_000)
+	chatty.add(true, 50_000)
+
+	top := tr.top()
+	if len(top) != 2 {
+		t.Fatalf("top = %+v, want the 2 busy open tunnels", top)
+	}
+	if got := top[0]; got.Target != "example.com:443" || got.BytesPerSec != 1_000_000 || got.ClientToTarget != 200_000 || got.TargetToClient != 800_000 {
+		t.Fatalf("top[0] = %+v, want example.com:443 at 1MB/s", got)
+	}
+	if got := top[1]; got.Remote != "100.64.0.2:5000" || got.BytesPerSec != 5_000 {
+		t.Fatalf("top[1] = %+v, want 100.64.0.2:5000 at 5kB/s", got)
+	}
+
+	// Bytes age out of the window a slot at a time.
+	now = now.Add(5 * time.Second)
+	chatty.add(true, 50_000)
+	if top := tr.top(); len(top) != 2 || top[0].BytesPerSec != 1_000_000 {
+		t.Fatalf("top after 5s = %+v, want the first burst still counted", top)
+	}
+	now = now.Add(6 * time.Second)
+	top = tr.top()
+	if len(top) != 1 || top[0].Remote != "100.64.0.2:5000" || top[0].BytesPerSec != 5_000 {
+		t.Fatalf("top after 11s = %+v, want only the later burst", top)
+	}
+
+	bulk.close()
+	chatty.close()
+	if top := tr.top(); len(top) != 0 {
+		t.Fatalf("top after close = %+v, want none", top)
+	}
+}
+
+func TestRateTrackerYoungTunnel(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1_000_000, 0)
+	tr := newRateTracker(1, 10*time.Second)
+	tr.now = func() time.Time { return now }
+
+	m := tr.open("socks5", "100.64.0.1:5000", "example.com:443")
+	defer m.close()
+	now = now.Add(2 * time.Second)
+	m.add(true, 2_000_000)
+	if top := tr.top(); len(top) != 1 || top[0].BytesPerSec != 1_000_000 {
+		t.Fatalf("top = %+v, want 1MB/s over the tunnel's 2s, not the 10s window", top)
+	}
+}
+
+func TestNewRateTrackerDisabled(t *testing.T) {
+	t.Parallel()
+
+	tr := newRateTracker(0, time.Second)
+	if tr != nil {
+		t.Fatalf("newRateTracker(0, 1s) = %v, want nil", tr)
+	}
+	m := tr.open("socks5", "client", "target")
+	m.add(true, 1)
+	m.close()
+	if top := tr.top(); top == nil || len(top) != 0 {
+		t.Fatalf("nil tracker top = %#v, want an empty list", top)
+	}
+}
+
+func TestRelayMetersTunnel(t *testing.T) {
+	// Not parallel: mutates the package-level tunnelRates.
+	orig := tunnelRates
+	tunnelRates = newRateTracker(5, time.Minute)
+	defer func() { tunnelRates = orig }()
+
+	clientConn, clientPeer := net.Pipe()
+	targetConn, targetPeer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(context.Background(), clientPeer, targetPeer, slog.New(slog.DiscardHandler), "http-connect", "100.64.0.1:5000", "example.com:443")
+	}()
+	go func() { _, _ = io.Copy(io.Discard, targetConn) }()
+
+	if _, err := clientConn.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// The relay counts bytes once it has written them on, just after
+	// the write above returns.
+	var rec *httptest.ResponseRecorder
+	var top []tunnelTalker
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		rec = httptest.NewRecorder()
+		serveTopTalkers(rec, httptest.NewRequest("GET", "/talkers", nil))
+		if err := json.Unmarshal(rec.Body.Bytes(), &top); err != nil {
+			t.Fatalf("decode /talkers: %v", err)
+		}
+		if len(top) > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(top) != 1 || top[0].Target != "example.com:443" || top[0].ClientToTarget == 0 {
+		t.Fatalf("/talkers = %s, want the open tunnel with client bytes", rec.Body)
+	}
+
+	_ = clientConn.Close()
+	_ = targetConn.Close()
+	<-done
+	if top := tunnelRates.top(); len(top) != 0 {
+		t.Fatalf("top after the tunnel ended = %+v, want none", top)
+	}
+}
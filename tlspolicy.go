@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// tlsRequiredPorts, when non-nil, lists destination ports whose HTTP
+// CONNECT tunnels must start with a TLS record from the client; anything
+// else is closed as a policy violation.
+var tlsRequiredPorts map[int]bool
+
+// tlsFirstByteTimeout bounds how long a tunnel to a TLS-required port waits
+// for the client to speak first. Server-first protocols never do, so they
+// are closed once it expires.
+var tlsFirstByteTimeout = 10 * time.Second
+
+// tlsRequired reports whether tunnels to the "host:port" targetAddr must
+// carry TLS.
+func tlsRequired(targetAddr string) bool {
+	if tlsRequiredPorts == nil {
+		return false
+	}
+	_, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	return err == nil && tlsRequiredPorts[port]
+}
+
+// firstClientBytes returns pending if the client already sent tunnel data
+// along with its request, and otherwise reads the client's first byte from
+// conn, waiting at most timeout. The result is what the relay must replay
+// ahead of conn.
+func firstClientBytes(conn net.Conn, pending []byte, timeout time.Duration) ([]byte, error) {
+	if len(pending) > 0 {
+		return pending, nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{}) //nolint:errcheck // best-effort cleanup
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
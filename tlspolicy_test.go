@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSRequired(t *testing.T) {
+	// Not parallel: mutates the package-level tlsRequiredPorts.
+
+	orig := tlsRequiredPorts
+	defer func() { tlsRequiredPorts = orig }()
+
+	tlsRequiredPorts = nil
+	if tlsRequired("example.com:443") {
+		t.Fatal("tlsRequired with no ports configured = true")
+	}
+
+	tlsRequiredPorts = map[int]bool{443: true}
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"example.com:443", true},
+		{"[::1]:443", true},
+		{"example.com:80", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := tlsRequired(tt.target); got != tt.want {
+			t.Errorf("tlsRequired(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+// requireTLSForTarget marks targetAddr's port TLS-only and shortens the
+// first-byte wait for the duration of the test.
+func requireTLSForTarget(t *testing.T, targetAddr string) {
+	t.Helper()
+	_, portStr, _ := net.SplitHostPort(targetAddr)
+	port, _ := strconv.Atoi(portStr)
+
+	origPorts, origTimeout := tlsRequiredPorts, tlsFirstByteTimeout
+	tlsRequiredPorts = map[int]bool{port: true}
+	tlsFirstByteTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { tlsRequiredPorts, tlsFirstByteTimeout = origPorts, origTimeout })
+}
+
+func TestHandleHTTPConnectRequireTLS(t *testing.T) {
+	// Not parallel: mutates the package-level tlsRequiredPorts and
+	// tlsFirstByteTimeout.
+
+	targetAddr, stopTarget := startEchoServer(t)
+	defer stopTarget()
+	requireTLSForTarget(t, targetAddr)
+
+	t.Run("tls_allowed", func(t *testing.T) {
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer func() {
+			_ = clientConn.Close()
+			<-done
+		}()
+
+		hello := "\x16\x03\x01hello"
+		go func() { _, _ = io.WriteString(clientConn, hello) }()
+		_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, len(hello))
+		if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatalf("read echoed TLS record: %v", err)
+		}
+		if string(buf) != hello {
+			t.Fatalf("echoed %q, want %q", buf, hello)
+		}
+	})
+
+	t.Run("plaintext_closed", func(t *testing.T) {
+		// Not parallel: mutates the package-level accessLogger.
+		var out syncBuffer
+		origLogger := accessLogger
+		defer func() { accessLogger = origLogger }()
+		accessLogger = slog.New(slog.NewTextHandler(&out, nil))
+
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer clientConn.Close() //nolint:errcheck // test cleanup
+
+		// Only the first byte is read before the handler gives up, so the
+		// rest of the write is never relayed.
+		go func() { _, _ = io.WriteString(clientConn, "SSH-2.0-smuggled\r\n") }()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("plaintext tunnel was not closed")
+		}
+		if got := out.String(); !strings.Contains(got, `msg="tunnel closed" protocol=http`) || !strings.Contains(got, "reason=policy-closed closed_by=proxy") {
+			t.Fatalf("access log = %q, want a policy-closed record closed by the proxy", got)
+		}
+	})
+
+	t.Run("silent_client_closed", func(t *testing.T) {
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer clientConn.Close() //nolint:errcheck // test cleanup
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatal("tunnel with no client data was not closed")
+		}
+	})
+}
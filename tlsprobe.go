@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// tlsProbeTargets, when non-nil, is the set of "host:port" targets (keyed
+// by targetKey) whose HTTP CONNECT only succeeds after a TLS handshake
+// with the target does.
+var tlsProbeTargets map[string]bool
+
+// tlsProbeTimeout bounds the probe handshake.
+var tlsProbeTimeout = 5 * time.Second
+
+// parseTLSProbeTargets parses a comma-separated list of host[:port]
+// targets; the port defaults to 443 as it does for CONNECT.
+func parseTLSProbeTargets(s string) (map[string]bool, error) {
+	targets := make(map[string]bool)
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		targetAddr, err := connectTarget(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", field, err)
+		}
+		targets[targetKey(targetAddr)] = true
+	}
+	return targets, nil
+}
+
+// tlsProbeRequired reports whether targetAddr must pass a TLS probe.
+func tlsProbeRequired(targetAddr string) bool {
+	return tlsProbeTargets != nil && tlsProbeTargets[targetKey(targetAddr)]
+}
+
+// probeTargetTLS completes a TLS handshake with the target over conn and
+// closes it. It only checks that the target speaks TLS, not who it is:
+// the certificate is left to the client, which verifies it inside the
+// tunnel.
+func probeTargetTLS(ctx context.Context, conn net.Conn, targetAddr string) error {
+	defer conn.Close() //nolint:errcheck // best-effort cleanup
+	ctx, cancel := context.WithTimeout(ctx, tlsProbeTimeout)
+	defer cancel()
+	host, _, _ := net.SplitHostPort(targetAddr)
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, //nolint:gosec // liveness check only; the client verifies the tunnel
+	})
+	return tc.HandshakeContext(ctx)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTLSProbeTargets(t *testing.T) {
+	t.Parallel()
+
+	got, err := parseTLSProbeTargets(" API.example.com. , 10.0.0.1:8443,,[::1]")
+	if err != nil {
+		t.Fatalf("parseTLSProbeTargets: %v", err)
+	}
+	for _, key := range []string{"api.example.com:443", "10.0.0.1:8443", "[::1]:443"} {
+		if !got[key] {
+			t.Errorf("missing %q in %v", key, got)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d targets, want 3: %v", len(got), got)
+	}
+	if _, err := parseTLSProbeTargets("example.com:0"); err == nil {
+		t.Fatal("expected error for port 0")
+	}
+}
+
+// probeTLSForTarget requires a TLS probe for targetAddr and shortens the
+// probe timeout for the duration of the test.
+func probeTLSForTarget(t *testing.T, targetAddr string) {
+	t.Helper()
+	origTargets, origTimeout := tlsProbeTargets, tlsProbeTimeout
+	tlsProbeTargets = map[string]bool{targetKey(targetAddr): true}
+	tlsProbeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { tlsProbeTargets, tlsProbeTimeout = origTargets, origTimeout })
+}
+
+func TestHandleHTTPConnectTLSProbe(t *testing.T) {
+	// Not parallel: mutates the package-level tlsProbeTargets and
+	// tlsProbeTimeout.
+
+	t.Run("tls_target", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, "hello")
+		}))
+		defer srv.Close()
+		targetAddr := srv.Listener.Addr().String()
+		probeTLSForTarget(t, targetAddr)
+
+		clientConn, done := openHTTPTunnel(t, targetAddr)
+		defer func() { _ = clientConn.Close(); <-done }()
+
+		// The probe's connection is gone; the tunnel must still carry a
+		// full TLS session on a fresh one.
+		_ = clientConn.SetDeadline(time.Now().Add(3 * time.Second))
+		tc := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec // test server
+		if _, err := io.WriteString(tc, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"); err != nil {
+			t.Fatalf("write through tunnel: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+		if err != nil {
+			t.Fatalf("read through tunnel: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatalf("tunneled response = %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("plaintext_target", func(t *testing.T) {
+		targetAddr, stopTarget := startEchoServer(t)
+		defer stopTarget()
+		probeTLSForTarget(t, targetAddr)
+
+		status, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n")
+		if !strings.Contains(status, "502") {
+			t.Fatalf("status = %q, want 502", status)
+		}
+	})
+
+	t.Run("silent_target", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer ln.Close() //nolint:errcheck // test cleanup
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close() //nolint:errcheck // test cleanup
+			}
+		}()
+		targetAddr := ln.Addr().String()
+		probeTLSForTarget(t, targetAddr)
+
+		status, _ := executeProxyRequest(t, "CONNECT "+targetAddr+" HTTP/1.1\r\nHost: "+targetAddr+"\r\n\r\n")
+		if !strings.Contains(status, "502") {
+			t.Fatalf("status = %q, want 502", status)
+		}
+	})
+}
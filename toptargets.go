@@ -0,0 +1,129 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"expvar"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// targetCounts counts tunnels per target over a rolling window, published
+// as the top_targets expvar. nil (the default) counts nothing.
+var targetCounts *targetCounter
+
+func init() {
+	expvar.Publish("top_targets", expvar.Func(func() any { return targetCounts.top() }))
+}
+
+// targetCounterSlots is how many buckets the window is split into; counts
+// age out one bucket at a time.
+const targetCounterSlots = 10
+
+// maxSlotTargets bounds the distinct targets counted per bucket, so a
+// client scanning many targets can't grow memory without limit. Targets
+// past it are counted under otherTargets.
+const maxSlotTargets = 10000
+
+const otherTargets = "(other)"
+
+// targetCount is one entry of top_targets.
+type targetCount struct {
+	Target string `json:"target"`
+	Count  int64  `json:"count"`
+}
+
+// targetCounter keeps per-target counts in targetCounterSlots buckets
+// covering the last window.
+type targetCounter struct {
+	n      int
+	window time.Duration
+	slot   time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	slots [targetCounterSlots]targetSlot
+}
+
+type targetSlot struct {
+	start  time.Time
+	counts map[string]int64
+}
+
+// newTargetCounter returns a counter reporting the top n targets over
+// window, or nil when n or window is not positive.
+func newTargetCounter(n int, window time.Duration) *targetCounter {
+	if n <= 0 || window <= 0 {
+		return nil
+	}
+	return &targetCounter{n: n, window: window, slot: max(window/targetCounterSlots, 1), now: time.Now}
+}
+
+// record counts one tunnel to targetAddr.
+func (c *targetCounter) record(targetAddr string) {
+	if c == nil {
+		return
+	}
+	start := c.now().Truncate(c.slot)
+	i := int(start.UnixNano()/int64(c.slot)) % targetCounterSlots
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &c.slots[i]
+	if !s.start.Equal(start) {
+		*s = targetSlot{start: start, counts: make(map[string]int64)}
+	}
+	key := targetKey(targetAddr)
+	if _, ok := s.counts[key]; !ok && len(s.counts) >= maxSlotTargets {
+		key = otherTargets
+	}
+	s.counts[key]++
+}
+
+// top returns the n targets with the most tunnels in the window, most
+// first.
+func (c *targetCounter) top() []targetCount {
+	if c == nil {
+		return []targetCount{}
+	}
+	oldest := c.now().Truncate(c.slot).Add(-c.window + c.slot)
+
+	totals := make(map[string]int64)
+	c.mu.Lock()
+	for _, s := range c.slots {
+		if s.start.Before(oldest) {
+			continue
+		}
+		for k, n := range s.counts {
+			totals[k] += n
+		}
+	}
+	c.mu.Unlock()
+
+	out := make([]targetCount, 0, len(totals))
+	for k, n := range totals {
+		out = append(out, targetCount{Target: k, Count: n})
+	}
+	slices.SortFunc(out, func(a, b targetCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Target, b.Target))
+	})
+	return out[:min(len(out), c.n)]
+}
+
+// logTopTargets logs the top targets once per window until ctx is done.
+func logTopTargets(ctx context.Context, c *targetCounter, logger *slog.Logger) {
+	t := time.NewTicker(c.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if top := c.top(); len(top) > 0 {
+				logger.Info("top targets", "window", c.window, "targets", top)
+			}
+		}
+	}
+}
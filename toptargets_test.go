@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTargetCounterTop(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1_700_000_000, 0)
+	c := newTargetCounter(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	for _, target := range []string{"a.example:443", "B.example.:443", "b.example:443", "c.example:22", "c.example:22", "c.example:22"} {
+		c.record(target)
+	}
+	want := []targetCount{{"c.example:22", 3}, {"b.example:443", 2}}
+	if got := c.top(); !slices.Equal(got, want) {
+		t.Fatalf("top = %v, want %v", got, want)
+	}
+
+	// Counts from the oldest bucket age out once the window moves past it.
+	now = now.Add(30 * time.Second)
+	c.record("a.example:443")
+	c.record("a.example:443")
+	want = []targetCount{{"a.example:443", 3}, {"c.example:22", 3}} // ties by name
+	if got := c.top(); !slices.Equal(got, want) {
+		t.Fatalf("top within the window = %v, want %v", got, want)
+	}
+	now = now.Add(45 * time.Second)
+	want = []targetCount{{"a.example:443", 2}}
+	if got := c.top(); !slices.Equal(got, want) {
+		t.Fatalf("top after the first records aged out = %v, want %v", got, want)
+	}
+}
+
+func TestTargetCounterBoundsDistinctTargets(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1_700_000_000, 0)
+	c := newTargetCounter(1, time.Minute)
+	c.now = func() time.Time { return now }
+	for i := range maxSlotTargets + 5 {
+		c.record("scan.example:" + strconv.Itoa(i+1))
+	}
+	if got := c.top(); len(got) != 1 || got[0] != (targetCount{otherTargets, 5}) {
+		t.Fatalf("top = %v, want the overflow bucket", got)
+	}
+}
+
+func TestTargetCounterDisabled(t *testing.T) {
+	t.Parallel()
+
+	if c := newTargetCounter(0, time.Minute); c != nil {
+		t.Fatal("newTargetCounter(0, ...) should be nil")
+	}
+	var c *targetCounter
+	c.record("example.com:443")
+	if got := c.top(); got == nil || len(got) != 0 {
+		t.Fatalf("nil counter top = %#v, want an empty slice", got)
+	}
+}
+
+func TestTopTargetsExpvar(t *testing.T) {
+	// Not parallel: mutates the package-level targetCounts.
+	orig := targetCounts
+	defer func() { targetCounts = orig }()
+	targetCounts = newTargetCounter(5, time.Minute)
+	targetCounts.record("example.com:443")
+
+	var got []targetCount
+	if err := json.Unmarshal([]byte(expvar.Get("top_targets").String()), &got); err != nil {
+		t.Fatalf("decode top_targets: %v", err)
+	}
+	if len(got) != 1 || got[0] != (targetCount{"example.com:443", 1}) {
+		t.Fatalf("top_targets = %v", got)
+	}
+}